@@ -1 +1,17 @@
 # Include custom targets and environment variables here
+
+EVAL_BASELINE ?=
+EVAL_CANDIDATE ?=
+EVAL_JUDGE ?=
+EVAL_REPORT ?=
+
+## Compares the summaries of two summarizer configurations on the recorded threads of server/testdata/eval.
+.PHONY: eval
+eval:
+ifeq ($(EVAL_BASELINE),)
+	$(error EVAL_BASELINE must be set, for example EVAL_BASELINE=openai)
+endif
+ifeq ($(EVAL_CANDIDATE),)
+	$(error EVAL_CANDIDATE must be set, for example EVAL_CANDIDATE=openai:gpt-4)
+endif
+	$(GO) test -v -count=1 -run '^TestEval$$' ./server -eval.baseline=$(EVAL_BASELINE) -eval.candidate=$(EVAL_CANDIDATE) -eval.judge=$(EVAL_JUDGE) -eval.report=$(EVAL_REPORT)
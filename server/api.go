@@ -0,0 +1,674 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+	"github.com/pkg/errors"
+)
+
+const ContextUserIDKey = "user_id"
+
+// ServeHTTP routes the plugin REST API.
+func (p *Plugin) ServeHTTP(c *plugin.Context, w http.ResponseWriter, r *http.Request) {
+	router := gin.Default()
+	router.Use(p.MattermostAuthorizationRequired)
+	router.GET("/metrics", p.SystemAdminRequired, p.handleMetrics)
+
+	api := router.Group("/api/v1")
+	api.GET("/summarize/channel/:channelid", p.handleSummarizeChannel)
+	api.POST("/post/:postid/summarize", p.handleSummarizePost)
+	api.POST("/post/:postid/translate", p.handleTranslatePost)
+	api.POST("/post/:postid/summary/translate", p.handleTranslateSummary)
+	api.POST("/actions/action-items", p.handleActionItems)
+	api.GET("/health", p.SystemAdminRequired, p.handleHealth)
+
+	admin := api.Group("/admin")
+	admin.Use(p.SystemAdminRequired)
+	admin.GET("/usage", p.handleExportUsage)
+	admin.GET("/audit", p.handleSearchAuditLog)
+	admin.GET("/indexer", p.handleGetIndexerStatus)
+	admin.POST("/indexer/reindex", p.handleReindex)
+	admin.GET("/credentials", p.handleListCredentials)
+	admin.POST("/credentials", p.handleSetCredential)
+	admin.PUT("/credentials/:name", p.handleSetCredential)
+	admin.DELETE("/credentials/:name", p.handleDeleteCredential)
+
+	router.ServeHTTP(w, r)
+}
+
+func (p *Plugin) MattermostAuthorizationRequired(c *gin.Context) {
+	userID := c.GetHeader("Mattermost-User-ID")
+	if userID == "" {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	c.Set(ContextUserIDKey, userID)
+}
+
+func (p *Plugin) SystemAdminRequired(c *gin.Context) {
+	if !p.pluginAPI.User.HasPermissionTo(c.GetString(ContextUserIDKey), model.PermissionManageSystem) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "must be a system admin"})
+	}
+}
+
+// authorizeChannel applies the same rules as ExecuteCommand to a REST request, aborting it when
+// the user can't summarize the given channel.
+func (p *Plugin) authorizeChannel(c *gin.Context, userID, channelID string) (*model.Channel, bool) {
+	if !p.pluginAPI.User.HasPermissionToChannel(userID, channelID, model.PermissionReadChannel) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "you don't have access to this channel"})
+		return nil, false
+	}
+
+	channel, err := p.pluginAPI.Channel.Get(channelID)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return nil, false
+	}
+
+	if err = p.checkUsageRestrictions(userID, channel.TeamId, channel); err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	if _, err = p.checkChannelPolicy(channel); err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	return channel, true
+}
+
+// checkRequestLimits aborts the request when the user or their team is over a limit. It returns the
+// context to use for summarizer calls, which are charged to them.
+func (p *Plugin) checkRequestLimits(c *gin.Context, userID string, channel *model.Channel) (context.Context, bool) {
+	if err := p.checkLimits(userID, channel.TeamId); err != nil {
+		var limitErr *LimitExceededError
+		if errors.As(err, &limitErr) {
+			abortWithLimitExceeded(c, limitErr)
+			return nil, false
+		}
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return nil, false
+	}
+
+	return withRequestInfo(c.Request.Context(), RequestInfo{
+		UserID:    userID,
+		TeamID:    channel.TeamId,
+		ChannelID: channel.Id,
+	}), true
+}
+
+func abortWithLimitExceeded(c *gin.Context, limitErr *LimitExceededError) {
+	c.Header("Retry-After", strconv.Itoa(int(time.Until(limitErr.ResetAt).Seconds())+1))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": limitErr.Error()})
+}
+
+func (p *Plugin) abortWithSummarizerError(c *gin.Context, err error) {
+	// Limits are checked again before each call of a request to the backend.
+	var limitErr *LimitExceededError
+	if errors.As(err, &limitErr) {
+		abortWithLimitExceeded(c, limitErr)
+		return
+	}
+
+	status, message := p.handleLLMError(err, "user_id", c.GetString(ContextUserIDKey), "path", c.Request.URL.Path)
+	c.AbortWithStatusJSON(status, gin.H{"error": message})
+}
+
+func (p *Plugin) handleSummarizeChannel(c *gin.Context) {
+	userID := c.GetString(ContextUserIDKey)
+	channelID := c.Param("channelid")
+
+	channel, ok := p.authorizeChannel(c, userID, channelID)
+	if !ok {
+		return
+	}
+
+	filters, err := summaryFiltersFromQuery(c.Request.URL.Query(), time.Now())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err = p.resolveSummaryFilters(filters); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	structured := c.Query("format") == "structured"
+	digest := c.Query("digest") == "true"
+	if digest && structured {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "digest can't be combined with the structured format"})
+		return
+	}
+	if digest && filters.Since.IsZero() {
+		filters.Since = time.Now().Add(-defaultDigestWindow)
+	}
+
+	data, err := p.getChannelPostsAndMeta(channelID, filters)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if len(data.Posts) == 0 {
+		c.JSON(http.StatusOK, gin.H{
+			"result":     "",
+			"post_count": 0,
+		})
+		return
+	}
+
+	ctx, ok := p.checkRequestLimits(c, userID, channel)
+	if !ok {
+		return
+	}
+
+	language := p.resolveLanguage(userID, c.Query("lang"))
+	formattedThread, redactor := p.prepareThread(data)
+
+	if !structured && wantsDigest(digest, data) {
+		summary, digestErr := p.summarizeDigest(ctx, channelID, data, language)
+		if digestErr != nil {
+			p.abortWithSummarizerError(c, digestErr)
+			return
+		}
+		summary, verification := p.verifyText(summary, data)
+
+		c.JSON(http.StatusOK, gin.H{
+			"result":       summary,
+			"digest":       true,
+			"verification": verification,
+			"post_count":   len(data.Posts),
+		})
+		return
+	}
+
+	if structured {
+		p.auditSummarization(ctx, AuditOperationSummarizeStructured, "", data, formattedThread)
+		structuredSummary, structuredErr := p.getSummarizer().SummarizeThreadStructured(ctx, formattedThread, language)
+		if structuredErr != nil {
+			p.abortWithSummarizerError(c, structuredErr)
+			return
+		}
+		redactor.RestoreStructuredSummary(structuredSummary)
+		verification, note := p.verifyStructuredSummary(structuredSummary, data, redactor.Restore(formattedThread))
+
+		c.JSON(http.StatusOK, gin.H{
+			"result":       strings.TrimSpace(structuredSummary.ToMarkdown() + "\n\n" + note),
+			"structured":   structuredSummary,
+			"verification": verification,
+			"post_count":   len(data.Posts),
+		})
+		return
+	}
+
+	p.auditSummarization(ctx, AuditOperationSummarize, "", data, formattedThread)
+	summary, err := p.getSummarizer().SummarizeThread(ctx, formattedThread, language)
+	if err != nil {
+		p.abortWithSummarizerError(c, err)
+		return
+	}
+	summary, verification := p.verifyText(redactor.Restore(summary), data, redactor.Restore(formattedThread))
+
+	c.JSON(http.StatusOK, gin.H{
+		"result":       summary,
+		"verification": verification,
+		"post_count":   len(data.Posts),
+	})
+}
+
+func (p *Plugin) handleActionItems(c *gin.Context) {
+	userID := c.GetString(ContextUserIDKey)
+
+	var request model.PostActionIntegrationRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	if request.UserId != userID {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	// Only the context signed when the summary was made is trusted, the rest of the request comes
+	// from the client.
+	taskContext, items, err := p.verifyActionItems(request.Context)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid action items"})
+		return
+	}
+	if taskContext.RequestedBy != userID {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "only the user who got the summary can use its action items"})
+		return
+	}
+
+	channel, ok := p.authorizeChannel(c, userID, taskContext.ChannelID)
+	if !ok {
+		return
+	}
+	taskContext.TeamID = channel.TeamId
+
+	policy, err := p.getChannelPolicy(channel.Id)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if !policy.AllowsPublicPosts() {
+		c.JSON(http.StatusOK, &model.PostActionIntegrationResponse{
+			EphemeralText: "The policy of this channel doesn't allow sharing summary results with other people or tools.",
+		})
+		return
+	}
+
+	sinkName, _ := request.Context["sink"].(string)
+	sink, err := p.getTaskSink(sinkName)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	signature, _ := request.Context["signature"].(string)
+	claimed, err := p.claimActionItems(sinkName, signature)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if !claimed {
+		c.JSON(http.StatusOK, &model.PostActionIntegrationResponse{
+			EphemeralText: "These action items were already sent.",
+		})
+		return
+	}
+
+	result, err := sink.PushActionItems(taskContext, items)
+	if err != nil {
+		p.API.LogError("Failed to push action items", "sink", sinkName, "error", err.Error())
+		result = "Failed to process the action items: " + err.Error()
+		if err = p.releaseActionItems(sinkName, signature); err != nil {
+			p.API.LogError("Failed to release action items", "sink", sinkName, "error", err.Error())
+		}
+	}
+
+	c.JSON(http.StatusOK, &model.PostActionIntegrationResponse{
+		EphemeralText: result,
+	})
+}
+
+const (
+	SummaryDestinationRHS       = "rhs"
+	SummaryDestinationEphemeral = "ephemeral"
+)
+
+type SummarizePostRequest struct {
+	Destination string `json:"destination"`
+	Language    string `json:"language"`
+}
+
+// handleSummarizePost backs the "Summarize thread" post menu action. The summary is either
+// returned for the webapp to show in the RHS, or posted as an ephemeral reply in the thread.
+func (p *Plugin) handleSummarizePost(c *gin.Context) {
+	userID := c.GetString(ContextUserIDKey)
+
+	var request SummarizePostRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if request.Destination == "" {
+		request.Destination = SummaryDestinationRHS
+	}
+	if request.Destination != SummaryDestinationRHS && request.Destination != SummaryDestinationEphemeral {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "destination must be rhs or ephemeral"})
+		return
+	}
+
+	post, err := p.pluginAPI.Post.GetPost(c.Param("postid"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "post not found"})
+		return
+	}
+
+	channel, ok := p.authorizeChannel(c, userID, post.ChannelId)
+	if !ok {
+		return
+	}
+
+	rootID := post.RootId
+	if rootID == "" {
+		rootID = post.Id
+	}
+
+	data, err := p.getThreadAndMeta(rootID, &SummaryFilters{})
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	ctx, ok := p.checkRequestLimits(c, userID, channel)
+	if !ok {
+		return
+	}
+
+	formattedThread, redactor := p.prepareThread(data)
+	p.auditSummarization(ctx, AuditOperationSummarize, rootID, data, formattedThread)
+	summary, err := p.getSummarizer().SummarizeThread(ctx, formattedThread, p.resolveLanguage(userID, request.Language))
+	if err != nil {
+		p.abortWithSummarizerError(c, err)
+		return
+	}
+	summary, verification := p.verifyText(redactor.Restore(summary), data, redactor.Restore(formattedThread))
+
+	if request.Destination == SummaryDestinationEphemeral {
+		p.pluginAPI.Post.SendEphemeralPost(userID, &model.Post{
+			UserId:    p.botid,
+			ChannelId: post.ChannelId,
+			RootId:    rootID,
+			Message:   summary,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result":       summary,
+		"verification": verification,
+		"root_id":      rootID,
+		"channel_id":   post.ChannelId,
+		"post_count":   len(data.Posts),
+	})
+}
+
+type TranslatePostRequest struct {
+	Destination string `json:"destination"`
+	Language    string `json:"language"`
+}
+
+// handleTranslatePost translates every post of the thread, returning them for the RHS or posting
+// them as an ephemeral reply in the thread.
+func (p *Plugin) handleTranslatePost(c *gin.Context) {
+	userID := c.GetString(ContextUserIDKey)
+
+	var request TranslatePostRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if request.Destination == "" {
+		request.Destination = SummaryDestinationRHS
+	}
+	if request.Destination != SummaryDestinationRHS && request.Destination != SummaryDestinationEphemeral {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "destination must be rhs or ephemeral"})
+		return
+	}
+
+	post, err := p.pluginAPI.Post.GetPost(c.Param("postid"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "post not found"})
+		return
+	}
+
+	channel, ok := p.authorizeChannel(c, userID, post.ChannelId)
+	if !ok {
+		return
+	}
+
+	language := p.resolveLanguage(userID, request.Language)
+	if language == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "language is required"})
+		return
+	}
+
+	rootID := post.RootId
+	if rootID == "" {
+		rootID = post.Id
+	}
+
+	data, err := p.getThreadAndMeta(rootID, &SummaryFilters{})
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	ctx, ok := p.checkRequestLimits(c, userID, channel)
+	if !ok {
+		return
+	}
+
+	translations, err := p.translatePosts(ctx, rootID, data, language)
+	if err != nil {
+		p.abortWithSummarizerError(c, err)
+		return
+	}
+	result := formatTranslations(translations, language)
+
+	if request.Destination == SummaryDestinationEphemeral {
+		p.pluginAPI.Post.SendEphemeralPost(userID, &model.Post{
+			UserId:    p.botid,
+			ChannelId: post.ChannelId,
+			RootId:    rootID,
+			Message:   result,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result":       result,
+		"translations": translations,
+		"language":     language,
+		"root_id":      rootID,
+		"channel_id":   post.ChannelId,
+		"post_count":   len(data.Posts),
+	})
+}
+
+type TranslateSummaryRequest struct {
+	Summary  string `json:"summary"`
+	Language string `json:"language"`
+}
+
+// handleTranslateSummary translates a summary of the thread the user already got, without
+// summarizing the posts again. The summary is redacted and pseudonymized with the users of the
+// thread, and audited as made of the posts of the thread.
+func (p *Plugin) handleTranslateSummary(c *gin.Context) {
+	userID := c.GetString(ContextUserIDKey)
+
+	var request TranslateSummaryRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.Summary == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "summary is required"})
+		return
+	}
+
+	post, err := p.pluginAPI.Post.GetPost(c.Param("postid"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "post not found"})
+		return
+	}
+
+	channel, ok := p.authorizeChannel(c, userID, post.ChannelId)
+	if !ok {
+		return
+	}
+
+	language := p.resolveLanguage(userID, request.Language)
+	if language == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "language is required"})
+		return
+	}
+
+	rootID := post.RootId
+	if rootID == "" {
+		rootID = post.Id
+	}
+
+	data, err := p.getThreadAndMeta(rootID, &SummaryFilters{})
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	ctx, ok := p.checkRequestLimits(c, userID, channel)
+	if !ok {
+		return
+	}
+
+	_, redactor := p.prepareThread(data)
+	summary := redactor.RedactText(request.Summary)
+	p.auditSummarization(ctx, AuditOperationTranslate, rootID, data, summary)
+	translation, err := p.getSummarizer().Translate(ctx, summary, language)
+	if err != nil {
+		p.abortWithSummarizerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result":     redactor.Restore(translation),
+		"language":   language,
+		"root_id":    rootID,
+		"channel_id": post.ChannelId,
+	})
+}
+
+// parseTimeRangeQuery reads the since and until query parameters as milliseconds, aborting the
+// request when either is invalid.
+func parseTimeRangeQuery(c *gin.Context, since, until *int64) bool {
+	now := time.Now()
+	for param, target := range map[string]*int64{"since": since, "until": until} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		t, err := parseTimeFilter(value, now)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid value for " + param + ": " + err.Error()})
+			return false
+		}
+		*target = model.GetMillisForTime(t)
+	}
+
+	return true
+}
+
+// handleExportUsage exports the raw usage records as JSON or, with format=csv, as CSV for
+// chargeback.
+func (p *Plugin) handleExportUsage(c *gin.Context) {
+	query := UsageQuery{
+		UserID: c.Query("user_id"),
+		TeamID: c.Query("team_id"),
+	}
+	if !parseTimeRangeQuery(c, &query.Since, &query.Until) {
+		return
+	}
+
+	records, err := p.getUsageRecords(query)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if c.Query("format") != "csv" {
+		c.JSON(http.StatusOK, records)
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=llm-usage.csv")
+	c.Status(http.StatusOK)
+	c.Writer.Header().Set("Content-Type", "text/csv")
+
+	writer := csv.NewWriter(c.Writer)
+	_ = writer.Write([]string{"id", "create_at", "user_id", "team_id", "channel_id", "model", "prompt_tokens", "completion_tokens", "cost"})
+	for _, record := range records {
+		_ = writer.Write([]string{
+			record.Id,
+			time.UnixMilli(record.CreateAt).UTC().Format(time.RFC3339),
+			record.UserId,
+			record.TeamId,
+			record.ChannelId,
+			record.Model,
+			strconv.Itoa(record.PromptTokens),
+			strconv.Itoa(record.CompletionTokens),
+			strconv.FormatFloat(record.Cost, 'f', 6, 64),
+		})
+	}
+	writer.Flush()
+}
+
+func (p *Plugin) handleSearchAuditLog(c *gin.Context) {
+	query := AuditQuery{
+		UserID:    c.Query("user_id"),
+		ChannelID: c.Query("channel_id"),
+		PostID:    c.Query("post_id"),
+		Operation: c.Query("operation"),
+	}
+	if !parseTimeRangeQuery(c, &query.Since, &query.Until) {
+		return
+	}
+	for param, target := range map[string]*int{"page": &query.Page, "per_page": &query.PerPage} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid value for " + param})
+			return
+		}
+		*target = number
+	}
+
+	entries, err := p.searchAuditLog(query)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
+
+func (p *Plugin) handleGetIndexerStatus(c *gin.Context) {
+	status, err := p.getIndexerStatus()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+// handleReindex restarts the backfill from scratch. The indexer job picks it up on its next run.
+func (p *Plugin) handleReindex(c *gin.Context) {
+	if !p.semanticSearchEnabled() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "semantic search is disabled"})
+		return
+	}
+
+	progress, err := p.startBackfill()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, progress)
+}
+
+// handleMetrics exposes the metrics in the Prometheus text format. Scrapers authenticate with the
+// personal access token of a system admin.
+func (p *Plugin) handleMetrics(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	p.metrics.Write(c.Writer)
+}
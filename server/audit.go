@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"github.com/mattermost/mattermost-plugin-api/cluster"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	auditTable      = "LLMSummarize_Audit"
+	auditPostsTable = "LLMSummarize_AuditPosts"
+
+	AuditOperationSummarize           = "summarize"
+	AuditOperationSummarizeStructured = "summarize_structured"
+	AuditOperationQuestion            = "question"
+	AuditOperationTranslate           = "translate"
+	AuditOperationDigest              = "digest"
+	AuditOperationEmbed               = "embed"
+	AuditOperationAskAll              = "ask_all"
+
+	auditRetentionInterval = 24 * time.Hour
+	auditMaxPerPage        = 200
+)
+
+// AuditEntry records which posts were sent to which LLM, and on whose behalf.
+type AuditEntry struct {
+	Id        string   `json:"id"`
+	CreateAt  int64    `json:"create_at"`
+	UserId    string   `json:"user_id"`
+	TeamId    string   `json:"team_id"`
+	ChannelId string   `json:"channel_id"`
+	RootId    string   `json:"root_id"`
+	Operation string   `json:"operation"`
+	Backend   string   `json:"backend"`
+	Model     string   `json:"model"`
+	PostIds   string   `json:"-"`
+	Posts     []string `json:"post_ids" db:"-"`
+	Content   string   `json:"content,omitempty"`
+}
+
+// auditSummarization stores an audit entry for posts about to be sent to the summarizer. It is
+// called before the request so content is accounted for even when the request fails.
+func (p *Plugin) auditSummarization(ctx context.Context, operation, rootID string, data *ThreadData, content string) {
+	if p.db == nil {
+		return
+	}
+
+	info := requestInfoFromContext(ctx)
+	summarizerInfo := p.getSummarizer().Info()
+
+	postIDs := make([]string, 0, len(data.Posts))
+	for _, post := range data.Posts {
+		postIDs = append(postIDs, post.Id)
+	}
+	encodedPostIDs, err := json.Marshal(postIDs)
+	if err != nil {
+		p.API.LogError("Failed to encode audited post ids", "error", err.Error())
+		return
+	}
+
+	if !p.getConfiguration().AuditIncludeContent {
+		content = ""
+	}
+
+	entry := AuditEntry{
+		Id:        model.NewId(),
+		CreateAt:  model.GetMillis(),
+		UserId:    info.UserID,
+		TeamId:    info.TeamID,
+		ChannelId: info.ChannelID,
+		RootId:    rootID,
+		Operation: operation,
+		Backend:   summarizerInfo.Backend,
+		Model:     summarizerInfo.Model,
+		PostIds:   string(encodedPostIDs),
+		Content:   content,
+	}
+	if err := p.insertAuditEntry(entry, postIDs); err != nil {
+		p.API.LogError("Failed to store audit entry", "user_id", info.UserID, "channel_id", info.ChannelID, "error", err.Error())
+	}
+}
+
+// insertAuditEntry stores an audit entry along with one row per post, which is what searching by
+// post relies on.
+func (p *Plugin) insertAuditEntry(entry AuditEntry, postIDs []string) error {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	query, args, err := p.builder.Insert(auditTable).
+		SetMap(map[string]interface{}{
+			"Id":        entry.Id,
+			"CreateAt":  entry.CreateAt,
+			"UserId":    entry.UserId,
+			"TeamId":    entry.TeamId,
+			"ChannelId": entry.ChannelId,
+			"RootId":    entry.RootId,
+			"Operation": entry.Operation,
+			"Backend":   entry.Backend,
+			"Model":     entry.Model,
+			"PostIds":   entry.PostIds,
+			"Content":   entry.Content,
+		}).
+		ToSql()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(query, args...); err != nil {
+		return errors.Wrap(err, "failed to insert audit entry")
+	}
+
+	if err := p.insertAuditPosts(tx, entry, postIDs); err != nil {
+		return err
+	}
+
+	return errors.Wrap(tx.Commit(), "failed to commit audit entry")
+}
+
+func (p *Plugin) insertAuditPosts(tx *sqlx.Tx, entry AuditEntry, postIDs []string) error {
+	builder := p.builder.Insert(auditPostsTable).Columns("AuditId", "PostId", "CreateAt")
+	seen := make(map[string]bool, len(postIDs))
+	for _, postID := range postIDs {
+		if seen[postID] {
+			continue
+		}
+		seen[postID] = true
+		builder = builder.Values(entry.Id, postID, entry.CreateAt)
+	}
+	if len(seen) == 0 {
+		return nil
+	}
+
+	query, args, err := builder.ToSql()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(query, args...); err != nil {
+		return errors.Wrap(err, "failed to insert audited posts")
+	}
+
+	return nil
+}
+
+type AuditQuery struct {
+	Since     int64
+	Until     int64
+	UserID    string
+	ChannelID string
+	PostID    string
+	Operation string
+	Page      int
+	PerPage   int
+}
+
+func (p *Plugin) searchAuditLog(q AuditQuery) ([]AuditEntry, error) {
+	builder := p.builder.Select("*").From(auditTable)
+	if q.Since != 0 {
+		builder = builder.Where(sq.GtOrEq{"CreateAt": q.Since})
+	}
+	if q.Until != 0 {
+		builder = builder.Where(sq.LtOrEq{"CreateAt": q.Until})
+	}
+	if q.UserID != "" {
+		builder = builder.Where(sq.Eq{"UserId": q.UserID})
+	}
+	if q.ChannelID != "" {
+		builder = builder.Where(sq.Eq{"ChannelId": q.ChannelID})
+	}
+	if q.Operation != "" {
+		builder = builder.Where(sq.Eq{"Operation": q.Operation})
+	}
+	if q.PostID != "" {
+		// The subquery keeps the default placeholders, the outer builder rewrites them.
+		builder = builder.Where(sq.Expr("Id IN (?)", sq.Select("AuditId").From(auditPostsTable).Where(sq.Eq{"PostId": q.PostID})))
+	}
+
+	if q.PerPage <= 0 || q.PerPage > auditMaxPerPage {
+		q.PerPage = auditMaxPerPage
+	}
+	if q.Page < 0 {
+		q.Page = 0
+	}
+
+	query, args, err := builder.
+		OrderBy("CreateAt DESC").
+		Limit(uint64(q.PerPage)).
+		Offset(uint64(q.Page * q.PerPage)).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []AuditEntry{}
+	if err := p.db.Select(&entries, query, args...); err != nil {
+		return nil, errors.Wrap(err, "failed to search audit log")
+	}
+
+	for i := range entries {
+		if err := json.Unmarshal([]byte(entries[i].PostIds), &entries[i].Posts); err != nil {
+			return nil, errors.Wrapf(err, "invalid post ids in audit entry %s", entries[i].Id)
+		}
+	}
+
+	return entries, nil
+}
+
+func (p *Plugin) startAuditRetentionJob() error {
+	job, err := cluster.Schedule(p.API, "audit_retention", cluster.MakeWaitForRoundedInterval(auditRetentionInterval), p.pruneAuditLog)
+	if err != nil {
+		return errors.Wrap(err, "failed to schedule audit retention job")
+	}
+	p.auditRetentionJob = job
+
+	return nil
+}
+
+// pruneAuditLog deletes the audit entries older than the configured retention.
+func (p *Plugin) pruneAuditLog() {
+	days := p.getConfiguration().AuditRetentionDays
+	if days <= 0 || p.db == nil {
+		return
+	}
+
+	cutoff := model.GetMillisForTime(time.Now().AddDate(0, 0, -days))
+	var result sql.Result
+	for _, table := range []string{auditPostsTable, auditTable} {
+		query, args, err := p.builder.Delete(table).Where(sq.Lt{"CreateAt": cutoff}).ToSql()
+		if err != nil {
+			p.API.LogError("Failed to build audit retention query", "error", err.Error())
+			return
+		}
+
+		if result, err = p.db.Exec(query, args...); err != nil {
+			p.API.LogError("Failed to prune audit log", "table", table, "error", err.Error())
+			return
+		}
+	}
+
+	if deleted, err := result.RowsAffected(); err == nil && deleted > 0 {
+		p.API.LogInfo("Pruned audit log", "deleted", deleted, "retention_days", days)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var auditColumns = []string{"Id", "CreateAt", "UserId", "TeamId", "ChannelId", "RootId", "Operation", "Backend", "Model", "PostIds", "Content"}
+
+func TestAuditSummarization(t *testing.T) {
+	ctx := withRequestInfo(context.Background(), RequestInfo{UserID: testUserID, TeamID: testTeamID, ChannelID: testChannelID})
+	data := &ThreadData{Posts: []*model.Post{{Id: "post1"}, {Id: "post2"}, {Id: "post1"}}}
+
+	for name, tc := range map[string]struct {
+		includeContent bool
+		content        string
+	}{
+		"without content": {false, ""},
+		"with content":    {true, "[1] alice: hi"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p, _, _ := newTestPlugin(t, &configuration{AuditIncludeContent: tc.includeContent})
+			db := newFakeDB(p, model.DatabaseDriverPostgres)
+
+			p.auditSummarization(ctx, AuditOperationSummarize, "root1", data, "[1] alice: hi")
+
+			entries := db.Statements("INSERT INTO LLMSummarize_Audit ")
+			require.Len(t, entries, 1)
+			// SetMap sorts the columns by name.
+			args := entries[0].Args
+			require.Len(t, args, 11)
+			auditID := args[4]
+			assert.Equal(t, []driver.Value{"fake", testChannelID, tc.content, args[3], auditID, "fake-model", AuditOperationSummarize, `["post1","post2","post1"]`, "root1", testTeamID, testUserID}, args)
+
+			posts := db.Statements("INSERT INTO LLMSummarize_AuditPosts ")
+			require.Len(t, posts, 1)
+			assert.Equal(t, []driver.Value{auditID, "post1", args[3], auditID, "post2", args[3]}, posts[0].Args, "each post is indexed once")
+			assert.Equal(t, 1, db.committed)
+		})
+	}
+
+	t.Run("without a database", func(t *testing.T) {
+		p, _, _ := newTestPlugin(t, nil)
+		p.auditSummarization(ctx, AuditOperationSummarize, "root1", data, "")
+	})
+}
+
+func TestSearchAuditLog(t *testing.T) {
+	p, _, _ := newTestPlugin(t, nil)
+	db := newFakeDB(p, model.DatabaseDriverPostgres)
+	db.returnRows("SELECT * FROM LLMSummarize_Audit", auditColumns,
+		[]driver.Value{"audit1", int64(2000), testUserID, testTeamID, testChannelID, "", AuditOperationTranslate, "fake", "fake-model", `["post1"]`, ""},
+	)
+
+	entries, err := p.searchAuditLog(AuditQuery{Since: 1000, UserID: testUserID, PostID: "post1", Operation: AuditOperationTranslate, Page: 2, PerPage: 10})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, []string{"post1"}, entries[0].Posts)
+	assert.Equal(t, AuditOperationTranslate, entries[0].Operation)
+
+	statements := db.Statements("SELECT")
+	require.Len(t, statements, 1)
+	assert.Equal(t, "SELECT * FROM LLMSummarize_Audit WHERE CreateAt >= $1 AND UserId = $2 AND Operation = $3 AND "+
+		"Id IN (SELECT AuditId FROM LLMSummarize_AuditPosts WHERE PostId = $4) ORDER BY CreateAt DESC LIMIT 10 OFFSET 20", statements[0].SQL)
+	assert.Equal(t, []driver.Value{int64(1000), testUserID, AuditOperationTranslate, "post1"}, statements[0].Args)
+
+	// Pages are capped.
+	_, err = p.searchAuditLog(AuditQuery{Page: -1, PerPage: 1000})
+	require.NoError(t, err)
+	statements = db.Statements("SELECT")
+	assert.Equal(t, "SELECT * FROM LLMSummarize_Audit ORDER BY CreateAt DESC LIMIT 200 OFFSET 0", statements[1].SQL)
+}
+
+func TestPruneAuditLog(t *testing.T) {
+	t.Run("retention disabled", func(t *testing.T) {
+		p, _, _ := newTestPlugin(t, nil)
+		db := newFakeDB(p, model.DatabaseDriverPostgres)
+
+		p.pruneAuditLog()
+		assert.Empty(t, db.Statements(""))
+	})
+
+	t.Run("entries older than the retention are deleted", func(t *testing.T) {
+		p, api, _ := newTestPlugin(t, &configuration{AuditRetentionDays: 30})
+		db := newFakeDB(p, model.DatabaseDriverPostgres)
+		db.rowsAffected = 3
+		api.On("LogInfo", "Pruned audit log", "deleted", int64(3), "retention_days", 30).Once()
+
+		p.pruneAuditLog()
+		statements := db.Statements("DELETE")
+		require.Len(t, statements, 2)
+		assert.Equal(t, "DELETE FROM LLMSummarize_AuditPosts WHERE CreateAt < $1", statements[0].SQL)
+		assert.Equal(t, "DELETE FROM LLMSummarize_Audit WHERE CreateAt < $1", statements[1].SQL)
+
+		cutoff := model.GetMillisForTime(time.Now().AddDate(0, 0, -30))
+		for _, statement := range statements {
+			require.Len(t, statement.Args, 1)
+			assert.InDelta(t, cutoff, statement.Args[0], float64(time.Minute.Milliseconds()))
+		}
+	})
+}
+
+func TestHandleSearchAuditLog(t *testing.T) {
+	p, api, _ := newTestPlugin(t, nil)
+	db := newFakeDB(p, model.DatabaseDriverPostgres)
+	db.returnRows("SELECT * FROM LLMSummarize_Audit", auditColumns,
+		[]driver.Value{"audit1", int64(2000), testUserID, testTeamID, testChannelID, "", AuditOperationSummarize, "fake", "fake-model", `["post1","post2"]`, ""},
+	)
+	api.On("HasPermissionTo", testUserID, model.PermissionManageSystem).Return(true)
+	api.On("HasPermissionTo", "regularuserregularuserreg1", model.PermissionManageSystem).Return(false)
+
+	request := func(userID, query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/admin/audit"+query, nil)
+		r.Header.Set("Mattermost-User-ID", userID)
+		p.ServeHTTP(nil, w, r)
+		return w
+	}
+
+	w := request(testUserID, "?post_id=post2&page=1&per_page=50")
+	require.Equal(t, http.StatusOK, w.Code)
+	var entries []map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+	require.Len(t, entries, 1)
+	assert.Equal(t, []interface{}{"post1", "post2"}, entries[0]["post_ids"])
+	assert.NotContains(t, entries[0], "content", "empty content is omitted")
+	statements := db.Statements("SELECT")
+	require.Len(t, statements, 1)
+	assert.Equal(t, []driver.Value{"post2"}, statements[0].Args)
+	assert.Contains(t, statements[0].SQL, "LIMIT 50 OFFSET 50")
+
+	assert.Equal(t, http.StatusForbidden, request("regularuserregularuserreg1", "").Code)
+	assert.Equal(t, http.StatusBadRequest, request(testUserID, "?page=first").Code)
+	assert.Equal(t, http.StatusBadRequest, request(testUserID, "?since=yesterday-ish").Code)
+	assert.Len(t, db.Statements("SELECT"), 1, "invalid requests don't reach the database")
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	channelPolicyKeyPrefix = "channel_policy_"
+
+	ChannelPolicyEnabled       = "enabled"
+	ChannelPolicyDisabled      = "disabled"
+	ChannelPolicyNoPublicPosts = "no-public-posts"
+)
+
+// ChannelPolicy is set by channel admins to restrict what the plugin can do in their channel.
+type ChannelPolicy struct {
+	Mode string `json:"mode"`
+
+	// Backend, when set, is the only summarizer backend allowed to receive the channel content.
+	Backend string `json:"backend,omitempty"`
+
+	UpdatedBy string `json:"updated_by,omitempty"`
+	UpdatedAt int64  `json:"updated_at,omitempty"`
+}
+
+// AllowsPublicPosts reports whether results may be shared beyond the requesting user, for example
+// with DMs to other users or an external task tracker.
+func (c *ChannelPolicy) AllowsPublicPosts() bool {
+	return c.Mode != ChannelPolicyNoPublicPosts
+}
+
+func (c *ChannelPolicy) Description() string {
+	var description string
+	switch c.Mode {
+	case ChannelPolicyDisabled:
+		description = "Summarization is **disabled** in this channel."
+	case ChannelPolicyNoPublicPosts:
+		description = "Summarization is **allowed**, but results are only ever shown to the requesting user."
+	default:
+		description = "Summarization is **allowed** in this channel."
+	}
+
+	if c.Backend != "" {
+		description += fmt.Sprintf(" Content may only be sent to the `%s` backend.", c.Backend)
+	}
+
+	return description
+}
+
+func (p *Plugin) getChannelPolicy(channelID string) (*ChannelPolicy, error) {
+	policy := &ChannelPolicy{Mode: ChannelPolicyEnabled}
+	if err := p.pluginAPI.KV.Get(channelPolicyKeyPrefix+channelID, policy); err != nil {
+		return nil, errors.Wrap(err, "failed to get channel policy")
+	}
+
+	return policy, nil
+}
+
+func (p *Plugin) saveChannelPolicy(channelID string, policy *ChannelPolicy) error {
+	if _, err := p.pluginAPI.KV.Set(channelPolicyKeyPrefix+channelID, policy); err != nil {
+		return errors.Wrap(err, "failed to save channel policy")
+	}
+
+	return nil
+}
+
+// checkChannelPolicy returns the policy of the channel, or an error explaining why its content
+// can't be summarized. Direct and group messages also need the consent of every participant.
+func (p *Plugin) checkChannelPolicy(channel *model.Channel) (*ChannelPolicy, error) {
+	policy, err := p.getChannelPolicy(channel.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	violation, err := p.channelPolicyViolation(channel, policy, p.getSummarizer().Info().Backend)
+	if err != nil {
+		return nil, err
+	}
+	if violation != "" {
+		return nil, errors.New(violation)
+	}
+
+	return policy, nil
+}
+
+// channelPolicyViolation explains why the content of the channel can't be sent to the backend,
+// or returns "" when it can.
+func (p *Plugin) channelPolicyViolation(channel *model.Channel, policy *ChannelPolicy, backend string) (string, error) {
+	if policy.Mode == ChannelPolicyDisabled {
+		return "Summarization has been disabled in this channel by its admins.", nil
+	}
+
+	if policy.Backend != "" && policy.Backend != backend {
+		return fmt.Sprintf("This channel can only be summarized with the %s backend, which is not the one configured.", policy.Backend), nil
+	}
+
+	if isConversation(channel) {
+		missing, err := p.missingConsents(channel)
+		if err != nil {
+			return "", err
+		}
+		if len(missing) > 0 {
+			return fmt.Sprintf("Every participant must consent before this conversation can be summarized. Waiting for %s to run `/summarize consent grant`.", strings.Join(missing, ", ")), nil
+		}
+	}
+
+	return "", nil
+}
+
+func (p *Plugin) canManageChannelPolicy(userID, channelID string) bool {
+	return p.pluginAPI.User.HasPermissionTo(userID, model.PermissionManageSystem) ||
+		p.pluginAPI.User.HasPermissionToChannel(userID, channelID, model.PermissionManageChannelRoles)
+}
+
+const channelPolicyUsage = "Usage: `/summarize channel-policy [show | enable | disable | no-public-posts | backend <name|any>]`"
+
+// executeChannelPolicyCommand shows or changes the policy of the current channel. Changes are
+// restricted to channel and system admins.
+func (p *Plugin) executeChannelPolicyCommand(args *model.CommandArgs, params []string) (*model.CommandResponse, error) {
+	policy, err := p.getChannelPolicy(args.ChannelId)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(params) == 0 || params[0] == "show" {
+		return ephemeralResponse(args, policy.Description()), nil
+	}
+
+	if !p.canManageChannelPolicy(args.UserId, args.ChannelId) {
+		return ephemeralResponse(args, "Only channel admins can change the summarization policy of this channel."), nil
+	}
+
+	switch params[0] {
+	case "enable":
+		policy.Mode = ChannelPolicyEnabled
+	case "disable":
+		policy.Mode = ChannelPolicyDisabled
+	case "no-public-posts":
+		policy.Mode = ChannelPolicyNoPublicPosts
+	case "backend":
+		if len(params) != 2 {
+			return ephemeralResponse(args, channelPolicyUsage), nil
+		}
+		policy.Backend = strings.ToLower(params[1])
+		if policy.Backend == "any" {
+			policy.Backend = ""
+		}
+	default:
+		return ephemeralResponse(args, channelPolicyUsage), nil
+	}
+
+	policy.UpdatedBy = args.UserId
+	policy.UpdatedAt = model.GetMillis()
+	if err := p.saveChannelPolicy(args.ChannelId, policy); err != nil {
+		return nil, err
+	}
+
+	if policy.Mode == ChannelPolicyDisabled || (policy.Backend != "" && policy.Backend != embeddingsBackend) {
+		if err := p.removeChannelFromIndex(args.ChannelId); err != nil {
+			return nil, err
+		}
+	}
+
+	return ephemeralResponse(args, "Channel policy updated. "+policy.Description()), nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelPolicyCommand(t *testing.T) {
+	for name, tc := range map[string]struct {
+		command      string
+		systemAdmin  bool
+		channelAdmin bool
+		stored       string
+		expectedText string
+		expected     *ChannelPolicy
+	}{
+		"show the default policy": {
+			command:      "/summarize channel-policy",
+			expectedText: "Summarization is **allowed** in this channel.",
+		},
+		"show a restricted policy": {
+			command:      "/summarize channel-policy show",
+			stored:       `{"mode": "no-public-posts", "backend": "openai"}`,
+			expectedText: "Summarization is **allowed**, but results are only ever shown to the requesting user. Content may only be sent to the `openai` backend.",
+		},
+		"disable as a channel admin": {
+			command:      "/summarize channel-policy disable",
+			channelAdmin: true,
+			expectedText: "Channel policy updated. Summarization is **disabled** in this channel.",
+			expected:     &ChannelPolicy{Mode: ChannelPolicyDisabled},
+		},
+		"restrict public posts as a system admin": {
+			command:      "/summarize channel-policy no-public-posts",
+			systemAdmin:  true,
+			expectedText: "Channel policy updated. Summarization is **allowed**, but results are only ever shown to the requesting user.",
+			expected:     &ChannelPolicy{Mode: ChannelPolicyNoPublicPosts},
+		},
+		"enable keeps the backend": {
+			command:      "/summarize channel-policy enable",
+			channelAdmin: true,
+			stored:       `{"mode": "disabled", "backend": "openai"}`,
+			expectedText: "Channel policy updated. Summarization is **allowed** in this channel. Content may only be sent to the `openai` backend.",
+			expected:     &ChannelPolicy{Mode: ChannelPolicyEnabled, Backend: "openai"},
+		},
+		"restrict the backend": {
+			command:      "/summarize channel-policy backend OpenAI",
+			channelAdmin: true,
+			expectedText: "Channel policy updated. Summarization is **allowed** in this channel. Content may only be sent to the `openai` backend.",
+			expected:     &ChannelPolicy{Mode: ChannelPolicyEnabled, Backend: "openai"},
+		},
+		"allow any backend": {
+			command:      "/summarize channel-policy backend any",
+			channelAdmin: true,
+			stored:       `{"mode": "enabled", "backend": "openai"}`,
+			expectedText: "Channel policy updated. Summarization is **allowed** in this channel.",
+			expected:     &ChannelPolicy{Mode: ChannelPolicyEnabled},
+		},
+		"members can't change the policy": {
+			command:      "/summarize channel-policy disable",
+			expectedText: "Only channel admins can change the summarization policy of this channel.",
+		},
+		"missing backend": {
+			command:      "/summarize channel-policy backend",
+			channelAdmin: true,
+			expectedText: channelPolicyUsage,
+		},
+		"unknown mode": {
+			command:      "/summarize channel-policy everyone",
+			channelAdmin: true,
+			expectedText: channelPolicyUsage,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p, api, summarizer := newTestPlugin(t, nil)
+			api.On("GetChannel", testChannelID).Return(&model.Channel{Id: testChannelID, TeamId: testTeamID, Type: model.ChannelTypeOpen}, nil)
+			store := mockKVStore(api, channelPolicyKeyPrefix)
+			if tc.stored != "" {
+				store[channelPolicyKeyPrefix+testChannelID] = []byte(tc.stored)
+			}
+			api.On("HasPermissionTo", testUserID, model.PermissionManageSystem).Return(tc.systemAdmin).Maybe()
+			api.On("HasPermissionToChannel", testUserID, testChannelID, model.PermissionManageChannelRoles).Return(tc.channelAdmin).Maybe()
+
+			response, appErr := p.ExecuteCommand(nil, summarizeArgs(tc.command, ""))
+			require.Nil(t, appErr)
+			assert.Equal(t, model.CommandResponseTypeEphemeral, response.ResponseType)
+			assert.Equal(t, tc.expectedText, response.Text)
+			assert.Empty(t, summarizer.Calls())
+
+			if tc.expected == nil {
+				if tc.stored == "" {
+					assert.Empty(t, store, "the policy is unchanged")
+				} else {
+					assert.JSONEq(t, tc.stored, string(store[channelPolicyKeyPrefix+testChannelID]), "the policy is unchanged")
+				}
+				return
+			}
+
+			var saved ChannelPolicy
+			require.NoError(t, json.Unmarshal(store[channelPolicyKeyPrefix+testChannelID], &saved))
+			assert.Equal(t, testUserID, saved.UpdatedBy)
+			assert.NotZero(t, saved.UpdatedAt)
+			saved.UpdatedBy, saved.UpdatedAt = "", 0
+			assert.Equal(t, *tc.expected, saved)
+		})
+	}
+}
+
+func TestCheckChannelPolicy(t *testing.T) {
+	channel := &model.Channel{Id: testChannelID, TeamId: testTeamID, Type: model.ChannelTypeOpen}
+
+	for name, tc := range map[string]struct {
+		stored            string
+		expectedErr       string
+		allowsPublicPosts bool
+	}{
+		"no policy":                     {allowsPublicPosts: true},
+		"enabled":                       {stored: `{"mode": "enabled"}`, allowsPublicPosts: true},
+		"disabled":                      {stored: `{"mode": "disabled"}`, expectedErr: "Summarization has been disabled in this channel by its admins."},
+		"no public posts":               {stored: `{"mode": "no-public-posts"}`},
+		"restricted to the backend":     {stored: `{"mode": "enabled", "backend": "fake"}`, allowsPublicPosts: true},
+		"restricted to another backend": {stored: `{"mode": "enabled", "backend": "openai"}`, expectedErr: "This channel can only be summarized with the openai backend, which is not the one configured."},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p, api, _ := newTestPlugin(t, nil)
+			store := mockKVStore(api, channelPolicyKeyPrefix)
+			if tc.stored != "" {
+				store[channelPolicyKeyPrefix+testChannelID] = []byte(tc.stored)
+			}
+
+			policy, err := p.checkChannelPolicy(channel)
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+				assert.Nil(t, policy)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.allowsPublicPosts, policy.AllowsPublicPosts())
+		})
+	}
+
+	t.Run("requests to a disabled channel are refused", func(t *testing.T) {
+		p, api, summarizer := newTestPlugin(t, nil)
+		api.On("HasPermissionToChannel", testUserID, testChannelID, model.PermissionReadChannel).Return(true)
+		api.On("GetChannel", testChannelID).Return(channel, nil)
+		store := mockKVStore(api, channelPolicyKeyPrefix)
+		store[channelPolicyKeyPrefix+testChannelID] = []byte(`{"mode": "disabled"}`)
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/summarize/channel/"+testChannelID, nil)
+		r.Header.Set("Mattermost-User-ID", testUserID)
+		p.ServeHTTP(nil, w, r)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, w.Body.String(), "disabled in this channel")
+		assert.Empty(t, summarizer.Calls())
+	})
+}
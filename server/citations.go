@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+)
+
+// citationPattern matches citations like [3] or [2, 5]. replaceCitations decides which matches
+// are actually citations.
+var citationPattern = regexp.MustCompile(`\[(\d+(?:\s*,\s*\d+)*)\]`)
+
+// linkCitations turns the citations of the posts numbered by formatThread into permalinks.
+func (p *Plugin) linkCitations(text string, posts []*model.Post) string {
+	return replaceCitations(text, posts, p.permalink)
+}
+
+// replaceCitations links every cited post number to the post. A bracketed list of numbers is a
+// citation when it follows prose, separated by a space or by another citation, and when every
+// number is a post. Anything else, like arr[0], [2023] or text in code, is left alone.
+func replaceCitations(text string, posts []*model.Post, permalink func(postID string) string) string {
+	code := codeRanges(text)
+
+	var sb strings.Builder
+	last := 0
+	for _, match := range citationPattern.FindAllStringSubmatchIndex(text, -1) {
+		start, end := match[0], match[1]
+		if inRanges(code, start) || (end < len(text) && text[end] == '(') {
+			continue
+		}
+		chained := last > 0 && start == last
+		if !chained && !followsProse(text, start) {
+			continue
+		}
+
+		links := []string{}
+		for _, number := range strings.Split(text[match[2]:match[3]], ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(number))
+			if err != nil || n < 1 || n > len(posts) {
+				links = nil
+				break
+			}
+			links = append(links, fmt.Sprintf("[[%d]](%s)", n, permalink(posts[n-1].Id)))
+		}
+		if links == nil {
+			continue
+		}
+
+		sb.WriteString(text[last:start])
+		sb.WriteString(strings.Join(links, ""))
+		last = end
+	}
+	sb.WriteString(text[last:])
+
+	return sb.String()
+}
+
+// followsProse returns whether the text before start ends with a space preceded by some text on the
+// same line.
+func followsProse(text string, start int) bool {
+	if start == 0 || !unicode.IsSpace(rune(text[start-1])) {
+		return false
+	}
+
+	lineStart := strings.LastIndexByte(text[:start], '\n') + 1
+	return strings.TrimSpace(text[lineStart:start]) != ""
+}
+
+// codeRanges returns the byte ranges of the fenced code blocks and inline code spans of markdown
+// text.
+func codeRanges(text string) [][2]int {
+	ranges := [][2]int{}
+	fence := ""
+	offset := 0
+	for _, line := range strings.SplitAfter(text, "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		switch {
+		case fence != "":
+			ranges = append(ranges, [2]int{offset, offset + len(line)})
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+			}
+		case strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~"):
+			ranges = append(ranges, [2]int{offset, offset + len(line)})
+			fence = trimmed[:3]
+		default:
+			for _, span := range inlineCodeSpans(line) {
+				ranges = append(ranges, [2]int{offset + span[0], offset + span[1]})
+			}
+		}
+		offset += len(line)
+	}
+
+	return ranges
+}
+
+// inlineCodeSpans returns the ranges of the code spans of a line, delimited by runs of backticks
+// of the same length.
+func inlineCodeSpans(line string) [][2]int {
+	spans := [][2]int{}
+	for i := 0; i < len(line); {
+		if line[i] != '`' {
+			i++
+			continue
+		}
+
+		run := i
+		for run < len(line) && line[run] == '`' {
+			run++
+		}
+		delimiter := line[i:run]
+
+		closing := -1
+		for j := run; j < len(line); {
+			k := strings.Index(line[j:], delimiter)
+			if k < 0 {
+				break
+			}
+			k += j
+			end := k + len(delimiter)
+			if end == len(line) || line[end] != '`' {
+				closing = end
+				break
+			}
+			for end < len(line) && line[end] == '`' {
+				end++
+			}
+			j = end
+		}
+		if closing < 0 {
+			i = run
+			continue
+		}
+
+		spans = append(spans, [2]int{i, closing})
+		i = closing
+	}
+
+	return spans
+}
+
+func inRanges(ranges [][2]int, position int) bool {
+	for _, r := range ranges {
+		if position >= r[0] && position < r[1] {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplaceCitations(t *testing.T) {
+	posts := []*model.Post{{Id: "first"}, {Id: "second"}, {Id: "third"}}
+	permalink := func(postID string) string { return "https://chat/pl/" + postID }
+
+	for name, tc := range map[string]struct {
+		text     string
+		expected string
+	}{
+		"single citation": {
+			text:     "Alice will deploy [1].",
+			expected: "Alice will deploy [[1]](https://chat/pl/first).",
+		},
+		"grouped and adjacent citations": {
+			text:     "It was agreed [1, 3][2]",
+			expected: "It was agreed [[1]](https://chat/pl/first)[[3]](https://chat/pl/third)[[2]](https://chat/pl/second)",
+		},
+		"numbers that aren't posts are kept": {
+			text:     "Nobody said that [7]. Bob did [0, 2]. Planned for [2023].",
+			expected: "Nobody said that [7]. Bob did [0, 2]. Planned for [2023].",
+		},
+		"existing links are kept": {
+			text:     "See [1](https://example.com) and [docs].",
+			expected: "See [1](https://example.com) and [docs].",
+		},
+		"indexing is kept": {
+			text:     "Read arr[0] and items[2] first [3].",
+			expected: "Read arr[0] and items[2] first [[3]](https://chat/pl/third).",
+		},
+		"only after prose": {
+			text:     "[1] is the first post.\n [2] too, unlike [3]",
+			expected: "[1] is the first post.\n [2] too, unlike [[3]](https://chat/pl/third)",
+		},
+		"inline code is kept": {
+			text:     "Use `list [1]` or ``a ` [2]`` as said [1].",
+			expected: "Use `list [1]` or ``a ` [2]`` as said [[1]](https://chat/pl/first).",
+		},
+		"fenced code is kept": {
+			text:     "Bob shared [2]:\n```go\nx := a [1]\n```\n~~~\ny [3]\n~~~\nDone [3].",
+			expected: "Bob shared [[2]](https://chat/pl/second):\n```go\nx := a [1]\n```\n~~~\ny [3]\n~~~\nDone [[3]](https://chat/pl/third).",
+		},
+		"unclosed backticks are prose": {
+			text:     "A stray ` before [1].",
+			expected: "A stray ` before [[1]](https://chat/pl/first).",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, replaceCitations(tc.text, posts, permalink))
+		})
+	}
+}
+
+func TestFormatThreadNumbersPosts(t *testing.T) {
+	data := &ThreadData{
+		Posts: []*model.Post{
+			{UserId: "alice", ChannelId: "town", Message: "hello"},
+			{UserId: "bob", ChannelId: "dev", Message: "hi"},
+		},
+		UsersByID: map[string]*model.User{
+			"alice": {Username: "alice"},
+			"bob":   {Username: "bob"},
+		},
+	}
+	assert.Equal(t, "[1] alice: hello\n\n[2] bob: hi\n\n", formatThread(data))
+
+	data.ChannelsByID = map[string]*model.Channel{"town": {DisplayName: "Town Square"}, "dev": {Name: "dev"}}
+	assert.Equal(t, "[1] alice in Town Square: hello\n\n[2] bob in dev: hi\n\n", formatThread(data))
+}
@@ -2,10 +2,16 @@ package main
 
 import (
 	"reflect"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
+const (
+	defaultLLMRequestTimeout  = 60 * time.Second
+	defaultSemanticSearchTopK = 20
+)
+
 // configuration captures the plugin's external configuration as exposed in the Mattermost server
 // configuration, as well as values computed from the configuration. Any public fields will be
 // deserialized from the Mattermost server configuration in OnConfigurationChange.
@@ -19,10 +25,51 @@ import (
 // copy appropriate for your types.
 type configuration struct {
 	OpenAIAPIKey string
+	OpenAIAPIURL string
+
+	LLMRequestTimeoutSeconds int
+	LLMMaxRetries            int
 
 	AllowPrivateChannels bool
+	AllowDirectMessages  bool
+	AllowGroupMessages   bool
 	AllowedTeamIDs       string
 	AllowedUserIDs       string
+
+	TaskWebhookURL    string
+	TaskWebhookSecret string
+
+	UserRequestsPerHour   int
+	TeamRequestsPerHour   int
+	UserDailyTokenQuota   int
+	UserMonthlyTokenQuota int
+	TeamDailyTokenQuota   int
+	TeamMonthlyTokenQuota int
+
+	UsagePriceTable string
+
+	AuditIncludeContent bool
+	AuditRetentionDays  int
+
+	RedactBuiltinPatterns bool
+	RedactionRules        string
+	PseudonymizeUsernames bool
+
+	RemoveUnverifiedClaims bool
+
+	EnableSemanticSearch bool
+	EmbeddingModel       string
+	EmbeddingDimensions  int
+	EmbeddingAPIURL      string
+	SemanticSearchTopK   int
+
+	WorkspaceSearchExcludedChannelIDs string
+
+	// modelPrices is computed from UsagePriceTable in OnConfigurationChange.
+	modelPrices map[string]ModelPrice
+
+	// redactionRules is computed from RedactionRules in OnConfigurationChange.
+	redactionRules []redactionRule
 }
 
 // Clone shallow copies the configuration. Your implementation may require a deep copy if
@@ -32,6 +79,24 @@ func (c *configuration) Clone() *configuration {
 	return &clone
 }
 
+// requestTimeout returns the deadline for a single summarizer call, including its retries.
+func (c *configuration) requestTimeout() time.Duration {
+	if c.LLMRequestTimeoutSeconds <= 0 {
+		return defaultLLMRequestTimeout
+	}
+
+	return time.Duration(c.LLMRequestTimeoutSeconds) * time.Second
+}
+
+// semanticSearchTopK returns how many chunks are retrieved for a question.
+func (c *configuration) semanticSearchTopK() int {
+	if c.SemanticSearchTopK <= 0 {
+		return defaultSemanticSearchTopK
+	}
+
+	return c.SemanticSearchTopK
+}
+
 // getConfiguration retrieves the active configuration under lock, making it safe to use
 // concurrently. The active configuration may change underneath the client of this method, but
 // the struct returned by this API call is considered immutable.
@@ -82,7 +147,30 @@ func (p *Plugin) OnConfigurationChange() error {
 		return errors.Wrap(err, "failed to load plugin configuration")
 	}
 
+	prices, err := parseModelPrices(configuration.UsagePriceTable)
+	if err != nil {
+		return err
+	}
+	configuration.modelPrices = prices
+
+	rules, err := parseRedactionRules(configuration.RedactionRules)
+	if err != nil {
+		return err
+	}
+	configuration.redactionRules = rules
+
 	p.setConfiguration(configuration)
 
+	// At startup the configuration is loaded before the plugin is activated, which migrates the
+	// API key, builds the backends and checks them then. Clearing a migrated key saves the
+	// configuration again, which is a no-op here.
+	if p.pluginAPI != nil {
+		p.moveAPIKeyToCredentials()
+		if err := p.configureBackends(configuration); err != nil {
+			return err
+		}
+		p.scheduleConfigurationCheck()
+	}
+
 	return nil
 }
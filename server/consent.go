@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	consentKeyPrefix = "consent_"
+
+	// maxConversationMembers covers the largest group message Mattermost allows.
+	maxConversationMembers = 100
+)
+
+func isConversation(channel *model.Channel) bool {
+	return channel.Type == model.ChannelTypeDirect || channel.Type == model.ChannelTypeGroup
+}
+
+// getConsents returns the IDs of the users who agreed to have the conversation summarized.
+func (p *Plugin) getConsents(channelID string) (map[string]bool, error) {
+	consents := map[string]bool{}
+	if err := p.pluginAPI.KV.Get(consentKeyPrefix+channelID, &consents); err != nil {
+		return nil, errors.Wrap(err, "failed to get consents")
+	}
+
+	return consents, nil
+}
+
+func (p *Plugin) setConsent(channelID, userID string, granted bool) error {
+	return p.pluginAPI.KV.SetAtomicWithRetries(consentKeyPrefix+channelID, func(oldValue []byte) (interface{}, error) {
+		consents := map[string]bool{}
+		if len(oldValue) > 0 {
+			if err := json.Unmarshal(oldValue, &consents); err != nil {
+				return nil, err
+			}
+		}
+
+		if granted {
+			consents[userID] = true
+		} else {
+			delete(consents, userID)
+		}
+
+		return consents, nil
+	})
+}
+
+// conversationMember is a human participant of a DM or GM.
+type conversationMember struct {
+	ID       string
+	Username string
+}
+
+// conversationMembers returns the human participants of a DM or GM. The members of these channels
+// never change, so they are only listed the first time.
+func (p *Plugin) conversationMembers(channelID string) ([]conversationMember, error) {
+	if members, ok := p.conversationMembersCache.Load(channelID); ok {
+		return members.([]conversationMember), nil
+	}
+
+	users, err := p.pluginAPI.User.ListInChannel(channelID, model.ChannelSortByUsername, 0, maxConversationMembers)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list conversation members")
+	}
+
+	members := []conversationMember{}
+	for _, user := range users {
+		if !user.IsBot {
+			members = append(members, conversationMember{ID: user.Id, Username: user.Username})
+		}
+	}
+	p.conversationMembersCache.Store(channelID, members)
+
+	return members, nil
+}
+
+// missingConsents returns the usernames of the human participants of a DM or GM who haven't
+// consented to it being summarized.
+func (p *Plugin) missingConsents(channel *model.Channel) ([]string, error) {
+	consents, err := p.getConsents(channel.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := p.conversationMembers(channel.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	missing := []string{}
+	for _, member := range members {
+		if !consents[member.ID] {
+			missing = append(missing, "@"+member.Username)
+		}
+	}
+	sort.Strings(missing)
+
+	return missing, nil
+}
+
+const consentUsage = "Usage: `/summarize consent [show | grant | revoke]`"
+
+// executeConsentCommand lets the participants of a DM or GM agree to, or withdraw from, having
+// the conversation summarized.
+func (p *Plugin) executeConsentCommand(args *model.CommandArgs, params []string) (*model.CommandResponse, error) {
+	channel, err := p.pluginAPI.Channel.Get(args.ChannelId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isConversation(channel) {
+		return ephemeralResponse(args, "Consent is only needed in direct and group messages."), nil
+	}
+
+	action := "show"
+	if len(params) > 0 {
+		action = params[0]
+	}
+
+	switch action {
+	case "grant", "revoke":
+		if err = p.setConsent(channel.Id, args.UserId, action == "grant"); err != nil {
+			return nil, err
+		}
+		if action == "revoke" {
+			if err = p.removeChannelFromIndex(channel.Id); err != nil {
+				return nil, err
+			}
+		}
+	case "show":
+	default:
+		return ephemeralResponse(args, consentUsage), nil
+	}
+
+	missing, err := p.missingConsents(channel)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(missing) == 0 {
+		return ephemeralResponse(args, "Everyone in this conversation has consented to it being summarized."), nil
+	}
+
+	return ephemeralResponse(args, fmt.Sprintf("Waiting for consent from %s. They can give it by running `/summarize consent grant` here.", strings.Join(missing, ", "))), nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testConversationMembers = []*model.User{
+	{Id: testUserID, Username: "alice"},
+	{Id: testOtherID, Username: "bob"},
+	{Id: "botbotbotbotbotbotbotbotb1", Username: "llmbot", IsBot: true},
+}
+
+// mockConversation makes the test channel a conversation of the given type between alice, bob
+// and a bot. Its policy and consents are kept in the returned store.
+func mockConversation(api *plugintest.API, channelType model.ChannelType) map[string][]byte {
+	api.On("GetChannel", testChannelID).Return(&model.Channel{Id: testChannelID, Type: channelType}, nil)
+	api.On("GetUsersInChannel", testChannelID, model.ChannelSortByUsername, 0, maxConversationMembers).Return(testConversationMembers, nil).Maybe()
+	return mockKVStore(api, channelPolicyKeyPrefix, consentKeyPrefix)
+}
+
+func TestMissingConsents(t *testing.T) {
+	channel := &model.Channel{Id: testChannelID, Type: model.ChannelTypeGroup}
+
+	for name, tc := range map[string]struct {
+		consents string
+		expected []string
+	}{
+		"nobody consented":     {expected: []string{"@alice", "@bob"}},
+		"one participant":      {consents: `{"` + testOtherID + `": true}`, expected: []string{"@alice"}},
+		"every participant":    {consents: `{"` + testUserID + `": true, "` + testOtherID + `": true}`, expected: []string{}},
+		"a former participant": {consents: `{"formerformerformerformerf1": true}`, expected: []string{"@alice", "@bob"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p, api, _ := newTestPlugin(t, nil)
+			api.On("GetUsersInChannel", testChannelID, model.ChannelSortByUsername, 0, maxConversationMembers).Return(testConversationMembers, nil).Once()
+			store := mockKVStore(api, consentKeyPrefix)
+			if tc.consents != "" {
+				store[consentKeyPrefix+testChannelID] = []byte(tc.consents)
+			}
+
+			missing, err := p.missingConsents(channel)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, missing)
+
+			// The members are only listed once.
+			missing, err = p.missingConsents(channel)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, missing)
+		})
+	}
+}
+
+func TestConsentCommand(t *testing.T) {
+	for name, tc := range map[string]struct {
+		channelType  model.ChannelType
+		consents     string
+		command      string
+		expectedText string
+		expected     map[string]bool
+	}{
+		"not a conversation": {
+			channelType:  model.ChannelTypeOpen,
+			command:      "/summarize consent grant",
+			expectedText: "Consent is only needed in direct and group messages.",
+		},
+		"show": {
+			channelType:  model.ChannelTypeDirect,
+			command:      "/summarize consent",
+			expectedText: "Waiting for consent from @alice, @bob. They can give it by running `/summarize consent grant` here.",
+		},
+		"grant": {
+			channelType:  model.ChannelTypeGroup,
+			command:      "/summarize consent grant",
+			expectedText: "Waiting for consent from @bob. They can give it by running `/summarize consent grant` here.",
+			expected:     map[string]bool{testUserID: true},
+		},
+		"last grant": {
+			channelType:  model.ChannelTypeDirect,
+			consents:     `{"` + testOtherID + `": true}`,
+			command:      "/summarize consent grant",
+			expectedText: "Everyone in this conversation has consented to it being summarized.",
+			expected:     map[string]bool{testUserID: true, testOtherID: true},
+		},
+		"revoke": {
+			channelType:  model.ChannelTypeGroup,
+			consents:     `{"` + testUserID + `": true, "` + testOtherID + `": true}`,
+			command:      "/summarize consent revoke",
+			expectedText: "Waiting for consent from @alice. They can give it by running `/summarize consent grant` here.",
+			expected:     map[string]bool{testOtherID: true},
+		},
+		"unknown action": {
+			channelType:  model.ChannelTypeDirect,
+			command:      "/summarize consent always",
+			expectedText: consentUsage,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p, api, summarizer := newTestPlugin(t, &configuration{AllowDirectMessages: true, AllowGroupMessages: true})
+			store := mockConversation(api, tc.channelType)
+			if tc.consents != "" {
+				store[consentKeyPrefix+testChannelID] = []byte(tc.consents)
+			}
+
+			response, appErr := p.ExecuteCommand(nil, summarizeArgs(tc.command, ""))
+			require.Nil(t, appErr)
+			assert.Equal(t, tc.expectedText, response.Text)
+			assert.Empty(t, summarizer.Calls())
+
+			if tc.expected != nil {
+				consents, err := p.getConsents(testChannelID)
+				require.NoError(t, err)
+				assert.Equal(t, tc.expected, consents)
+			}
+		})
+	}
+}
+
+func TestConversationPolicy(t *testing.T) {
+	t.Run("summaries wait for every participant", func(t *testing.T) {
+		p, api, summarizer := newTestPlugin(t, &configuration{AllowDirectMessages: true})
+		store := mockConversation(api, model.ChannelTypeDirect)
+		store[consentKeyPrefix+testChannelID] = []byte(`{"` + testUserID + `": true}`)
+
+		response, appErr := p.ExecuteCommand(nil, summarizeArgs("/summarize", testRootID))
+		require.Nil(t, appErr)
+		assert.Equal(t, "Every participant must consent before this conversation can be summarized. Waiting for @bob to run `/summarize consent grant`.", response.Text)
+		assert.Empty(t, summarizer.Calls())
+	})
+
+	t.Run("summaries are allowed once everyone consented", func(t *testing.T) {
+		p, api, summarizer := newTestPlugin(t, &configuration{AllowGroupMessages: true})
+		store := mockConversation(api, model.ChannelTypeGroup)
+		store[consentKeyPrefix+testChannelID] = []byte(`{"` + testUserID + `": true, "` + testOtherID + `": true}`)
+		mockThread(api)
+
+		response, appErr := p.ExecuteCommand(nil, summarizeArgs("/summarize", testRootID))
+		require.Nil(t, appErr)
+		assert.Equal(t, "summary of 2 posts", response.Text)
+		assert.Equal(t, []string{"SummarizeThread"}, summarizer.Calls())
+	})
+
+	t.Run("a disabled policy applies to conversations too", func(t *testing.T) {
+		p, api, summarizer := newTestPlugin(t, &configuration{AllowDirectMessages: true})
+		api.On("GetChannel", testChannelID).Return(&model.Channel{Id: testChannelID, Type: model.ChannelTypeDirect}, nil)
+		store := mockKVStore(api, channelPolicyKeyPrefix)
+		store[channelPolicyKeyPrefix+testChannelID] = []byte(`{"mode": "disabled"}`)
+
+		response, appErr := p.ExecuteCommand(nil, summarizeArgs("/summarize", testRootID))
+		require.Nil(t, appErr)
+		assert.Equal(t, "Summarization has been disabled in this channel by its admins.", response.Text)
+		assert.Empty(t, summarizer.Calls())
+	})
+}
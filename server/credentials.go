@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	credentialsKey = "credentials"
+
+	// defaultCredentialName is used for the key migrated from the plugin configuration.
+	defaultCredentialName = "default"
+
+	CredentialBackendOpenAI     = "openai"
+	CredentialBackendEmbeddings = "embeddings"
+
+	// credentialKeyContext separates the keys derived for this plugin from other uses of the at rest
+	// encryption key of the server.
+	credentialKeyContext = "summarize-plugin-credentials:"
+)
+
+var credentialNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// ErrNoAPIKey is returned when no credential, nor the deprecated configuration setting, provides
+// an API key for a backend.
+var ErrNoAPIKey = errors.New("no API key is configured")
+
+// Credential is an API key stored encrypted in the KV store. A credential with a team is only used
+// for requests made in that team, one without is used for every other team.
+type Credential struct {
+	Name         string `json:"name"`
+	Backend      string `json:"backend"`
+	TeamID       string `json:"team_id"`
+	EncryptedKey []byte `json:"encrypted_key"`
+	KeyHint      string `json:"key_hint"`
+	UpdatedAt    int64  `json:"updated_at"`
+	UpdatedBy    string `json:"updated_by"`
+}
+
+// CredentialInfo describes a credential without its key. It is all the API ever returns.
+type CredentialInfo struct {
+	Name      string `json:"name"`
+	Backend   string `json:"backend"`
+	TeamID    string `json:"team_id"`
+	KeyHint   string `json:"key_hint"`
+	UpdatedAt int64  `json:"updated_at"`
+	UpdatedBy string `json:"updated_by"`
+}
+
+func (c *Credential) Info() CredentialInfo {
+	return CredentialInfo{
+		Name:      c.Name,
+		Backend:   c.Backend,
+		TeamID:    c.TeamID,
+		KeyHint:   c.KeyHint,
+		UpdatedAt: c.UpdatedAt,
+		UpdatedBy: c.UpdatedBy,
+	}
+}
+
+func isCredentialBackend(backend string) bool {
+	return backend == CredentialBackendOpenAI || backend == CredentialBackendEmbeddings
+}
+
+// keyHint keeps the last characters of a key so admins can tell which one is stored.
+func keyHint(apiKey string) string {
+	if len(apiKey) <= 8 {
+		return "****"
+	}
+
+	return "****" + apiKey[len(apiKey)-4:]
+}
+
+// credentialCipher derives the AES-256 key protecting the credentials from the at rest encryption
+// key of the server, so the KV store alone is not enough to read them.
+func (p *Plugin) credentialCipher() (cipher.AEAD, error) {
+	config := p.API.GetUnsanitizedConfig()
+	if config == nil || config.SqlSettings.AtRestEncryptKey == nil || *config.SqlSettings.AtRestEncryptKey == "" {
+		return nil, errors.New("the server has no at rest encryption key")
+	}
+
+	key := sha256.Sum256([]byte(credentialKeyContext + *config.SqlSettings.AtRestEncryptKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create cipher")
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// encryptAPIKey seals the key with AES-GCM, prefixing the random nonce. The credential name is
+// authenticated so a sealed key can't be moved to another credential.
+func (p *Plugin) encryptAPIKey(name, apiKey string) ([]byte, error) {
+	aead, err := p.credentialCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "failed to generate nonce")
+	}
+
+	return aead.Seal(nonce, nonce, []byte(apiKey), []byte(name)), nil
+}
+
+func (p *Plugin) decryptAPIKey(name string, sealed []byte) (string, error) {
+	aead, err := p.credentialCipher()
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.Errorf("credential %q is corrupted", name)
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(name))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to decrypt credential %q", name)
+	}
+
+	return string(plain), nil
+}
+
+func (p *Plugin) getCredentials() (map[string]*Credential, error) {
+	credentials := map[string]*Credential{}
+	if err := p.pluginAPI.KV.Get(credentialsKey, &credentials); err != nil {
+		return nil, errors.Wrap(err, "failed to get credentials")
+	}
+
+	return credentials, nil
+}
+
+// updateCredentials applies update to the stored credentials atomically.
+func (p *Plugin) updateCredentials(update func(credentials map[string]*Credential) error) error {
+	return p.pluginAPI.KV.SetAtomicWithRetries(credentialsKey, func(oldValue []byte) (interface{}, error) {
+		credentials := map[string]*Credential{}
+		if len(oldValue) > 0 {
+			if err := json.Unmarshal(oldValue, &credentials); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := update(credentials); err != nil {
+			return nil, err
+		}
+
+		return credentials, nil
+	})
+}
+
+// CredentialConflictError is returned when another credential already has the backend and team.
+type CredentialConflictError struct {
+	Name string
+}
+
+func (e *CredentialConflictError) Error() string {
+	return fmt.Sprintf("credential %q is already used for this backend and team", e.Name)
+}
+
+// setCredential encrypts and stores a key, replacing the credential of the same name. Replacing a
+// credential rotates its key: the next request uses it, on every node, without a restart.
+func (p *Plugin) setCredential(name, backend, teamID, apiKey, userID string) (*Credential, error) {
+	encrypted, err := p.encryptAPIKey(name, apiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	credential := &Credential{
+		Name:         name,
+		Backend:      backend,
+		TeamID:       teamID,
+		EncryptedKey: encrypted,
+		KeyHint:      keyHint(apiKey),
+		UpdatedAt:    model.GetMillis(),
+		UpdatedBy:    userID,
+	}
+	err = p.updateCredentials(func(credentials map[string]*Credential) error {
+		for _, other := range credentials {
+			if other.Name != name && other.Backend == backend && other.TeamID == teamID {
+				return &CredentialConflictError{Name: other.Name}
+			}
+		}
+		credentials[name] = credential
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return credential, nil
+}
+
+func (p *Plugin) deleteCredential(name string) (bool, error) {
+	found := false
+	err := p.updateCredentials(func(credentials map[string]*Credential) error {
+		_, found = credentials[name]
+		delete(credentials, name)
+		return nil
+	})
+
+	return found, err
+}
+
+// findCredential picks the credential of the team for the backend, or the one shared by every team.
+func findCredential(credentials map[string]*Credential, backend, teamID string) *Credential {
+	var shared *Credential
+	for _, credential := range credentials {
+		if credential.Backend != backend {
+			continue
+		}
+		if teamID != "" && credential.TeamID == teamID {
+			return credential
+		}
+		if credential.TeamID == "" {
+			shared = credential
+		}
+	}
+
+	return shared
+}
+
+// resolveAPIKey returns the key to use for a request to the backend, in the team of the request
+// info found in ctx. Embeddings fall back to the completion credentials, and both fall back to the
+// deprecated OpenAIAPIKey setting. The store is read on every request so rotated keys apply at once.
+func (p *Plugin) resolveAPIKey(ctx context.Context, backend string) (string, error) {
+	credentials, err := p.getCredentials()
+	if err != nil {
+		return "", err
+	}
+
+	teamID := requestInfoFromContext(ctx).TeamID
+	credential := findCredential(credentials, backend, teamID)
+	if credential == nil && backend == CredentialBackendEmbeddings {
+		credential = findCredential(credentials, CredentialBackendOpenAI, teamID)
+	}
+	if credential != nil {
+		return p.decryptAPIKey(credential.Name, credential.EncryptedKey)
+	}
+
+	if apiKey := strings.TrimSpace(p.getConfiguration().OpenAIAPIKey); apiKey != "" {
+		return apiKey, nil
+	}
+
+	return "", ErrNoAPIKey
+}
+
+func (p *Plugin) apiKeyResolver(backend string) APIKeyResolver {
+	return func(ctx context.Context) (string, error) {
+		return p.resolveAPIKey(ctx, backend)
+	}
+}
+
+// migrateAPIKey moves a key set in the plugin configuration to the default credential, and clears
+// the setting so the key is no longer readable in the System Console. A key entered after the
+// first migration is newer than the stored one, so it replaces the default credential.
+func (p *Plugin) migrateAPIKey() error {
+	apiKey := strings.TrimSpace(p.getConfiguration().OpenAIAPIKey)
+	if apiKey == "" {
+		return nil
+	}
+
+	credentials, err := p.getCredentials()
+	if err != nil {
+		return err
+	}
+	if _, err = p.setCredential(defaultCredentialName, CredentialBackendOpenAI, "", apiKey, ""); err != nil {
+		return err
+	}
+	if _, ok := credentials[defaultCredentialName]; ok {
+		p.API.LogWarn("Replaced the default credential with the OpenAI API key set in the plugin configuration", "credential", defaultCredentialName)
+	}
+
+	pluginConfig := p.API.GetPluginConfig()
+	for key := range pluginConfig {
+		if strings.EqualFold(key, "OpenAIAPIKey") {
+			pluginConfig[key] = ""
+		}
+	}
+	if appErr := p.API.SavePluginConfig(pluginConfig); appErr != nil {
+		return errors.Wrap(appErr, "failed to clear the API key from the configuration")
+	}
+
+	p.API.LogInfo("Moved the OpenAI API key from the plugin configuration to the encrypted credentials", "credential", defaultCredentialName)
+	return nil
+}
+
+// APIKeyResolver returns the API key to authenticate a request with.
+type APIKeyResolver func(ctx context.Context) (string, error)
+
+func staticAPIKey(apiKey string) APIKeyResolver {
+	return func(context.Context) (string, error) {
+		return apiKey, nil
+	}
+}
+
+// apiKeyTransport authenticates every request with the key resolved at the time it is sent.
+type apiKeyTransport struct {
+	base   http.RoundTripper
+	apiKey APIKeyResolver
+}
+
+func (t *apiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	apiKey, err := t.apiKey(req.Context())
+	if err == nil && apiKey == "" {
+		err = ErrNoAPIKey
+	}
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, &LLMError{Kind: LLMErrorAuth, Err: err}
+	}
+
+	authenticated := req.Clone(req.Context())
+	authenticated.Header.Set("Authorization", "Bearer "+apiKey)
+
+	return t.base.RoundTrip(authenticated)
+}
+
+// newAuthenticatedClient returns the HTTP client used to reach an OpenAI compatible API.
+func newAuthenticatedClient(apiKey APIKeyResolver, maxRetries int) *http.Client {
+	return &http.Client{
+		Transport: &apiKeyTransport{
+			base:   newRetryTransport(http.DefaultTransport, maxRetries),
+			apiKey: apiKey,
+		},
+	}
+}
+
+func (p *Plugin) handleListCredentials(c *gin.Context) {
+	credentials, err := p.getCredentials()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	infos := make([]CredentialInfo, 0, len(credentials))
+	for _, credential := range credentials {
+		infos = append(infos, credential.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+
+	c.JSON(http.StatusOK, infos)
+}
+
+// handleSetCredential stores or rotates a credential, named by the path or, when posted to the
+// collection, by the request. The key is write-only: neither this endpoint nor any other returns
+// it.
+func (p *Plugin) handleSetCredential(c *gin.Context) {
+	var request struct {
+		Name    string `json:"name"`
+		Backend string `json:"backend"`
+		TeamID  string `json:"team_id"`
+		APIKey  string `json:"api_key"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	name := c.Param("name")
+	if name == "" {
+		name = request.Name
+	}
+	if name == "" {
+		name = defaultCredentialName
+	}
+	if !credentialNameRegexp.MatchString(name) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "credential names are made of lowercase letters, digits, dashes and underscores"})
+		return
+	}
+
+	if request.Backend == "" {
+		request.Backend = CredentialBackendOpenAI
+	}
+	if !isCredentialBackend(request.Backend) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "backend must be openai or embeddings"})
+		return
+	}
+	request.APIKey = strings.TrimSpace(request.APIKey)
+	if request.APIKey == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "api_key is required"})
+		return
+	}
+	if request.TeamID != "" {
+		if _, err := p.pluginAPI.Team.Get(request.TeamID); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown team"})
+			return
+		}
+	}
+
+	credential, err := p.setCredential(name, request.Backend, request.TeamID, request.APIKey, c.GetString(ContextUserIDKey))
+	var conflictErr *CredentialConflictError
+	if errors.As(err, &conflictErr) {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": conflictErr.Error()})
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	p.API.LogInfo("Credential updated", "credential", name, "backend", request.Backend, "team_id", request.TeamID, "user_id", c.GetString(ContextUserIDKey))
+	c.JSON(http.StatusOK, credential.Info())
+}
+
+func (p *Plugin) handleDeleteCredential(c *gin.Context) {
+	name := c.Param("name")
+	found, err := p.deleteCredential(name)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if !found {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	p.API.LogInfo("Credential deleted", "credential", name, "user_id", c.GetString(ContextUserIDKey))
+
+	c.Status(http.StatusNoContent)
+}
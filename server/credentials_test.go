@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// mockCredentialStore keeps the credentials record in memory and provides the at rest encryption
+// key of the server.
+func mockCredentialStore(api *plugintest.API) map[string][]byte {
+	store := mockKVStore(api, credentialsKey)
+
+	config := &model.Config{}
+	config.SetDefaults()
+	config.SqlSettings.AtRestEncryptKey = model.NewString("abcdefghijklmnopqrstuvwxyz012345")
+	api.On("GetUnsanitizedConfig").Return(config).Maybe()
+
+	return store
+}
+
+func TestCredentialEncryption(t *testing.T) {
+	p, api, _ := newTestPlugin(t, nil)
+	mockCredentialStore(api)
+
+	sealed, err := p.encryptAPIKey("default", "sk-secret")
+	require.NoError(t, err)
+	assert.NotContains(t, string(sealed), "sk-secret")
+
+	apiKey, err := p.decryptAPIKey("default", sealed)
+	require.NoError(t, err)
+	assert.Equal(t, "sk-secret", apiKey)
+
+	// A key sealed for a credential can't be read as another one.
+	_, err = p.decryptAPIKey("other", sealed)
+	assert.Error(t, err)
+
+	assert.Equal(t, "****cret", keyHint("sk-1234-secret"))
+	assert.Equal(t, "****", keyHint("short"))
+}
+
+func TestResolveAPIKey(t *testing.T) {
+	p, api, _ := newTestPlugin(t, &configuration{OpenAIAPIKey: "sk-config"})
+	mockCredentialStore(api)
+	teamCtx := withRequestInfo(context.Background(), RequestInfo{TeamID: testTeamID})
+	otherTeamCtx := withRequestInfo(context.Background(), RequestInfo{TeamID: "otherteamotherteamotherte1"})
+
+	resolve := func(ctx context.Context, backend string) string {
+		apiKey, err := p.resolveAPIKey(ctx, backend)
+		require.NoError(t, err)
+		return apiKey
+	}
+
+	// The deprecated setting is used until a credential is stored.
+	assert.Equal(t, "sk-config", resolve(teamCtx, CredentialBackendOpenAI))
+
+	_, err := p.setCredential("default", CredentialBackendOpenAI, "", "sk-shared", testUserID)
+	require.NoError(t, err)
+	_, err = p.setCredential("team", CredentialBackendOpenAI, testTeamID, "sk-team", testUserID)
+	require.NoError(t, err)
+
+	assert.Equal(t, "sk-team", resolve(teamCtx, CredentialBackendOpenAI))
+	assert.Equal(t, "sk-shared", resolve(otherTeamCtx, CredentialBackendOpenAI))
+	assert.Equal(t, "sk-shared", resolve(context.Background(), CredentialBackendOpenAI))
+	assert.Equal(t, "sk-team", resolve(teamCtx, CredentialBackendEmbeddings), "embeddings fall back to the completion credentials")
+
+	_, err = p.setCredential("embeddings", CredentialBackendEmbeddings, "", "sk-embeddings", testUserID)
+	require.NoError(t, err)
+	assert.Equal(t, "sk-embeddings", resolve(teamCtx, CredentialBackendEmbeddings))
+
+	// Rotating a key applies to the next request.
+	_, err = p.setCredential("team", CredentialBackendOpenAI, testTeamID, "sk-rotated", testUserID)
+	require.NoError(t, err)
+	assert.Equal(t, "sk-rotated", resolve(teamCtx, CredentialBackendOpenAI))
+
+	_, err = p.setCredential("duplicate", CredentialBackendOpenAI, testTeamID, "sk-other", testUserID)
+	assert.Error(t, err)
+
+	found, err := p.deleteCredential("team")
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "sk-shared", resolve(teamCtx, CredentialBackendOpenAI))
+
+	p.setConfiguration(&configuration{})
+	_, err = p.deleteCredential("default")
+	require.NoError(t, err)
+	_, err = p.resolveAPIKey(teamCtx, CredentialBackendOpenAI)
+	assert.ErrorIs(t, err, ErrNoAPIKey)
+}
+
+func TestMigrateAPIKey(t *testing.T) {
+	resolve := func(t *testing.T, p *Plugin) string {
+		apiKey, err := p.resolveAPIKey(context.Background(), CredentialBackendOpenAI)
+		require.NoError(t, err)
+		return apiKey
+	}
+	mockClearedConfig := func(api *plugintest.API, apiKey string) {
+		api.On("GetPluginConfig").Return(map[string]interface{}{"openaiapikey": apiKey, "openaiapiurl": "https://api.openai.com/v1"}).Once()
+		api.On("SavePluginConfig", map[string]interface{}{"openaiapikey": "", "openaiapiurl": "https://api.openai.com/v1"}).Return(nil).Once()
+		api.On("LogInfo", "Moved the OpenAI API key from the plugin configuration to the encrypted credentials", "credential", defaultCredentialName).Once()
+	}
+
+	t.Run("nothing to migrate", func(t *testing.T) {
+		p, _, _ := newTestPlugin(t, nil)
+		require.NoError(t, p.migrateAPIKey())
+	})
+
+	t.Run("the key becomes the default credential", func(t *testing.T) {
+		p, api, _ := newTestPlugin(t, &configuration{OpenAIAPIKey: " sk-config "})
+		mockCredentialStore(api)
+		mockClearedConfig(api, " sk-config ")
+
+		require.NoError(t, p.migrateAPIKey())
+		p.setConfiguration(&configuration{})
+		assert.Equal(t, "sk-config", resolve(t, p))
+	})
+
+	t.Run("a new key replaces the default credential", func(t *testing.T) {
+		p, api, _ := newTestPlugin(t, &configuration{OpenAIAPIKey: "sk-new"})
+		mockCredentialStore(api)
+		_, err := p.setCredential(defaultCredentialName, CredentialBackendOpenAI, "", "sk-old", testUserID)
+		require.NoError(t, err)
+		mockClearedConfig(api, "sk-new")
+		api.On("LogWarn", "Replaced the default credential with the OpenAI API key set in the plugin configuration", "credential", defaultCredentialName).Once()
+
+		require.NoError(t, p.migrateAPIKey())
+		p.setConfiguration(&configuration{})
+		assert.Equal(t, "sk-new", resolve(t, p))
+	})
+
+	t.Run("a key entered while the plugin runs is migrated", func(t *testing.T) {
+		p, api, _ := newTestPlugin(t, nil)
+		t.Cleanup(p.stopConfigurationCheck)
+		mockCredentialStore(api)
+		apiKey := "sk-entered"
+		api.On("LoadPluginConfiguration", mock.Anything).Run(func(args mock.Arguments) {
+			args.Get(0).(*configuration).OpenAIAPIKey = apiKey
+		}).Return(nil)
+		mockClearedConfig(api, apiKey)
+
+		require.NoError(t, p.OnConfigurationChange())
+		assert.Equal(t, "sk-entered", resolve(t, p))
+
+		// The configuration saved without the key doesn't migrate anything.
+		apiKey = ""
+		require.NoError(t, p.OnConfigurationChange())
+		assert.Equal(t, "sk-entered", resolve(t, p))
+	})
+}
+
+func TestAPIKeyTransport(t *testing.T) {
+	var authorization []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = append(authorization, r.Header.Get("Authorization"))
+		_, _ = w.Write([]byte(`{"choices": [{"message": {"role": "assistant", "content": "Summary"}}]}`))
+	}))
+	defer server.Close()
+
+	apiKey := "sk-first"
+	summarizer := NewOpenAISummarizer(func(context.Context) (string, error) { return apiKey, nil }, server.URL+"/v1", time.Second, 0, nil)
+
+	_, err := summarizer.SummarizeThread(context.Background(), "thread", "")
+	require.NoError(t, err)
+	apiKey = "sk-second"
+	_, err = summarizer.SummarizeThread(context.Background(), "thread", "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Bearer sk-first", "Bearer sk-second"}, authorization)
+
+	apiKey = ""
+	_, err = summarizer.SummarizeThread(context.Background(), "thread", "")
+	var llmErr *LLMError
+	require.ErrorAs(t, err, &llmErr)
+	assert.Equal(t, LLMErrorAuth, llmErr.Kind)
+	assert.Len(t, authorization, 2, "no request is sent without a key")
+}
+
+func TestCredentialsAPI(t *testing.T) {
+	p, api, _ := newTestPlugin(t, nil)
+	store := mockCredentialStore(api)
+	api.On("HasPermissionTo", testUserID, model.PermissionManageSystem).Return(true)
+	api.On("GetTeam", testTeamID).Return(&model.Team{Id: testTeamID}, nil)
+	api.On("GetTeam", "unknown").Return(nil, model.NewAppError("GetTeam", "not_found", nil, "", http.StatusNotFound))
+	api.On("LogInfo", "Credential updated", "credential", "team", "backend", CredentialBackendOpenAI, "team_id", testTeamID, "user_id", testUserID)
+	api.On("LogInfo", "Credential deleted", "credential", "team", "user_id", testUserID)
+	api.On("LogInfo", "Credential updated", "credential", defaultCredentialName, "backend", CredentialBackendOpenAI, "team_id", "", "user_id", testUserID)
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Mattermost-User-ID", testUserID)
+		p.ServeHTTP(nil, w, r)
+		return w
+	}
+
+	w := request(http.MethodPut, "/api/v1/admin/credentials/team", `{"team_id": "`+testTeamID+`", "api_key": "sk-team-secret"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "sk-team-secret")
+	assert.NotContains(t, w.Body.String(), "encrypted_key")
+	assert.False(t, bytes.Contains(store[credentialsKey], []byte("sk-team-secret")), "keys are stored encrypted")
+
+	for path, body := range map[string]string{
+		"/api/v1/admin/credentials/Not%20Valid": `{"api_key": "sk"}`,
+		"/api/v1/admin/credentials/team":        `{"backend": "anthropic", "api_key": "sk"}`,
+		"/api/v1/admin/credentials/empty":       `{"api_key": " "}`,
+		"/api/v1/admin/credentials/unknown":     `{"team_id": "unknown", "api_key": "sk"}`,
+	} {
+		assert.Equal(t, http.StatusBadRequest, request(http.MethodPut, path, body).Code, path)
+	}
+
+	w = request(http.MethodPut, "/api/v1/admin/credentials/other", `{"team_id": "`+testTeamID+`", "api_key": "sk-other"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.JSONEq(t, `{"error": "credential \"team\" is already used for this backend and team"}`, w.Body.String())
+
+	// The System Console posts the key of the default credential to the collection.
+	w = request(http.MethodPost, "/api/v1/admin/credentials", `{"api_key": "sk-default-secret"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "sk-default-secret")
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/api/v1/admin/credentials", `{"name": "Not Valid", "api_key": "sk"}`).Code)
+
+	w = request(http.MethodGet, "/api/v1/admin/credentials", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "sk-team-secret")
+	assert.NotContains(t, w.Body.String(), "sk-default-secret")
+	var infos []CredentialInfo
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &infos))
+	require.Len(t, infos, 2)
+	assert.Equal(t, CredentialInfo{
+		Name:      defaultCredentialName,
+		Backend:   CredentialBackendOpenAI,
+		KeyHint:   "****cret",
+		UpdatedAt: infos[0].UpdatedAt,
+		UpdatedBy: testUserID,
+	}, infos[0])
+	assert.Equal(t, CredentialInfo{
+		Name:      "team",
+		Backend:   CredentialBackendOpenAI,
+		TeamID:    testTeamID,
+		KeyHint:   "****cret",
+		UpdatedAt: infos[1].UpdatedAt,
+		UpdatedBy: testUserID,
+	}, infos[1])
+
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, "/api/v1/admin/credentials/team", "").Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, "/api/v1/admin/credentials/team", "").Code)
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	summariesTable = "LLMSummarize_Summaries"
+
+	SummaryScopeThread = "thread"
+	SummaryScopeDay    = "day"
+
+	// digestPostThreshold is the number of posts above which channel summaries switch to the
+	// hierarchical pipeline even when it wasn't requested.
+	digestPostThreshold = 300
+
+	// defaultDigestWindow is the range of an explicitly requested digest without --since.
+	defaultDigestWindow = 7 * 24 * time.Hour
+)
+
+// StoredSummary is an intermediate result of the hierarchical pipeline. SourceHash identifies the
+// input it was computed from, so it is only reused while that input is unchanged.
+type StoredSummary struct {
+	Id         string
+	ChannelId  string
+	Scope      string
+	ScopeId    string
+	Language   string
+	SourceHash string
+	PostCount  int
+	Model      string
+	Summary    string
+	UpdateAt   int64
+}
+
+// digestThread is a thread, or the part of it inside the summarized range.
+type digestThread struct {
+	RootID string
+	Data   *ThreadData
+}
+
+// digestDay groups the threads started on the same day, in UTC.
+type digestDay struct {
+	Day     string
+	Threads []digestThread
+}
+
+// groupThreadsByDay splits posts sorted by creation time into threads, assigning each thread to
+// the day of its first post in the range.
+func groupThreadsByDay(data *ThreadData) []digestDay {
+	days := []digestDay{}
+	dayIndex := map[string]int{}
+	threadIndex := map[string][2]int{}
+
+	for _, post := range data.Posts {
+		rootID := post.RootId
+		if rootID == "" {
+			rootID = post.Id
+		}
+
+		if index, ok := threadIndex[rootID]; ok {
+			thread := days[index[0]].Threads[index[1]]
+			thread.Data.Posts = append(thread.Data.Posts, post)
+			continue
+		}
+
+		day := model.GetTimeForMillis(post.CreateAt).UTC().Format("2006-01-02")
+		if _, ok := dayIndex[day]; !ok {
+			dayIndex[day] = len(days)
+			days = append(days, digestDay{Day: day})
+		}
+
+		i := dayIndex[day]
+		threadIndex[rootID] = [2]int{i, len(days[i].Threads)}
+		days[i].Threads = append(days[i].Threads, digestThread{
+			RootID: rootID,
+			Data:   &ThreadData{Posts: []*model.Post{post}, UsersByID: data.UsersByID},
+		})
+	}
+
+	return days
+}
+
+func sourceHash(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// threadSourceHash changes whenever a post of the thread is added, edited or removed.
+func threadSourceHash(data *ThreadData) string {
+	parts := make([]string, 0, len(data.Posts))
+	for _, post := range data.Posts {
+		parts = append(parts, fmt.Sprintf("%s:%d", post.Id, post.EditAt))
+	}
+
+	return sourceHash(parts...)
+}
+
+// summarySourceHash adds what produces a summary, besides its input, to the hash of the input: the
+// backend and model, the prompts and the redaction settings. Stored summaries computed with other
+// settings are then computed again instead of being mixed with new ones.
+func (p *Plugin) summarySourceHash(inputHash string) string {
+	config := p.getConfiguration()
+	info := p.getSummarizer().Info()
+
+	return sourceHash(
+		inputHash,
+		info.Backend,
+		info.Model,
+		strconv.Itoa(summaryPromptVersion),
+		strconv.FormatBool(config.RedactBuiltinPatterns),
+		config.RedactionRules,
+		strconv.FormatBool(config.PseudonymizeUsernames),
+	)
+}
+
+func storedSummaryID(channelID, scope, scopeID, language string) string {
+	return sourceHash(channelID, scope, scopeID, strings.ToLower(language))
+}
+
+func (p *Plugin) getStoredSummary(id string) (*StoredSummary, error) {
+	if p.db == nil {
+		return nil, nil
+	}
+
+	query, args, err := p.builder.Select("*").From(summariesTable).Where(sq.Eq{"Id": id}).ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	var summary StoredSummary
+	if err := p.db.Get(&summary, query, args...); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "failed to get stored summary")
+	}
+
+	return &summary, nil
+}
+
+func (p *Plugin) saveStoredSummary(summary *StoredSummary) error {
+	if p.db == nil {
+		return nil
+	}
+
+	deleteQuery, deleteArgs, err := p.builder.Delete(summariesTable).Where(sq.Eq{"Id": summary.Id}).ToSql()
+	if err != nil {
+		return err
+	}
+
+	insertQuery, insertArgs, err := p.builder.Insert(summariesTable).
+		SetMap(map[string]interface{}{
+			"Id":         summary.Id,
+			"ChannelId":  summary.ChannelId,
+			"Scope":      summary.Scope,
+			"ScopeId":    summary.ScopeId,
+			"Language":   summary.Language,
+			"SourceHash": summary.SourceHash,
+			"PostCount":  summary.PostCount,
+			"Model":      summary.Model,
+			"Summary":    summary.Summary,
+			"UpdateAt":   summary.UpdateAt,
+		}).
+		ToSql()
+	if err != nil {
+		return err
+	}
+
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "failed to start transaction")
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.Exec(deleteQuery, deleteArgs...); err != nil {
+		return errors.Wrap(err, "failed to delete stored summary")
+	}
+	if _, err := tx.Exec(insertQuery, insertArgs...); err != nil {
+		return errors.Wrap(err, "failed to store summary")
+	}
+
+	return tx.Commit()
+}
+
+// storedOrSummarize returns the stored summary when it was computed from the same input with the
+// same settings, and otherwise computes and stores it. Failing to store is logged, as the summary
+// is still usable.
+func (p *Plugin) storedOrSummarize(channelID, scope, scopeID, language, inputHash string, postCount int, summarize func() (string, error)) (string, error) {
+	id := storedSummaryID(channelID, scope, scopeID, language)
+	hash := p.summarySourceHash(inputHash)
+
+	stored, err := p.getStoredSummary(id)
+	if err != nil {
+		return "", err
+	}
+	if stored != nil && stored.SourceHash == hash {
+		return stored.Summary, nil
+	}
+
+	summary, err := summarize()
+	if err != nil {
+		return "", err
+	}
+
+	if err := p.saveStoredSummary(&StoredSummary{
+		Id:         id,
+		ChannelId:  channelID,
+		Scope:      scope,
+		ScopeId:    scopeID,
+		Language:   language,
+		SourceHash: hash,
+		PostCount:  postCount,
+		Model:      p.getSummarizer().Info().Model,
+		Summary:    summary,
+		UpdateAt:   model.GetMillis(),
+	}); err != nil {
+		p.API.LogError("Failed to store summary", "scope", scope, "scope_id", scopeID, "error", err.Error())
+	}
+
+	return summary, nil
+}
+
+// summarizeDigest summarizes the posts of a channel hierarchically: every thread is summarized on
+// its own, the thread summaries of each day are combined, and finally the days are combined.
+// Thread and day summaries are stored, so only what changed since the last digest is sent to the
+// summarizer. Stored summaries keep real usernames and are redacted again before being reused.
+func (p *Plugin) summarizeDigest(ctx context.Context, channelID string, data *ThreadData, language string) (string, error) {
+	redactor := p.newRedactor()
+	redactor.Redact(data)
+
+	days := groupThreadsByDay(data)
+	dayParts := make([]string, 0, len(days))
+	for _, day := range days {
+		summary, err := p.summarizeDigestDay(ctx, channelID, day, language, redactor)
+		if err != nil {
+			return "", err
+		}
+		dayParts = append(dayParts, fmt.Sprintf("Day %s:\n%s", day.Day, summary))
+		if len(days) == 1 {
+			return summary, nil
+		}
+	}
+
+	content := redactor.RedactText(strings.Join(dayParts, "\n\n"))
+	p.auditSummarization(ctx, AuditOperationDigest, "", data, content)
+	summary, err := p.getSummarizer().SummarizeSummaries(ctx, content, language)
+	if err != nil {
+		return "", err
+	}
+
+	return redactor.Restore(summary), nil
+}
+
+func (p *Plugin) summarizeDigestDay(ctx context.Context, channelID string, day digestDay, language string, redactor *Redactor) (string, error) {
+	summaries := make([]string, 0, len(day.Threads))
+	threadParts := make([]string, 0, len(day.Threads))
+	hashes := make([]string, 0, len(day.Threads))
+	dayData := &ThreadData{UsersByID: map[string]*model.User{}}
+
+	for _, thread := range day.Threads {
+		summary, hash, err := p.summarizeDigestThread(ctx, channelID, thread, language, redactor)
+		if err != nil {
+			return "", err
+		}
+		summaries = append(summaries, summary)
+		threadParts = append(threadParts, fmt.Sprintf("Thread started by %s:\n%s", thread.Data.UsersByID[thread.Data.Posts[0].UserId].Username, summary))
+		hashes = append(hashes, hash)
+		dayData.Posts = append(dayData.Posts, thread.Data.Posts...)
+		dayData.UsersByID = thread.Data.UsersByID
+	}
+
+	if len(summaries) == 1 {
+		return summaries[0], nil
+	}
+
+	return p.storedOrSummarize(channelID, SummaryScopeDay, day.Day, language, sourceHash(hashes...), len(dayData.Posts), func() (string, error) {
+		content := redactor.RedactText(strings.Join(threadParts, "\n\n"))
+		p.auditSummarization(ctx, AuditOperationDigest, "", dayData, content)
+		summary, err := p.getSummarizer().SummarizeSummaries(ctx, content, language)
+		if err != nil {
+			return "", err
+		}
+		return redactor.Restore(summary), nil
+	})
+}
+
+// summarizeDigestThread returns the summary of a thread along with the hash of its posts. A
+// single post is its own summary and isn't sent to the summarizer.
+func (p *Plugin) summarizeDigestThread(ctx context.Context, channelID string, thread digestThread, language string, redactor *Redactor) (string, string, error) {
+	hash := threadSourceHash(thread.Data)
+	if len(thread.Data.Posts) == 1 {
+		post := thread.Data.Posts[0]
+		return fmt.Sprintf("%s: %s", thread.Data.UsersByID[post.UserId].Username, post.Message), hash, nil
+	}
+
+	summary, err := p.storedOrSummarize(channelID, SummaryScopeThread, thread.RootID, language, hash, len(thread.Data.Posts), func() (string, error) {
+		formattedThread := redactor.Redact(thread.Data)
+		p.auditSummarization(ctx, AuditOperationSummarize, thread.RootID, thread.Data, formattedThread)
+		summary, err := p.getSummarizer().SummarizeThread(ctx, formattedThread, language)
+		if err != nil {
+			return "", err
+		}
+		return redactor.Restore(summary), nil
+	})
+
+	return summary, hash, err
+}
+
+// checkDigestRequest validates an explicit --digest request, extending the range to the default
+// digest window when no --since was given.
+func checkDigestRequest(args *model.CommandArgs, structured, question bool, filters *SummaryFilters) error {
+	switch {
+	case args.RootId != "":
+		return errors.New("--digest can only be used on channels, not threads")
+	case structured:
+		return errors.New("--digest can't be combined with --structured")
+	case question:
+		return errors.New("--digest can't be combined with a question")
+	}
+
+	if filters.Since.IsZero() {
+		filters.Since = time.Now().Add(-defaultDigestWindow)
+	}
+
+	return nil
+}
+
+// wantsDigest reports whether a channel summary should go through the hierarchical pipeline.
+func wantsDigest(requested bool, data *ThreadData) bool {
+	return requested || len(data.Posts) > digestPostThreshold
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func digestTestData() *ThreadData {
+	day1 := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	day2 := day1.Add(24 * time.Hour)
+	at := func(t time.Time, minutes int) int64 {
+		return model.GetMillisForTime(t.Add(time.Duration(minutes) * time.Minute))
+	}
+
+	return &ThreadData{
+		Posts: []*model.Post{
+			{Id: "a", UserId: "alice", Message: "release today?", CreateAt: at(day1, 0)},
+			{Id: "b", UserId: "bob", Message: "standup notes", CreateAt: at(day1, 5)},
+			{Id: "c", UserId: "bob", RootId: "a", Message: "yes", CreateAt: at(day1, 10)},
+			{Id: "d", UserId: "alice", RootId: "a", Message: "shipping it", CreateAt: at(day2, 0)},
+			{Id: "e", UserId: "alice", Message: "retro tomorrow", CreateAt: at(day2, 5)},
+		},
+		UsersByID: map[string]*model.User{
+			"alice": {Id: "alice", Username: "alice"},
+			"bob":   {Id: "bob", Username: "bob"},
+		},
+	}
+}
+
+func TestGroupThreadsByDay(t *testing.T) {
+	days := groupThreadsByDay(digestTestData())
+	require.Len(t, days, 2)
+
+	assert.Equal(t, "2023-05-01", days[0].Day)
+	require.Len(t, days[0].Threads, 2)
+	assert.Equal(t, "a", days[0].Threads[0].RootID)
+	assert.Len(t, days[0].Threads[0].Data.Posts, 3, "replies stay with the day the thread started")
+	assert.Equal(t, "b", days[0].Threads[1].RootID)
+
+	assert.Equal(t, "2023-05-02", days[1].Day)
+	require.Len(t, days[1].Threads, 1)
+	assert.Equal(t, "e", days[1].Threads[0].RootID)
+}
+
+func TestThreadSourceHash(t *testing.T) {
+	data := digestTestData()
+	hash := threadSourceHash(data)
+
+	data.Posts[0].EditAt = 1
+	assert.NotEqual(t, hash, threadSourceHash(data))
+}
+
+func TestStoredOrSummarize(t *testing.T) {
+	p, _, _ := newTestPlugin(t, nil)
+	db := newFakeDB(p, model.DatabaseDriverPostgres)
+	inputHash := threadSourceHash(digestTestData())
+	db.returnRows("SELECT * FROM LLMSummarize_Summaries",
+		[]string{"Id", "ChannelId", "Scope", "ScopeId", "Language", "SourceHash", "PostCount", "Model", "Summary", "UpdateAt"},
+		[]driver.Value{"id", testChannelID, SummaryScopeThread, "a", "", p.summarySourceHash(inputHash), int64(3), "fake-model", "stored summary", int64(1)},
+	)
+
+	calls := 0
+	summarize := func() (string, error) {
+		calls++
+		return "new summary", nil
+	}
+	get := func() string {
+		summary, err := p.storedOrSummarize(testChannelID, SummaryScopeThread, "a", "", inputHash, 3, summarize)
+		require.NoError(t, err)
+		return summary
+	}
+
+	assert.Equal(t, "stored summary", get())
+	assert.Zero(t, calls)
+
+	for name, config := range map[string]*configuration{
+		"redaction":      {RedactBuiltinPatterns: true},
+		"custom rules":   {RedactionRules: "TICKET=INC-[0-9]+"},
+		"pseudonymizing": {PseudonymizeUsernames: true},
+	} {
+		p.setConfiguration(config)
+		assert.Equal(t, "new summary", get(), "changing the %s settings computes the summary again", name)
+	}
+	assert.Equal(t, 3, calls)
+
+	p.setConfiguration(&configuration{})
+	assert.NotEqual(t, sourceHash(inputHash), p.summarySourceHash(inputHash))
+	assert.Equal(t, "stored summary", get())
+}
+
+func TestSummarizeDigest(t *testing.T) {
+	summarizer := &fakeSummarizer{}
+	p := &Plugin{summarizer: summarizer}
+
+	summary, err := p.summarizeDigest(context.Background(), "channel", digestTestData(), "")
+	require.NoError(t, err)
+	assert.Equal(t, "digest", summary)
+
+	// Only the thread with replies needs a summary; single posts are used as they are. The first
+	// day is combined, the second has a single thread, and then both days are combined.
+	assert.Equal(t, []string{"SummarizeThread", "SummarizeSummaries", "SummarizeSummaries"}, summarizer.Calls())
+}
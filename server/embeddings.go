@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	defaultEmbeddingModel = "text-embedding-ada-002"
+
+	// embeddingsBackend is the backend receiving the posts to index, in terms of channel policies.
+	// Embeddings are always computed by an OpenAI compatible API.
+	embeddingsBackend = "openai"
+
+	// maxEmbeddingBatch bounds the number of inputs sent in a single embeddings request.
+	maxEmbeddingBatch = 100
+)
+
+// knownEmbeddingDimensions is the length of the vectors of the OpenAI embedding models. Other
+// models need the EmbeddingDimensions setting to be stored in a pgvector column.
+var knownEmbeddingDimensions = map[string]int{
+	"text-embedding-ada-002": 1536,
+	"text-embedding-3-small": 1536,
+	"text-embedding-3-large": 3072,
+}
+
+// Embedder turns text into vectors whose distance reflects how related the texts are.
+type Embedder interface {
+	Model() string
+	// Dimensions is the length of the vectors, or 0 when it isn't known in advance.
+	Dimensions() int
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// OpenAIEmbedder calls the embeddings endpoint of OpenAI, or of any server exposing the same API.
+// The request is sent without the go-openai client, whose embedding models are a fixed list.
+type OpenAIEmbedder struct {
+	httpClient *http.Client
+	apiURL     string
+	model      string
+	dimensions int
+	timeout    time.Duration
+	onUsage    UsageHandler
+}
+
+type embeddingsRequest struct {
+	Input []string `json:"input"`
+	Model string   `json:"model"`
+}
+
+type embeddingsResponse struct {
+	Data  []openai.Embedding `json:"data"`
+	Usage openai.Usage       `json:"usage"`
+}
+
+// NewOpenAIEmbedder creates an embedder for the given model, passed as is to the API. The API key
+// is resolved for every request. An empty apiURL uses OpenAI itself, and dimensions of 0 use the
+// known length of the vectors of the model, if any.
+func NewOpenAIEmbedder(apiKey APIKeyResolver, apiURL, modelName string, dimensions int, timeout time.Duration, maxRetries int, onUsage UsageHandler) (*OpenAIEmbedder, error) {
+	if modelName == "" {
+		modelName = defaultEmbeddingModel
+	}
+	if dimensions <= 0 {
+		dimensions = knownEmbeddingDimensions[modelName]
+	}
+
+	if apiURL == "" {
+		apiURL = openai.DefaultConfig("").BaseURL
+	}
+	if parsed, err := url.Parse(apiURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, errors.Errorf("invalid embedding API URL %q", apiURL)
+	}
+
+	return &OpenAIEmbedder{
+		httpClient: newAuthenticatedClient(apiKey, maxRetries),
+		apiURL:     strings.TrimSuffix(apiURL, "/"),
+		model:      modelName,
+		dimensions: dimensions,
+		timeout:    timeout,
+		onUsage:    onUsage,
+	}, nil
+}
+
+func (e *OpenAIEmbedder) Model() string {
+	return e.model
+}
+
+func (e *OpenAIEmbedder) Dimensions() int {
+	return e.dimensions
+}
+
+// Embed returns one vector per text, in the same order, splitting large inputs in several requests.
+func (e *OpenAIEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); start += maxEmbeddingBatch {
+		end := start + maxEmbeddingBatch
+		if end > len(texts) {
+			end = len(texts)
+		}
+
+		batch, err := e.embedBatch(ctx, texts[start:end])
+		if err != nil {
+			return nil, err
+		}
+		vectors = append(vectors, batch...)
+	}
+
+	return vectors, nil
+}
+
+func (e *OpenAIEmbedder) embedBatch(ctx context.Context, texts []string) ([][]float32, error) {
+	if e.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.timeout)
+		defer cancel()
+	}
+
+	// Newlines are known to degrade the quality of the embeddings.
+	input := make([]string, len(texts))
+	for i, text := range texts {
+		input[i] = strings.ReplaceAll(text, "\n", " ")
+	}
+
+	resp, err := e.createEmbeddings(ctx, embeddingsRequest{Input: input, Model: e.model})
+	if err != nil {
+		return nil, classifyOpenAIError(err)
+	}
+
+	if len(resp.Data) != len(texts) {
+		return nil, errors.Errorf("expected %d embeddings, got %d", len(texts), len(resp.Data))
+	}
+
+	if e.onUsage != nil {
+		e.onUsage(ctx, TokenUsage{
+			Model:        e.Model(),
+			PromptTokens: resp.Usage.PromptTokens,
+		})
+	}
+
+	sort.Slice(resp.Data, func(i, j int) bool { return resp.Data[i].Index < resp.Data[j].Index })
+	vectors := make([][]float32, len(resp.Data))
+	for i, embedding := range resp.Data {
+		vectors[i] = embedding.Embedding
+	}
+
+	return vectors, nil
+}
+
+// createEmbeddings posts the request to the embeddings endpoint. Errors are returned as the
+// go-openai client does, so that they are classified the same way.
+func (e *OpenAIEmbedder) createEmbeddings(ctx context.Context, request embeddingsRequest) (*embeddingsResponse, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.apiURL+"/embeddings", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+		var errResp openai.ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error == nil {
+			return nil, &openai.RequestError{HTTPStatusCode: resp.StatusCode, Err: errors.Errorf("embeddings request failed with status %d", resp.StatusCode)}
+		}
+		errResp.Error.HTTPStatusCode = resp.StatusCode
+		return nil, errResp.Error
+	}
+
+	var embeddings embeddingsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&embeddings); err != nil {
+		return nil, errors.Wrap(err, "failed to decode embeddings")
+	}
+
+	return &embeddings, nil
+}
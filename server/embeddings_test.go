@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkText(t *testing.T) {
+	assert.Equal(t, []string{"short post"}, chunkText("  short post ", 20))
+	assert.Empty(t, chunkText("   ", 20))
+
+	chunks := chunkText("one two three four five six", 10)
+	assert.Equal(t, []string{"one two", "three four", "five six"}, chunks)
+
+	chunks = chunkText(strings.Repeat("a", 25), 10)
+	assert.Equal(t, []string{strings.Repeat("a", 10), strings.Repeat("a", 10), strings.Repeat("a", 5)}, chunks)
+}
+
+func TestVectorHelpers(t *testing.T) {
+	vector := []float32{0.5, -1.25, 3}
+	assert.Equal(t, vector, decodeVector(encodeVector(vector)))
+	assert.Equal(t, "[0.5,-1.25,3]", pgvectorLiteral(vector))
+
+	assert.InDelta(t, 1, cosineSimilarity([]float32{1, 2}, []float32{2, 4}), 1e-9)
+	assert.InDelta(t, 0, cosineSimilarity([]float32{1, 0}, []float32{0, 1}), 1e-9)
+	assert.Zero(t, cosineSimilarity([]float32{1}, []float32{1, 2}))
+
+	matches := topMatches([]VectorMatch{{Id: "a", Score: 0.1}, {Id: "b", Score: 0.9}, {Id: "c", Score: 0.5}}, 2)
+	require.Len(t, matches, 2)
+	assert.Equal(t, "b", matches[0].Id)
+	assert.Equal(t, "c", matches[1].Id)
+}
+
+func TestOpenAIEmbedder(t *testing.T) {
+	_, err := NewOpenAIEmbedder(staticAPIKey("key"), "localhost:8080", "", 0, time.Second, 0, nil)
+	assert.Error(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/embeddings", r.URL.Path)
+
+		var request struct {
+			Input []string `json:"input"`
+			Model string   `json:"model"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		assert.Equal(t, []string{"first line second line", "other"}, request.Input)
+		assert.Equal(t, "text-embedding-ada-002", request.Model)
+
+		// Answer out of order to check the embeddings are matched by index.
+		_, _ = w.Write([]byte(`{"data": [
+			{"index": 1, "embedding": [0, 1]},
+			{"index": 0, "embedding": [1, 0]}
+		], "usage": {"prompt_tokens": 7}}`))
+	}))
+	defer server.Close()
+
+	var usage TokenUsage
+	embedder, err := NewOpenAIEmbedder(staticAPIKey("key"), server.URL+"/v1/", "", 0, time.Second, 0, func(ctx context.Context, u TokenUsage) {
+		usage = u
+	})
+	require.NoError(t, err)
+
+	vectors, err := embedder.Embed(context.Background(), []string{"first line\nsecond line", "other"})
+	require.NoError(t, err)
+	assert.Equal(t, [][]float32{{1, 0}, {0, 1}}, vectors)
+	assert.Equal(t, TokenUsage{Model: "text-embedding-ada-002", PromptTokens: 7}, usage)
+}
+
+func TestOpenAIEmbedderModels(t *testing.T) {
+	var requested string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Model string `json:"model"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		requested = request.Model
+
+		if request.Model == "missing-model" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error": {"message": "model not found", "type": "invalid_request_error"}}`))
+			return
+		}
+		if request.Model == "private-model" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`unauthorized`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"data": [{"index": 0, "embedding": [1, 0, 0]}]}`))
+	}))
+	defer server.Close()
+
+	embedder, err := NewOpenAIEmbedder(staticAPIKey("key"), server.URL, "nomic-embed-text", 0, time.Second, 0, nil)
+	require.NoError(t, err)
+	assert.Zero(t, embedder.Dimensions(), "the length of the vectors of other models isn't known")
+	vectors, err := embedder.Embed(context.Background(), []string{"text"})
+	require.NoError(t, err)
+	assert.Equal(t, [][]float32{{1, 0, 0}}, vectors)
+	assert.Equal(t, "nomic-embed-text", requested, "the model name is passed as is")
+
+	embedder, err = NewOpenAIEmbedder(staticAPIKey("key"), server.URL, "nomic-embed-text", 768, time.Second, 0, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 768, embedder.Dimensions())
+
+	embedder, err = NewOpenAIEmbedder(staticAPIKey("key"), server.URL, "text-embedding-3-large", 0, time.Second, 0, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 3072, embedder.Dimensions())
+
+	for modelName, kind := range map[string]LLMErrorKind{
+		"missing-model": LLMErrorUpstreamUnavailable,
+		"private-model": LLMErrorAuth,
+	} {
+		embedder, err = NewOpenAIEmbedder(staticAPIKey("key"), server.URL, modelName, 0, time.Second, 0, nil)
+		require.NoError(t, err)
+		_, err = embedder.Embed(context.Background(), []string{"text"})
+		var llmErr *LLMError
+		require.ErrorAs(t, err, &llmErr)
+		assert.Equal(t, kind, llmErr.Kind, modelName)
+	}
+}
+
+func TestVectorIndexPgvector(t *testing.T) {
+	setup := func(t *testing.T, installed bool) (*vectorIndex, *fakeDB) {
+		p, api, _ := newTestPlugin(t, nil)
+		db := newFakeDB(p, model.DatabaseDriverPostgres)
+		api.On("GetConfig").Return(&model.Config{SqlSettings: model.SqlSettings{DriverName: model.NewString(model.DatabaseDriverPostgres)}})
+		api.On("LogInfo", mock.Anything).Maybe()
+		api.On("LogInfo", mock.Anything, mock.Anything, mock.Anything).Maybe()
+		db.returnRows("SELECT EXISTS", []string{"exists"}, []driver.Value{installed})
+		return p.newVectorIndex(), db
+	}
+
+	t.Run("not installed", func(t *testing.T) {
+		index, db := setup(t, false)
+		index.setDimensions(1536)
+		assert.False(t, index.usesPgvector())
+		assert.Empty(t, db.Statements("CREATE EXTENSION"), "the extension is never installed")
+		assert.Empty(t, db.Statements("ALTER TABLE"))
+	})
+
+	t.Run("unknown dimensions", func(t *testing.T) {
+		index, db := setup(t, true)
+		index.setDimensions(0)
+		assert.False(t, index.usesPgvector())
+		assert.Empty(t, db.Statements("ALTER TABLE"))
+	})
+
+	t.Run("typed column and index", func(t *testing.T) {
+		index, db := setup(t, true)
+		index.setDimensions(1536)
+		assert.True(t, index.usesPgvector())
+		assert.Len(t, db.Statements("ALTER TABLE LLMSummarize_Embeddings ADD COLUMN EmbeddingVector vector(1536)"), 1)
+		assert.Len(t, db.Statements("CREATE INDEX IF NOT EXISTS LLMSummarize_Embeddings_Vector_Idx ON LLMSummarize_Embeddings USING hnsw (EmbeddingVector vector_cosine_ops)"), 1)
+
+		index.setDimensions(1536)
+		assert.Len(t, db.Statements("ALTER TABLE"), 2, "the column is only set up once")
+	})
+
+	t.Run("existing column", func(t *testing.T) {
+		index, db := setup(t, true)
+		db.returnRows("SELECT format_type", []string{"format_type"}, []driver.Value{"vector(768)"})
+		index.setDimensions(768)
+		assert.True(t, index.usesPgvector())
+		assert.Empty(t, db.Statements("ALTER TABLE"), "a column of the right type is kept")
+	})
+
+	t.Run("too long to index", func(t *testing.T) {
+		index, db := setup(t, true)
+		index.setDimensions(3072)
+		assert.True(t, index.usesPgvector())
+		assert.Len(t, db.Statements("ALTER TABLE LLMSummarize_Embeddings ADD COLUMN EmbeddingVector vector(3072)"), 1)
+		assert.Empty(t, db.Statements("CREATE INDEX"))
+	})
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// The evaluation harness runs a corpus of recorded threads through two summarizer configurations
+// and reports how the summaries compare. It lives in the tests because the plugin is a main
+// package, run it with `make eval` or:
+//
+//	go test ./server -run '^TestEval$' -eval.baseline openai -eval.candidate openai:gpt-4
+var (
+	evalCorpus    = flag.String("eval.corpus", filepath.Join("testdata", "eval"), "directory of the recorded threads to evaluate")
+	evalBaseline  = flag.String("eval.baseline", "", "summarizer to compare against: fake, openai or openai:<model>")
+	evalCandidate = flag.String("eval.candidate", "", "summarizer being evaluated: fake, openai or openai:<model>")
+	evalJudge     = flag.String("eval.judge", "", "optional summarizer grading the summaries: openai or openai:<model>")
+	evalReport    = flag.String("eval.report", "", "file to write the report to, standard output when empty")
+)
+
+var (
+	wordPattern  = regexp.MustCompile(`[\p{L}\p{N}]+`)
+	namePattern  = regexp.MustCompile(`[\p{L}\p{N}._-]+`)
+	gradePattern = regexp.MustCompile(`[1-5]`)
+)
+
+// regressionThreshold is the drop of a score between configurations flagged in the report.
+const regressionThreshold = 0.1
+
+// EvalCase is a recorded thread along with what a good summary of it looks like.
+type EvalCase struct {
+	Name             string     `json:"name"`
+	Thread           ThreadData `json:"thread"`
+	Reference        string     `json:"reference"`
+	RequiredMentions []string   `json:"required_mentions"`
+	MaxWords         int        `json:"max_words"`
+}
+
+// EvalResult holds the scores of the summary of a case. Scores range from 0 to 1, except
+// JudgeGrade which goes from 1 to 5 and is 0 when no judge was used or the judge failed. A
+// failing judge is reported in JudgeErr, as the summary and its other scores are still valid.
+type EvalResult struct {
+	Case          string
+	Summary       string
+	Err           error
+	Words         int
+	WithinLength  bool
+	MentionRecall float64
+	Rouge1        float64
+	RougeL        float64
+	JudgeGrade    int
+	JudgeErr      error
+}
+
+// EvalConfig names a summarizer under evaluation.
+type EvalConfig struct {
+	Name       string
+	Summarizer Summarizer
+}
+
+func loadEvalCorpus(dir string) ([]*EvalCase, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	cases := make([]*EvalCase, 0, len(paths))
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		evalCase := &EvalCase{}
+		if err := json.Unmarshal(content, evalCase); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s", path)
+		}
+		if evalCase.Name == "" {
+			evalCase.Name = strings.TrimSuffix(filepath.Base(path), ".json")
+		}
+		cases = append(cases, evalCase)
+	}
+
+	return cases, nil
+}
+
+// newEvalSummarizer builds the summarizer described by spec. OpenAI is reached with the
+// OPENAI_API_KEY and, when set, OPENAI_API_URL environment variables.
+func newEvalSummarizer(spec string) (Summarizer, error) {
+	backend, modelName, _ := strings.Cut(spec, ":")
+	switch backend {
+	case "fake":
+		return &fakeSummarizer{}, nil
+	case "openai":
+		apiKey := os.Getenv("OPENAI_API_KEY")
+		if apiKey == "" {
+			return nil, errors.New("OPENAI_API_KEY must be set to evaluate OpenAI")
+		}
+		summarizer := NewOpenAISummarizer(staticAPIKey(apiKey), os.Getenv("OPENAI_API_URL"), 2*time.Minute, 3, nil)
+		if modelName != "" {
+			summarizer.model = modelName
+		}
+		return summarizer, nil
+	}
+
+	return nil, errors.Errorf("unknown summarizer %q", spec)
+}
+
+func tokenize(text string) []string {
+	return wordPattern.FindAllString(strings.ToLower(text), -1)
+}
+
+func f1(overlap, candidateLength, referenceLength int) float64 {
+	if overlap == 0 {
+		return 0
+	}
+	precision := float64(overlap) / float64(candidateLength)
+	recall := float64(overlap) / float64(referenceLength)
+
+	return 2 * precision * recall / (precision + recall)
+}
+
+// rouge1 is the F1 score of the words shared by the candidate and the reference.
+func rouge1(candidate, reference string) float64 {
+	candidateTokens, referenceTokens := tokenize(candidate), tokenize(reference)
+	counts := map[string]int{}
+	for _, token := range referenceTokens {
+		counts[token]++
+	}
+
+	overlap := 0
+	for _, token := range candidateTokens {
+		if counts[token] > 0 {
+			counts[token]--
+			overlap++
+		}
+	}
+
+	return f1(overlap, len(candidateTokens), len(referenceTokens))
+}
+
+// rougeL is the F1 score of the longest common subsequence of words.
+func rougeL(candidate, reference string) float64 {
+	candidateTokens, referenceTokens := tokenize(candidate), tokenize(reference)
+	if len(candidateTokens) == 0 || len(referenceTokens) == 0 {
+		return 0
+	}
+
+	previous := make([]int, len(referenceTokens)+1)
+	current := make([]int, len(referenceTokens)+1)
+	for _, candidateToken := range candidateTokens {
+		for j, referenceToken := range referenceTokens {
+			if candidateToken == referenceToken {
+				current[j+1] = previous[j] + 1
+			} else if previous[j+1] > current[j] {
+				current[j+1] = previous[j+1]
+			} else {
+				current[j+1] = current[j]
+			}
+		}
+		previous, current = current, previous
+	}
+
+	return f1(previous[len(referenceTokens)], len(candidateTokens), len(referenceTokens))
+}
+
+// mentionRecall is the fraction of the required people named in the summary, with or without @.
+func mentionRecall(summary string, required []string) float64 {
+	if len(required) == 0 {
+		return 1
+	}
+
+	words := map[string]bool{}
+	for _, word := range namePattern.FindAllString(strings.ToLower(summary), -1) {
+		words[strings.Trim(word, "._-")] = true
+	}
+
+	found := 0
+	for _, name := range required {
+		if words[strings.ToLower(strings.TrimPrefix(name, "@"))] {
+			found++
+		}
+	}
+
+	return float64(found) / float64(len(required))
+}
+
+// judgeSummary asks the judge to grade the summary from 1 to 5. Any Summarizer can judge, the
+// grading instructions are given as a question on the thread.
+func judgeSummary(ctx context.Context, judge Summarizer, thread, summary string) (int, error) {
+	question := "Grade the following summary of the thread from 1 (useless or wrong) to 5 (accurate, complete and concise). " +
+		"Answer with the grade only.\n\nSummary: " + summary
+	answer, err := judge.AnswerQuestionOnThread(ctx, thread, question, "")
+	if err != nil {
+		return 0, err
+	}
+
+	grade := gradePattern.FindString(answer)
+	if grade == "" {
+		return 0, errors.Errorf("judge did not answer with a grade: %q", answer)
+	}
+
+	return strconv.Atoi(grade)
+}
+
+func evaluateCase(ctx context.Context, evalCase *EvalCase, summarizer, judge Summarizer) *EvalResult {
+	result := &EvalResult{Case: evalCase.Name}
+
+	thread := formatThread(&evalCase.Thread)
+	result.Summary, result.Err = summarizer.SummarizeThread(ctx, thread, "")
+	if result.Err != nil {
+		return result
+	}
+
+	result.Words = len(strings.Fields(result.Summary))
+	result.WithinLength = evalCase.MaxWords <= 0 || result.Words <= evalCase.MaxWords
+	result.MentionRecall = mentionRecall(result.Summary, evalCase.RequiredMentions)
+	if evalCase.Reference != "" {
+		result.Rouge1 = rouge1(result.Summary, evalCase.Reference)
+		result.RougeL = rougeL(result.Summary, evalCase.Reference)
+	}
+	if judge != nil {
+		result.JudgeGrade, result.JudgeErr = judgeSummary(ctx, judge, thread, result.Summary)
+	}
+
+	return result
+}
+
+func runEval(ctx context.Context, cases []*EvalCase, summarizer, judge Summarizer) []*EvalResult {
+	results := make([]*EvalResult, 0, len(cases))
+	for _, evalCase := range cases {
+		results = append(results, evaluateCase(ctx, evalCase, summarizer, judge))
+	}
+
+	return results
+}
+
+// evalAggregate averages the scores of the cases that didn't fail. The judge grade is averaged
+// over the cases the judge graded.
+type evalAggregate struct {
+	Errors        int
+	JudgeErrors   int
+	LengthPass    float64
+	MentionRecall float64
+	Rouge1        float64
+	RougeL        float64
+	JudgeGrade    float64
+}
+
+func aggregateResults(results []*EvalResult) evalAggregate {
+	aggregate := evalAggregate{}
+	succeeded, graded := 0, 0
+	for _, result := range results {
+		if result.Err != nil {
+			aggregate.Errors++
+			continue
+		}
+		succeeded++
+		if result.WithinLength {
+			aggregate.LengthPass++
+		}
+		aggregate.MentionRecall += result.MentionRecall
+		aggregate.Rouge1 += result.Rouge1
+		aggregate.RougeL += result.RougeL
+		if result.JudgeErr != nil {
+			aggregate.JudgeErrors++
+		} else if result.JudgeGrade > 0 {
+			graded++
+			aggregate.JudgeGrade += float64(result.JudgeGrade)
+		}
+	}
+
+	if succeeded > 0 {
+		n := float64(succeeded)
+		aggregate.LengthPass /= n
+		aggregate.MentionRecall /= n
+		aggregate.Rouge1 /= n
+		aggregate.RougeL /= n
+	}
+	if graded > 0 {
+		aggregate.JudgeGrade /= float64(graded)
+	}
+
+	return aggregate
+}
+
+func formatDelta(baseline, candidate float64) string {
+	delta := candidate - baseline
+	if math.Abs(delta) < 0.005 {
+		return "="
+	}
+
+	return fmt.Sprintf("%+.2f", delta)
+}
+
+// writeEvalReport writes a markdown comparison of the two configurations, flagging the cases
+// whose scores dropped.
+func writeEvalReport(w io.Writer, cases []*EvalCase, baseline, candidate EvalConfig, baselineResults, candidateResults []*EvalResult) {
+	baselineAggregate := aggregateResults(baselineResults)
+	candidateAggregate := aggregateResults(candidateResults)
+
+	fmt.Fprintf(w, "# Summary evaluation: %s vs %s\n\n", baseline.Name, candidate.Name)
+	fmt.Fprintf(w, "%d cases.\n\n", len(cases))
+	fmt.Fprintf(w, "| Metric | %s | %s | Delta |\n|---|---|---|---|\n", baseline.Name, candidate.Name)
+	fmt.Fprintf(w, "| Errors | %d | %d | %+d |\n", baselineAggregate.Errors, candidateAggregate.Errors, candidateAggregate.Errors-baselineAggregate.Errors)
+	if baselineAggregate.JudgeErrors > 0 || candidateAggregate.JudgeErrors > 0 {
+		fmt.Fprintf(w, "| Judge errors | %d | %d | %+d |\n", baselineAggregate.JudgeErrors, candidateAggregate.JudgeErrors, candidateAggregate.JudgeErrors-baselineAggregate.JudgeErrors)
+	}
+	for _, metric := range []struct {
+		name                string
+		baseline, candidate float64
+	}{
+		{"Within length", baselineAggregate.LengthPass, candidateAggregate.LengthPass},
+		{"Mention recall", baselineAggregate.MentionRecall, candidateAggregate.MentionRecall},
+		{"ROUGE-1", baselineAggregate.Rouge1, candidateAggregate.Rouge1},
+		{"ROUGE-L", baselineAggregate.RougeL, candidateAggregate.RougeL},
+		{"Judge grade", baselineAggregate.JudgeGrade, candidateAggregate.JudgeGrade},
+	} {
+		fmt.Fprintf(w, "| %s | %.2f | %.2f | %s |\n", metric.name, metric.baseline, metric.candidate, formatDelta(metric.baseline, metric.candidate))
+	}
+
+	fmt.Fprintf(w, "\n## Cases\n\n| Case | Words | Mentions | ROUGE-L | Judge | |\n|---|---|---|---|---|---|\n")
+	for i, evalCase := range cases {
+		b, c := baselineResults[i], candidateResults[i]
+		if b.Err != nil || c.Err != nil {
+			fmt.Fprintf(w, "| %s | | | | | error: %v |\n", evalCase.Name, firstError(b.Err, c.Err))
+			continue
+		}
+
+		notes := []string{}
+		if b.RougeL-c.RougeL > regressionThreshold || b.MentionRecall-c.MentionRecall > regressionThreshold || (b.WithinLength && !c.WithinLength) {
+			notes = append(notes, "regression")
+		}
+		if judgeErr := firstError(b.JudgeErr, c.JudgeErr); judgeErr != nil {
+			notes = append(notes, fmt.Sprintf("judge error: %v", judgeErr))
+		}
+		fmt.Fprintf(w, "| %s | %d → %d | %.2f → %.2f | %.2f → %.2f | %s → %s | %s |\n",
+			evalCase.Name, b.Words, c.Words, b.MentionRecall, c.MentionRecall, b.RougeL, c.RougeL, formatGrade(b), formatGrade(c), strings.Join(notes, ", "))
+	}
+}
+
+func formatGrade(result *EvalResult) string {
+	if result.JudgeErr != nil {
+		return "?"
+	}
+
+	return strconv.Itoa(result.JudgeGrade)
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// TestEval compares the summarizers given with -eval.baseline and -eval.candidate on the corpus.
+func TestEval(t *testing.T) {
+	if *evalBaseline == "" || *evalCandidate == "" {
+		t.Skip("set -eval.baseline and -eval.candidate to run the evaluation")
+	}
+
+	cases, err := loadEvalCorpus(*evalCorpus)
+	require.NoError(t, err)
+	require.NotEmpty(t, cases, "no cases found in %s", *evalCorpus)
+
+	var judge Summarizer
+	if *evalJudge != "" {
+		judge, err = newEvalSummarizer(*evalJudge)
+		require.NoError(t, err)
+	}
+
+	configs := []EvalConfig{{Name: *evalBaseline}, {Name: *evalCandidate}}
+	results := make([][]*EvalResult, len(configs))
+	for i := range configs {
+		configs[i].Summarizer, err = newEvalSummarizer(configs[i].Name)
+		require.NoError(t, err)
+		results[i] = runEval(context.Background(), cases, configs[i].Summarizer, judge)
+	}
+
+	out := io.Writer(os.Stdout)
+	if *evalReport != "" {
+		file, err := os.Create(*evalReport)
+		require.NoError(t, err)
+		defer file.Close()
+		out = file
+	}
+	writeEvalReport(out, cases, configs[0], configs[1], results[0], results[1])
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvalScores(t *testing.T) {
+	reference := "alice will ship the importer on Friday"
+
+	assert.InDelta(t, 1, rouge1(reference, reference), 1e-9)
+	assert.InDelta(t, 1, rougeL("Alice will ship the importer on Friday.", reference), 1e-9)
+	assert.Zero(t, rouge1("nothing in common", reference))
+	assert.Zero(t, rougeL("", reference))
+
+	// Same words in another order share every unigram but not the sequence.
+	shuffled := "on Friday the importer alice will ship"
+	assert.InDelta(t, 1, rouge1(shuffled, reference), 1e-9)
+	assert.Less(t, rougeL(shuffled, reference), 1.0)
+
+	// "alice ship friday": precision 3/3, recall 3/7.
+	assert.InDelta(t, 0.6, rougeL("alice ship friday", reference), 1e-9)
+
+	assert.Equal(t, 1.0, mentionRecall("@alice and Bob.Smith agreed.", []string{"alice", "@bob.smith"}))
+	assert.Equal(t, 0.5, mentionRecall("alice agreed", []string{"alice", "bob"}))
+	assert.Equal(t, 0.0, mentionRecall("malice everywhere", []string{"alice"}))
+	assert.Equal(t, 1.0, mentionRecall("anything", nil))
+}
+
+func TestJudgeSummary(t *testing.T) {
+	grade, err := judgeSummary(context.Background(), &fakeSummarizer{answer: "4/5"}, "thread", "summary")
+	require.NoError(t, err)
+	assert.Equal(t, 4, grade)
+
+	_, err = judgeSummary(context.Background(), &fakeSummarizer{answer: "great summary"}, "thread", "summary")
+	assert.Error(t, err)
+}
+
+func TestRunEval(t *testing.T) {
+	cases, err := loadEvalCorpus("testdata/eval")
+	require.NoError(t, err)
+	require.Len(t, cases, 3)
+	assert.Equal(t, "incident", cases[0].Name)
+	assert.Len(t, cases[0].Thread.Posts, 4)
+	assert.Equal(t, "dave", cases[0].Thread.UsersByID["u1"].Username)
+
+	ctx := context.Background()
+	good := &fakeSummarizer{summary: "dave rolled back the deploy after erin found the index migration did not run on the read replicas."}
+	bad := &fakeSummarizer{summary: strings.Repeat("words ", 40)}
+	goodResults := runEval(ctx, cases[:1], good, &fakeSummarizer{answer: "5"})
+	badResults := runEval(ctx, cases[:1], bad, &fakeSummarizer{answer: "1"})
+
+	require.NoError(t, goodResults[0].Err)
+	assert.True(t, goodResults[0].WithinLength)
+	assert.Equal(t, 1.0, goodResults[0].MentionRecall)
+	assert.Greater(t, goodResults[0].RougeL, 0.4)
+	assert.Equal(t, 5, goodResults[0].JudgeGrade)
+
+	assert.False(t, badResults[0].WithinLength)
+	assert.Zero(t, badResults[0].MentionRecall)
+	assert.Equal(t, 1, badResults[0].JudgeGrade)
+
+	var report strings.Builder
+	writeEvalReport(&report, cases[:1], EvalConfig{Name: "good"}, EvalConfig{Name: "bad"}, goodResults, badResults)
+	assert.Contains(t, report.String(), "# Summary evaluation: good vs bad")
+	assert.Contains(t, report.String(), "| Mention recall | 1.00 | 0.00 | -1.00 |")
+	assert.Contains(t, report.String(), "| regression |")
+
+	failing := &fakeSummarizer{err: errors.New("backend down")}
+	failedResults := runEval(ctx, cases[:1], failing, nil)
+	assert.Equal(t, 1, aggregateResults(failedResults).Errors)
+
+	// A failing judge leaves the summary and its other scores in.
+	judgeFailedResults := runEval(ctx, cases[:1], good, &fakeSummarizer{err: errors.New("judge down")})
+	require.NoError(t, judgeFailedResults[0].Err)
+	assert.EqualError(t, judgeFailedResults[0].JudgeErr, "judge down")
+	assert.Equal(t, goodResults[0].Summary, judgeFailedResults[0].Summary)
+	assert.Equal(t, goodResults[0].RougeL, judgeFailedResults[0].RougeL)
+	aggregate := aggregateResults(judgeFailedResults)
+	assert.Zero(t, aggregate.Errors)
+	assert.Equal(t, 1, aggregate.JudgeErrors)
+	assert.Equal(t, 1.0, aggregate.MentionRecall)
+
+	report.Reset()
+	writeEvalReport(&report, cases[:1], EvalConfig{Name: "good"}, EvalConfig{Name: "judge down"}, goodResults, judgeFailedResults)
+	assert.Contains(t, report.String(), "| Judge errors | 0 | 1 | +1 |")
+	assert.Contains(t, report.String(), "| 5 → ? | judge error: judge down |")
+}
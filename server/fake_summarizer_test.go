@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// fakeSummarizer is a Summarizer that answers without calling any LLM and records every call.
+// Summaries and answers are derived from the input unless summary or answer are set.
+type fakeSummarizer struct {
+	mu      sync.Mutex
+	calls   []string
+	err     error
+	summary string
+	answer  string
+}
+
+func (f *fakeSummarizer) record(call string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+	return f.err
+}
+
+func (f *fakeSummarizer) Info() SummarizerInfo {
+	return SummarizerInfo{Backend: "fake", Model: "fake-model"}
+}
+
+func (f *fakeSummarizer) SummarizeThread(ctx context.Context, thread, language string) (string, error) {
+	if err := f.record("SummarizeThread"); err != nil {
+		return "", err
+	}
+	if f.summary != "" {
+		return f.summary, nil
+	}
+	return fmt.Sprintf("summary of %d posts", strings.Count(thread, "\n\n")), nil
+}
+
+func (f *fakeSummarizer) SummarizeThreadStructured(ctx context.Context, thread, language string) (*StructuredSummary, error) {
+	if err := f.record("SummarizeThreadStructured"); err != nil {
+		return nil, err
+	}
+	return &StructuredSummary{TLDR: "structured summary"}, nil
+}
+
+func (f *fakeSummarizer) AnswerQuestionOnThread(ctx context.Context, thread, question, language string) (string, error) {
+	if err := f.record("AnswerQuestionOnThread"); err != nil {
+		return "", err
+	}
+	if f.answer != "" {
+		return f.answer, nil
+	}
+	return "answer to " + question, nil
+}
+
+func (f *fakeSummarizer) SummarizeSummaries(ctx context.Context, summaries, language string) (string, error) {
+	if err := f.record("SummarizeSummaries"); err != nil {
+		return "", err
+	}
+	return "digest", nil
+}
+
+func (f *fakeSummarizer) Translate(ctx context.Context, text, language string) (string, error) {
+	if err := f.record("Translate"); err != nil {
+		return "", err
+	}
+	return "[" + language + "] " + text, nil
+}
+
+func (f *fakeSummarizer) TranslateMessages(ctx context.Context, messages []string, language string) ([]string, error) {
+	if err := f.record("TranslateMessages"); err != nil {
+		return nil, err
+	}
+	translations := make([]string, len(messages))
+	for i, message := range messages {
+		translations[i] = "[" + language + "] " + message
+	}
+	return translations, nil
+}
+
+func (f *fakeSummarizer) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.calls...)
+}
+
+func (f *fakeSummarizer) CheckHealth(ctx context.Context) *HealthStatus {
+	return newHealthStatus(f.Info(), 0, f.record("CheckHealth"))
+}
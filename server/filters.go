@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+const defaultChannelSummaryWindow = 24 * time.Hour
+
+// SummaryFilters selects which posts are included in a summary. It is shared between the slash
+// command and the REST API.
+type SummaryFilters struct {
+	Since                  time.Time
+	Until                  time.Time
+	FromUsername           string
+	FromUserID             string
+	OnlyThreadsWithReplies bool
+}
+
+// parseSummaryFilters extracts the filter flags from the given command arguments. Any argument that
+// is not a filter flag is returned untouched so it can be used as the question.
+func parseSummaryFilters(args []string, now time.Time) (*SummaryFilters, []string, error) {
+	filters := &SummaryFilters{}
+	rest := []string{}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "--") {
+			rest = append(rest, arg)
+			continue
+		}
+
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+		needsValue := func() (string, error) {
+			if hasValue {
+				return value, nil
+			}
+			if i+1 >= len(args) {
+				return "", errors.Errorf("missing value for --%s", name)
+			}
+			i++
+			return args[i], nil
+		}
+
+		switch name {
+		case "since", "until":
+			value, err := needsValue()
+			if err != nil {
+				return nil, nil, err
+			}
+			t, err := parseTimeFilter(value, now)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "invalid value for --%s", name)
+			}
+			if name == "since" {
+				filters.Since = t
+			} else {
+				filters.Until = t
+			}
+		case "from":
+			value, err := needsValue()
+			if err != nil {
+				return nil, nil, err
+			}
+			filters.FromUsername = strings.TrimPrefix(value, "@")
+		case "only-threads-with-replies":
+			filters.OnlyThreadsWithReplies = true
+		default:
+			return nil, nil, errors.Errorf("unknown flag --%s", name)
+		}
+	}
+
+	if err := filters.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	return filters, rest, nil
+}
+
+// summaryFiltersFromQuery builds the filters from the query parameters of a REST request, using the
+// same syntax as the slash command flags.
+func summaryFiltersFromQuery(query url.Values, now time.Time) (*SummaryFilters, error) {
+	filters := &SummaryFilters{}
+
+	if since := query.Get("since"); since != "" {
+		t, err := parseTimeFilter(since, now)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid value for since")
+		}
+		filters.Since = t
+	}
+
+	if until := query.Get("until"); until != "" {
+		t, err := parseTimeFilter(until, now)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid value for until")
+		}
+		filters.Until = t
+	}
+
+	filters.FromUsername = strings.TrimPrefix(query.Get("from"), "@")
+
+	if onlyThreads := query.Get("only_threads_with_replies"); onlyThreads != "" {
+		value, err := strconv.ParseBool(onlyThreads)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid value for only_threads_with_replies")
+		}
+		filters.OnlyThreadsWithReplies = value
+	}
+
+	if err := filters.validate(); err != nil {
+		return nil, err
+	}
+
+	return filters, nil
+}
+
+func (f *SummaryFilters) validate() error {
+	if !f.Since.IsZero() && !f.Until.IsZero() && !f.Since.Before(f.Until) {
+		return errors.New("--since must be before --until")
+	}
+
+	return nil
+}
+
+// parseTimeFilter accepts either a duration relative to now (30m, 12h, 7d, 2w) or an absolute
+// date (2006-01-02) or timestamp (RFC 3339).
+func parseTimeFilter(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	if t, err := time.ParseInLocation("2006-01-02", value, now.Location()); err == nil {
+		return t, nil
+	}
+
+	duration, err := parseDuration(value)
+	if err != nil {
+		return time.Time{}, errors.Errorf("%q is not a duration (e.g. 12h, 7d, 2w) or a date (e.g. 2006-01-02)", value)
+	}
+
+	return now.Add(-duration), nil
+}
+
+// parseDuration extends time.ParseDuration with day (d) and week (w) units.
+func parseDuration(value string) (time.Duration, error) {
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(value, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(value, "w"):
+		unit = 7 * 24 * time.Hour
+	}
+
+	if unit == 0 {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return 0, err
+		}
+		if duration <= 0 {
+			return 0, errors.New("duration must be positive")
+		}
+		return duration, nil
+	}
+
+	count, err := strconv.Atoi(value[:len(value)-1])
+	if err != nil || count <= 0 {
+		return 0, errors.Errorf("invalid duration %q", value)
+	}
+
+	return time.Duration(count) * unit, nil
+}
+
+// resolveSummaryFilters looks up the users referenced by the filters, failing if any of them is unknown.
+func (p *Plugin) resolveSummaryFilters(filters *SummaryFilters) error {
+	if filters.FromUsername == "" {
+		return nil
+	}
+
+	user, err := p.pluginAPI.User.GetByUsername(filters.FromUsername)
+	if err != nil {
+		return errors.Errorf("unknown user @%s", filters.FromUsername)
+	}
+	filters.FromUserID = user.Id
+
+	return nil
+}
+
+// Apply returns the posts that match the filters.
+func (f *SummaryFilters) Apply(posts []*model.Post) []*model.Post {
+	result := make([]*model.Post, 0, len(posts))
+	for _, post := range posts {
+		if post.DeleteAt != 0 {
+			continue
+		}
+		if !f.Since.IsZero() && post.CreateAt < model.GetMillisForTime(f.Since) {
+			continue
+		}
+		if !f.Until.IsZero() && post.CreateAt > model.GetMillisForTime(f.Until) {
+			continue
+		}
+		if f.FromUserID != "" && post.UserId != f.FromUserID {
+			continue
+		}
+		if f.OnlyThreadsWithReplies && post.RootId == "" && post.ReplyCount == 0 {
+			continue
+		}
+		result = append(result, post)
+	}
+
+	return result
+}
+
+// Description returns a human readable summary of the active filters.
+func (f *SummaryFilters) Description() string {
+	parts := []string{}
+	if !f.Since.IsZero() {
+		parts = append(parts, fmt.Sprintf("since %s", f.Since.Format(time.RFC1123)))
+	}
+	if !f.Until.IsZero() {
+		parts = append(parts, fmt.Sprintf("until %s", f.Until.Format(time.RFC1123)))
+	}
+	if f.FromUsername != "" {
+		parts = append(parts, fmt.Sprintf("from @%s", f.FromUsername))
+	}
+	if f.OnlyThreadsWithReplies {
+		parts = append(parts, "only threads with replies")
+	}
+
+	return strings.Join(parts, ", ")
+}
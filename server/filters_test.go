@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSummaryFilters(t *testing.T) {
+	now := time.Date(2023, 5, 10, 12, 0, 0, 0, time.UTC)
+
+	t.Run("flags and question", func(t *testing.T) {
+		filters, rest, err := parseSummaryFilters([]string{"--since", "2d", "--from", "@alice", "--only-threads-with-replies", "what", "happened?"}, now)
+		require.NoError(t, err)
+		assert.Equal(t, now.Add(-48*time.Hour), filters.Since)
+		assert.Equal(t, "alice", filters.FromUsername)
+		assert.True(t, filters.OnlyThreadsWithReplies)
+		assert.Equal(t, []string{"what", "happened?"}, rest)
+	})
+
+	t.Run("inline values and dates", func(t *testing.T) {
+		filters, _, err := parseSummaryFilters([]string{"--since=2023-05-01", "--until=12h"}, now)
+		require.NoError(t, err)
+		assert.Equal(t, time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC), filters.Since)
+		assert.Equal(t, now.Add(-12*time.Hour), filters.Until)
+	})
+
+	for name, args := range map[string][]string{
+		"bad duration":   {"--since", "yesterday"},
+		"missing value":  {"--from"},
+		"unknown flag":   {"--everything"},
+		"inverted range": {"--since", "1h", "--until", "2h"},
+		"zero duration":  {"--since", "0d"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := parseSummaryFilters(args, now)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestSummaryFiltersFromQuery(t *testing.T) {
+	now := time.Date(2023, 5, 10, 12, 0, 0, 0, time.UTC)
+
+	filters, err := summaryFiltersFromQuery(url.Values{"since": {"1w"}, "from": {"bob"}, "only_threads_with_replies": {"true"}}, now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(-7*24*time.Hour), filters.Since)
+	assert.Equal(t, "bob", filters.FromUsername)
+	assert.True(t, filters.OnlyThreadsWithReplies)
+
+	_, err = summaryFiltersFromQuery(url.Values{"only_threads_with_replies": {"maybe"}}, now)
+	assert.Error(t, err)
+}
+
+func TestSummaryFiltersApply(t *testing.T) {
+	now := time.Date(2023, 5, 10, 12, 0, 0, 0, time.UTC)
+	posts := []*model.Post{
+		{Id: "old", UserId: "alice", CreateAt: model.GetMillisForTime(now.Add(-72 * time.Hour))},
+		{Id: "root", UserId: "alice", CreateAt: model.GetMillisForTime(now.Add(-2 * time.Hour)), ReplyCount: 1},
+		{Id: "reply", UserId: "bob", RootId: "root", CreateAt: model.GetMillisForTime(now.Add(-time.Hour))},
+		{Id: "lonely", UserId: "bob", CreateAt: model.GetMillisForTime(now.Add(-time.Hour))},
+		{Id: "deleted", UserId: "bob", CreateAt: model.GetMillisForTime(now.Add(-time.Hour)), DeleteAt: 1},
+	}
+
+	ids := func(posts []*model.Post) []string {
+		result := []string{}
+		for _, post := range posts {
+			result = append(result, post.Id)
+		}
+		return result
+	}
+
+	filters := &SummaryFilters{Since: now.Add(-24 * time.Hour)}
+	assert.Equal(t, []string{"root", "reply", "lonely"}, ids(filters.Apply(posts)))
+
+	filters = &SummaryFilters{FromUserID: "bob"}
+	assert.Equal(t, []string{"reply", "lonely"}, ids(filters.Apply(posts)))
+
+	filters = &SummaryFilters{OnlyThreadsWithReplies: true}
+	assert.Equal(t, []string{"root", "reply"}, ids(filters.Apply(posts)))
+}
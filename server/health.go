@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	pluginapi "github.com/mattermost/mattermost-plugin-api"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	healthCheckTimeout = 15 * time.Second
+
+	// configurationCheckDelay debounces the checks of configuration changes, which are saved in
+	// bursts from the System Console.
+	configurationCheckDelay = 10 * time.Second
+
+	// configurationCheckClaimTTL is how long a node that checked a configuration keeps the other
+	// nodes of the cluster from checking it again.
+	configurationCheckClaimTTL = time.Minute
+
+	lastDiagnosisKey              = "last_diagnosis"
+	configurationCheckClaimPrefix = "configuration_check_"
+)
+
+const (
+	HealthAuthOK      = "ok"
+	HealthAuthInvalid = "invalid"
+	HealthAuthUnknown = "unknown"
+
+	HealthModelAvailable   = "available"
+	HealthModelUnavailable = "unavailable"
+	HealthModelUnknown     = "unknown"
+)
+
+// HealthStatus is the result of a test completion against a backend.
+type HealthStatus struct {
+	Backend     string `json:"backend"`
+	Model       string `json:"model"`
+	Healthy     bool   `json:"healthy"`
+	Auth        string `json:"auth"`
+	ModelStatus string `json:"model_status"`
+	LatencyMS   int64  `json:"latency_ms"`
+	Error       string `json:"error,omitempty"`
+	CheckedAt   int64  `json:"checked_at"`
+}
+
+// newHealthStatus derives the status of the credentials and the model from the error of a test
+// completion.
+func newHealthStatus(info SummarizerInfo, latency time.Duration, err error) *HealthStatus {
+	status := &HealthStatus{
+		Backend:     info.Backend,
+		Model:       info.Model,
+		Healthy:     true,
+		Auth:        HealthAuthOK,
+		ModelStatus: HealthModelAvailable,
+		LatencyMS:   latency.Milliseconds(),
+		CheckedAt:   model.GetMillis(),
+	}
+	if err == nil {
+		return status
+	}
+
+	status.Healthy = false
+	status.Error = err.Error()
+
+	var llmErr *LLMError
+	var apiErr *openai.APIError
+	switch {
+	case errors.As(err, &llmErr) && llmErr.Kind == LLMErrorAuth:
+		status.Auth = HealthAuthInvalid
+		status.ModelStatus = HealthModelUnknown
+	case errors.As(err, &apiErr) && (apiErr.Code == "model_not_found" || apiErr.HTTPStatusCode == http.StatusNotFound):
+		status.ModelStatus = HealthModelUnavailable
+	case errors.As(err, &llmErr) && llmErr.Kind == LLMErrorQuotaExceeded:
+		// The backend knew both the key and the model to apply their quota.
+	default:
+		status.Auth = HealthAuthUnknown
+		status.ModelStatus = HealthModelUnknown
+	}
+
+	return status
+}
+
+// Diagnosis combines the problems found in the configuration with the health of the backend.
+type Diagnosis struct {
+	Healthy  bool          `json:"healthy"`
+	Problems []string      `json:"problems"`
+	Backend  *HealthStatus `json:"backend"`
+}
+
+// validateConfiguration returns the problems of the configuration that can be found without
+// reaching the backend.
+func validateConfiguration(c *configuration) []string {
+	problems := []string{}
+	for _, setting := range []struct{ name, value string }{
+		{"OpenAI API URL", c.OpenAIAPIURL},
+		{"Embedding API URL", c.EmbeddingAPIURL},
+	} {
+		if setting.value == "" {
+			continue
+		}
+		if parsed, err := url.Parse(setting.value); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			problems = append(problems, fmt.Sprintf("The %s %q is not a valid http or https URL.", setting.name, setting.value))
+		}
+	}
+
+	if strings.TrimSpace(c.AllowedUserIDs) == "" {
+		problems = append(problems, "No user is allowed to use the plugin, set the allowed user IDs.")
+	}
+	if strings.TrimSpace(c.AllowedTeamIDs) == "" {
+		problems = append(problems, "No team is allowed to use the plugin, set the allowed team IDs.")
+	}
+
+	return problems
+}
+
+// diagnose validates the configuration and, when an API key is available, runs a test completion
+// with the summarizer.
+func (p *Plugin) diagnose(ctx context.Context, config *configuration, summarizer Summarizer) *Diagnosis {
+	diagnosis := &Diagnosis{Problems: validateConfiguration(config)}
+
+	_, err := p.resolveAPIKey(ctx, CredentialBackendOpenAI)
+	switch {
+	case errors.Is(err, ErrNoAPIKey):
+		diagnosis.Problems = append([]string{"The OpenAI API key is not set."}, diagnosis.Problems...)
+	case err != nil:
+		diagnosis.Problems = append([]string{fmt.Sprintf("The OpenAI API key can't be read: %s.", err.Error())}, diagnosis.Problems...)
+	case summarizer != nil:
+		diagnosis.Backend = summarizer.CheckHealth(ctx)
+	}
+	diagnosis.Healthy = len(diagnosis.Problems) == 0 && diagnosis.Backend != nil && diagnosis.Backend.Healthy
+
+	return diagnosis
+}
+
+// setLastDiagnosis stores the diagnosis in the KV store, so every node of a cluster shows the same
+// one in the System Console.
+func (p *Plugin) setLastDiagnosis(diagnosis *Diagnosis) {
+	if _, err := p.pluginAPI.KV.Set(lastDiagnosisKey, diagnosis); err != nil {
+		p.API.LogWarn("Failed to save the diagnosis", "error", err.Error())
+	}
+}
+
+func (p *Plugin) getLastDiagnosis() *Diagnosis {
+	var diagnosis *Diagnosis
+	if err := p.pluginAPI.KV.Get(lastDiagnosisKey, &diagnosis); err != nil {
+		p.API.LogWarn("Failed to get the last diagnosis", "error", err.Error())
+		return nil
+	}
+
+	return diagnosis
+}
+
+// scheduleConfigurationCheck checks the configuration once it stops changing for a while.
+func (p *Plugin) scheduleConfigurationCheck() {
+	p.healthLock.Lock()
+	defer p.healthLock.Unlock()
+
+	if p.configurationCheckTimer != nil {
+		p.configurationCheckTimer.Stop()
+	}
+	p.configurationCheckTimer = time.AfterFunc(configurationCheckDelay, p.checkConfiguration)
+}
+
+func (p *Plugin) stopConfigurationCheck() {
+	p.healthLock.Lock()
+	defer p.healthLock.Unlock()
+
+	if p.configurationCheckTimer != nil {
+		p.configurationCheckTimer.Stop()
+		p.configurationCheckTimer = nil
+	}
+}
+
+// claimConfigurationCheck reports whether this node is the first of the cluster to check the
+// configuration. Every node is notified of a change, but the test completion is only paid once.
+func (p *Plugin) claimConfigurationCheck(config *configuration) (bool, error) {
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		return false, err
+	}
+	hash := sha256.Sum256(encoded)
+
+	claimed, err := p.pluginAPI.KV.Set(configurationCheckClaimPrefix+hex.EncodeToString(hash[:8]), model.GetMillis(),
+		pluginapi.SetAtomic(nil), pluginapi.SetExpiry(configurationCheckClaimTTL))
+	if err != nil {
+		return false, errors.Wrap(err, "failed to claim the configuration check")
+	}
+
+	return claimed, nil
+}
+
+// checkConfiguration diagnoses the current configuration with the summarizer serving requests,
+// logging the problems found. The result is shown in the System Console.
+func (p *Plugin) checkConfiguration() {
+	config := p.getConfiguration()
+	claimed, err := p.claimConfigurationCheck(config)
+	if err != nil {
+		p.API.LogWarn("Failed to check the configuration", "error", err.Error())
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	diagnosis := p.diagnose(context.Background(), config, p.getSummarizer())
+	p.setLastDiagnosis(diagnosis)
+
+	for _, problem := range diagnosis.Problems {
+		p.API.LogWarn("Plugin configuration problem", "problem", problem)
+	}
+	if backend := diagnosis.Backend; backend != nil && !backend.Healthy {
+		p.API.LogWarn("LLM backend health check failed",
+			"backend", backend.Backend,
+			"model", backend.Model,
+			"auth", backend.Auth,
+			"model_status", backend.ModelStatus,
+			"error", backend.Error,
+		)
+	}
+}
+
+func formatDiagnosis(diagnosis *Diagnosis) string {
+	var sb strings.Builder
+	sb.WriteString("#### Summarizer diagnostics\n\n")
+
+	if backend := diagnosis.Backend; backend != nil {
+		fmt.Fprintf(&sb, "- Backend: %s, model %s\n", backend.Backend, backend.Model)
+		fmt.Fprintf(&sb, "- Authentication: %s\n", backend.Auth)
+		fmt.Fprintf(&sb, "- Model: %s\n", backend.ModelStatus)
+		fmt.Fprintf(&sb, "- Latency: %d ms\n", backend.LatencyMS)
+		if backend.Error != "" {
+			fmt.Fprintf(&sb, "- Error: %s\n", backend.Error)
+		}
+	} else {
+		sb.WriteString("- Backend: not checked\n")
+	}
+
+	if len(diagnosis.Problems) > 0 {
+		sb.WriteString("\n**Configuration problems**\n")
+		for _, problem := range diagnosis.Problems {
+			fmt.Fprintf(&sb, "- %s\n", problem)
+		}
+	}
+
+	if diagnosis.Healthy {
+		sb.WriteString("\nEverything looks good.")
+	} else {
+		sb.WriteString("\nSummarization won't work until the problems above are fixed.")
+	}
+
+	return sb.String()
+}
+
+func (p *Plugin) executeDiagnoseCommand(args *model.CommandArgs, params []string) (*model.CommandResponse, error) {
+	if !p.pluginAPI.User.HasPermissionTo(args.UserId, model.PermissionManageSystem) {
+		return ephemeralResponse(args, "Only system admins can run diagnostics."), nil
+	}
+
+	diagnosis := p.diagnose(context.Background(), p.getConfiguration(), p.getSummarizer())
+	p.setLastDiagnosis(diagnosis)
+
+	return ephemeralResponse(args, formatDiagnosis(diagnosis)), nil
+}
+
+// handleHealth runs the diagnostics, or returns the last ones with cached=true. The response
+// status is 503 when summarization can't work.
+func (p *Plugin) handleHealth(c *gin.Context) {
+	var diagnosis *Diagnosis
+	if c.Query("cached") == "true" {
+		diagnosis = p.getLastDiagnosis()
+	}
+	if diagnosis == nil {
+		diagnosis = p.diagnose(c.Request.Context(), p.getConfiguration(), p.getSummarizer())
+		p.setLastDiagnosis(diagnosis)
+	}
+
+	status := http.StatusOK
+	if !diagnosis.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, diagnosis)
+}
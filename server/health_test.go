@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pluginapi "github.com/mattermost/mattermost-plugin-api"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAISummarizerCheckHealth(t *testing.T) {
+	for name, tc := range map[string]struct {
+		fixture     string
+		healthy     bool
+		auth        string
+		modelStatus string
+	}{
+		"healthy":         {"summarize_thread", true, HealthAuthOK, HealthModelAvailable},
+		"invalid api key": {"invalid_api_key", false, HealthAuthInvalid, HealthModelUnknown},
+		"unknown model":   {"model_not_found", false, HealthAuthOK, HealthModelUnavailable},
+	} {
+		t.Run(name, func(t *testing.T) {
+			standIn := newOpenAIStandIn(t, tc.fixture)
+			usages := 0
+			summarizer := NewOpenAISummarizer(staticAPIKey("test-key"), standIn.APIURL(), time.Second, 0, func(context.Context, TokenUsage) { usages++ })
+
+			status := summarizer.CheckHealth(context.Background())
+			assert.Equal(t, tc.healthy, status.Healthy)
+			assert.Equal(t, tc.auth, status.Auth)
+			assert.Equal(t, tc.modelStatus, status.ModelStatus)
+			assert.Equal(t, "openai", status.Backend)
+			assert.Equal(t, tc.healthy, status.Error == "")
+			assert.Zero(t, usages, "health checks are not charged")
+
+			requests := standIn.Requests()
+			require.Len(t, requests, 1)
+			assert.Equal(t, 1, requests[0].MaxTokens)
+		})
+	}
+}
+
+func TestValidateConfiguration(t *testing.T) {
+	valid := &configuration{
+		OpenAIAPIKey:   "sk-test",
+		AllowedUserIDs: testUserID,
+		AllowedTeamIDs: testTeamID,
+	}
+	assert.Empty(t, validateConfiguration(valid))
+
+	assert.Equal(t, []string{
+		`The OpenAI API URL "localhost:8080" is not a valid http or https URL.`,
+		"No user is allowed to use the plugin, set the allowed user IDs.",
+		"No team is allowed to use the plugin, set the allowed team IDs.",
+	}, validateConfiguration(&configuration{
+		OpenAIAPIURL:         "localhost:8080",
+		EmbeddingAPIURL:      "https://embeddings.example.com/v1",
+		EnableSemanticSearch: true,
+		EmbeddingModel:       "nomic-embed-text",
+	}))
+}
+
+func TestDiagnoseCommand(t *testing.T) {
+	t.Run("system admins only", func(t *testing.T) {
+		p, api, summarizer := newTestPlugin(t, &configuration{OpenAIAPIKey: "sk-test"})
+		mockChannel(api, model.ChannelTypeOpen)
+		api.On("HasPermissionTo", testUserID, model.PermissionManageSystem).Return(false)
+
+		response, appErr := p.ExecuteCommand(nil, summarizeArgs("/summarize diagnose", ""))
+		require.Nil(t, appErr)
+		assert.Equal(t, "Only system admins can run diagnostics.", response.Text)
+		assert.Empty(t, summarizer.Calls())
+	})
+
+	t.Run("healthy", func(t *testing.T) {
+		p, api, summarizer := newTestPlugin(t, &configuration{OpenAIAPIKey: "sk-test"})
+		mockChannel(api, model.ChannelTypeOpen)
+		mockCredentialStore(api)
+		mockKVStore(api, lastDiagnosisKey)
+		api.On("HasPermissionTo", testUserID, model.PermissionManageSystem).Return(true)
+
+		response, appErr := p.ExecuteCommand(nil, summarizeArgs("/summarize diagnose", ""))
+		require.Nil(t, appErr)
+		assert.Contains(t, response.Text, "- Backend: fake, model fake-model\n- Authentication: ok\n- Model: available\n")
+		assert.Contains(t, response.Text, "Everything looks good.")
+		assert.Equal(t, []string{"CheckHealth"}, summarizer.Calls())
+		assert.True(t, p.getLastDiagnosis().Healthy)
+	})
+
+	t.Run("missing api key", func(t *testing.T) {
+		p, api, summarizer := newTestPlugin(t, nil)
+		mockChannel(api, model.ChannelTypeOpen)
+		mockCredentialStore(api)
+		mockKVStore(api, lastDiagnosisKey)
+		api.On("HasPermissionTo", testUserID, model.PermissionManageSystem).Return(true)
+
+		response, appErr := p.ExecuteCommand(nil, summarizeArgs("/summarize diagnose", ""))
+		require.Nil(t, appErr)
+		assert.Contains(t, response.Text, "- Backend: not checked\n")
+		assert.Contains(t, response.Text, "- The OpenAI API key is not set.\n")
+		assert.Empty(t, summarizer.Calls())
+	})
+
+	t.Run("stored credential", func(t *testing.T) {
+		p, api, summarizer := newTestPlugin(t, nil)
+		mockChannel(api, model.ChannelTypeOpen)
+		mockCredentialStore(api)
+		mockKVStore(api, lastDiagnosisKey)
+		api.On("HasPermissionTo", testUserID, model.PermissionManageSystem).Return(true)
+		_, err := p.setCredential(defaultCredentialName, CredentialBackendOpenAI, "", "sk-stored", testUserID)
+		require.NoError(t, err)
+
+		response, appErr := p.ExecuteCommand(nil, summarizeArgs("/summarize diagnose", ""))
+		require.Nil(t, appErr)
+		assert.Contains(t, response.Text, "Everything looks good.")
+		assert.Equal(t, []string{"CheckHealth"}, summarizer.Calls())
+	})
+}
+
+func TestHandleHealth(t *testing.T) {
+	p, api, summarizer := newTestPlugin(t, &configuration{OpenAIAPIKey: "sk-test"})
+	mockCredentialStore(api)
+	mockKVStore(api, lastDiagnosisKey)
+	api.On("HasPermissionTo", testUserID, model.PermissionManageSystem).Return(true)
+
+	get := func(path string) (int, *Diagnosis) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Mattermost-User-ID", testUserID)
+		p.ServeHTTP(nil, w, r)
+
+		diagnosis := &Diagnosis{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(diagnosis))
+		return w.Code, diagnosis
+	}
+
+	status, diagnosis := get("/api/v1/health")
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, diagnosis.Healthy)
+	assert.Equal(t, HealthAuthOK, diagnosis.Backend.Auth)
+
+	// The cached diagnosis doesn't reach the backend again.
+	status, _ = get("/api/v1/health?cached=true")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"CheckHealth"}, summarizer.Calls())
+
+	summarizer.err = &LLMError{Kind: LLMErrorAuth, Err: assert.AnError}
+	status, diagnosis = get("/api/v1/health")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.False(t, diagnosis.Healthy)
+	assert.Equal(t, HealthAuthInvalid, diagnosis.Backend.Auth)
+}
+
+func TestCheckConfiguration(t *testing.T) {
+	p, api, summarizer := newTestPlugin(t, &configuration{OpenAIAPIKey: "sk-test"})
+	mockCredentialStore(api)
+	mockKVStore(api, lastDiagnosisKey, configurationCheckClaimPrefix)
+
+	// Another node of the cluster, notified of the same configuration change.
+	otherSummarizer := &fakeSummarizer{}
+	other := &Plugin{summarizer: otherSummarizer}
+	other.SetAPI(api)
+	other.pluginAPI = pluginapi.NewClient(api, nil)
+	other.setConfiguration(p.getConfiguration())
+
+	p.checkConfiguration()
+	other.checkConfiguration()
+
+	// The backend serving requests is checked once for the whole cluster, and every node shows
+	// the result.
+	assert.Equal(t, []string{"CheckHealth"}, summarizer.Calls())
+	assert.Empty(t, otherSummarizer.Calls())
+	require.NotNil(t, other.getLastDiagnosis())
+	assert.True(t, other.getLastDiagnosis().Healthy)
+
+	// A new configuration is checked again.
+	config := p.getConfiguration().Clone()
+	config.LLMMaxRetries = 5
+	other.setConfiguration(config)
+	other.checkConfiguration()
+	assert.Equal(t, []string{"CheckHealth"}, otherSummarizer.Calls())
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/mattermost/mattermost-plugin-api/cluster"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+	"github.com/pkg/errors"
+)
+
+const (
+	indexQueueSize    = 1000
+	indexBatchSize    = 50
+	indexJobInterval  = time.Minute
+	backfillBatchSize = 100
+
+	// backfillBatchesPerRun bounds how long a single run of the indexer job takes. The job
+	// resumes from the checkpoint on its next run.
+	backfillBatchesPerRun = 20
+
+	// pruneBatchSize bounds how many deleted posts are removed from the index per run.
+	pruneBatchSize = 1000
+
+	backfillProgressKey = "indexer_backfill"
+)
+
+// postIndexer keeps the vector index in sync with new and edited posts. Posts are queued by the
+// hooks and embedded in batches in the background. When the queue is full the post is dropped
+// and only picked up by the next reindex, so a slow embeddings API never blocks posting.
+type postIndexer struct {
+	plugin  *Plugin
+	queue   chan *model.Post
+	dropped int64
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+func newPostIndexer(p *Plugin) *postIndexer {
+	return &postIndexer{
+		plugin: p,
+		queue:  make(chan *model.Post, indexQueueSize),
+		stop:   make(chan struct{}),
+	}
+}
+
+func (i *postIndexer) Start() {
+	i.done.Add(1)
+	go i.run()
+}
+
+// Stop waits for the batch being indexed, discarding whatever is still queued.
+func (i *postIndexer) Stop() {
+	close(i.stop)
+	i.done.Wait()
+}
+
+// Enqueue schedules the post to be indexed without blocking.
+func (i *postIndexer) Enqueue(post *model.Post) {
+	if i == nil {
+		return
+	}
+
+	select {
+	case i.queue <- post:
+	default:
+		atomic.AddInt64(&i.dropped, 1)
+	}
+}
+
+func (i *postIndexer) QueueLength() int {
+	return len(i.queue)
+}
+
+func (i *postIndexer) Dropped() int64 {
+	return atomic.LoadInt64(&i.dropped)
+}
+
+func (i *postIndexer) run() {
+	defer i.done.Done()
+
+	for {
+		var post *model.Post
+		select {
+		case <-i.stop:
+			return
+		case post = <-i.queue:
+		}
+
+		batch := map[string]*model.Post{post.Id: post}
+	drain:
+		for len(batch) < indexBatchSize {
+			select {
+			case post = <-i.queue:
+				batch[post.Id] = post
+			default:
+				break drain
+			}
+		}
+
+		posts := make([]*model.Post, 0, len(batch))
+		for _, post := range batch {
+			posts = append(posts, post)
+		}
+		if err := i.plugin.indexPosts(context.Background(), posts); err != nil {
+			i.plugin.API.LogError("Failed to index posts", "count", len(posts), "error", err.Error())
+		}
+	}
+}
+
+func (p *Plugin) MessageHasBeenPosted(c *plugin.Context, post *model.Post) {
+	if p.semanticSearchEnabled() {
+		p.getIndexer().Enqueue(post)
+	}
+}
+
+func (p *Plugin) MessageHasBeenUpdated(c *plugin.Context, newPost, oldPost *model.Post) {
+	if p.semanticSearchEnabled() && newPost.Message != oldPost.Message {
+		p.getIndexer().Enqueue(newPost)
+	}
+}
+
+// BackfillProgress is the checkpoint of the backfill, which walks every channel in ID order and
+// its posts in creation order.
+type BackfillProgress struct {
+	Running       bool   `json:"running"`
+	StartedAt     int64  `json:"started_at"`
+	UpdatedAt     int64  `json:"updated_at"`
+	FinishedAt    int64  `json:"finished_at"`
+	ChannelID     string `json:"channel_id"`
+	LastCreateAt  int64  `json:"last_create_at"`
+	LastPostID    string `json:"last_post_id"`
+	ChannelsDone  int    `json:"channels_done"`
+	ChannelsTotal int    `json:"channels_total"`
+	PostsIndexed  int    `json:"posts_indexed"`
+	LastError     string `json:"last_error,omitempty"`
+}
+
+func (p *Plugin) getBackfillProgress() (*BackfillProgress, error) {
+	var progress *BackfillProgress
+	if err := p.pluginAPI.KV.Get(backfillProgressKey, &progress); err != nil {
+		return nil, errors.Wrap(err, "failed to get backfill progress")
+	}
+
+	return progress, nil
+}
+
+func (p *Plugin) saveBackfillProgress(progress *BackfillProgress) error {
+	progress.UpdatedAt = model.GetMillis()
+	if _, err := p.pluginAPI.KV.Set(backfillProgressKey, progress); err != nil {
+		return errors.Wrap(err, "failed to save backfill progress")
+	}
+
+	return nil
+}
+
+// startBackfill restarts the backfill from the first channel. Posts already indexed are
+// embedded again, which also picks up a change of embedding model.
+func (p *Plugin) startBackfill() (*BackfillProgress, error) {
+	query, args, err := p.builder.Select("COUNT(*)").
+		From("Channels").
+		Where(sq.Eq{"DeleteAt": 0, "Type": p.indexableChannelTypes()}).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	var channelsTotal int
+	if err = p.db.Get(&channelsTotal, query, args...); err != nil {
+		return nil, errors.Wrap(err, "failed to count channels")
+	}
+
+	progress := &BackfillProgress{
+		Running:       true,
+		StartedAt:     model.GetMillis(),
+		ChannelsTotal: channelsTotal,
+	}
+
+	return progress, p.saveBackfillProgress(progress)
+}
+
+// startIndexer starts the background queue and the job that backfills existing posts and removes
+// deleted ones. The first activation with semantic search enabled starts a backfill.
+func (p *Plugin) startIndexer() error {
+	if !p.semanticSearchEnabled() {
+		return nil
+	}
+
+	progress, err := p.getBackfillProgress()
+	if err != nil {
+		return err
+	}
+	if progress == nil {
+		if _, err = p.startBackfill(); err != nil {
+			return err
+		}
+	}
+
+	job, err := cluster.Schedule(p.API, "indexer", cluster.MakeWaitForInterval(indexJobInterval), p.runIndexerJob)
+	if err != nil {
+		return errors.Wrap(err, "failed to schedule indexer job")
+	}
+
+	indexer := newPostIndexer(p)
+	indexer.Start()
+
+	p.backendLock.Lock()
+	p.indexer = indexer
+	p.indexerJob = job
+	p.backendLock.Unlock()
+
+	return nil
+}
+
+func (p *Plugin) stopIndexer() {
+	p.backendLock.Lock()
+	indexer, job := p.indexer, p.indexerJob
+	p.indexer, p.indexerJob = nil, nil
+	p.backendLock.Unlock()
+
+	// The indexer is stopped without the lock, as the batch it finishes reads the embedder.
+	if job != nil {
+		if err := job.Close(); err != nil {
+			p.API.LogError("Failed to close indexer job", "error", err.Error())
+		}
+	}
+	if indexer != nil {
+		indexer.Stop()
+	}
+}
+
+func (p *Plugin) runIndexerJob() {
+	if err := p.pruneDeletedPosts(); err != nil {
+		p.API.LogError("Failed to remove deleted posts from the index", "error", err.Error())
+	}
+
+	if err := p.runBackfill(backfillBatchesPerRun); err != nil {
+		p.API.LogError("Failed to backfill the index", "error", err.Error())
+	}
+}
+
+// runBackfill indexes up to the given number of batches, saving the checkpoint after each one.
+func (p *Plugin) runBackfill(batches int) error {
+	progress, err := p.getBackfillProgress()
+	if err != nil || progress == nil || !progress.Running {
+		return err
+	}
+
+	for ; batches > 0; batches-- {
+		if progress.ChannelID == "" {
+			channelID, channelErr := p.nextBackfillChannel(progress.ChannelID)
+			if channelErr != nil {
+				return channelErr
+			}
+			if channelID == "" {
+				progress.Running = false
+				progress.FinishedAt = model.GetMillis()
+				return p.saveBackfillProgress(progress)
+			}
+			progress.ChannelID = channelID
+		}
+
+		posts, postsErr := p.getBackfillPosts(progress)
+		if postsErr != nil {
+			return postsErr
+		}
+
+		if len(posts) > 0 {
+			if indexErr := p.indexPosts(context.Background(), posts); indexErr != nil {
+				progress.LastError = indexErr.Error()
+				_ = p.saveBackfillProgress(progress)
+				return indexErr
+			}
+			last := posts[len(posts)-1]
+			progress.LastCreateAt = last.CreateAt
+			progress.LastPostID = last.Id
+			progress.PostsIndexed += len(posts)
+			progress.LastError = ""
+		}
+
+		if len(posts) < backfillBatchSize {
+			nextChannelID, channelErr := p.nextBackfillChannel(progress.ChannelID)
+			if channelErr != nil {
+				return channelErr
+			}
+			progress.ChannelsDone++
+			progress.LastCreateAt = 0
+			progress.LastPostID = ""
+			progress.ChannelID = nextChannelID
+			if nextChannelID == "" {
+				progress.Running = false
+				progress.FinishedAt = model.GetMillis()
+				return p.saveBackfillProgress(progress)
+			}
+		}
+
+		if err = p.saveBackfillProgress(progress); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// nextBackfillChannel returns the channel following the given one, or "" once all are done. Only
+// the types of channels that may be summarized are backfilled. Policies and consents are checked
+// when the posts are indexed.
+func (p *Plugin) nextBackfillChannel(afterChannelID string) (string, error) {
+	query, args, err := p.builder.Select("Id").
+		From("Channels").
+		Where(sq.Eq{"DeleteAt": 0, "Type": p.indexableChannelTypes()}).
+		Where(sq.Gt{"Id": afterChannelID}).
+		OrderBy("Id ASC").
+		Limit(1).
+		ToSql()
+	if err != nil {
+		return "", err
+	}
+
+	channelIDs := []string{}
+	if err = p.db.Select(&channelIDs, query, args...); err != nil {
+		return "", errors.Wrap(err, "failed to get next channel")
+	}
+	if len(channelIDs) == 0 {
+		return "", nil
+	}
+
+	return channelIDs[0], nil
+}
+
+// getBackfillPosts reads the next batch of posts of the channel being backfilled. The Posts table
+// is read directly because the API only pages by offset, which shifts as new posts arrive.
+func (p *Plugin) getBackfillPosts(progress *BackfillProgress) ([]*model.Post, error) {
+	query, args, err := p.builder.Select("Id", "ChannelId", "UserId", "RootId", "Message", "Type", "CreateAt", "EditAt", "DeleteAt").
+		From("Posts").
+		Where(sq.Eq{"ChannelId": progress.ChannelID}).
+		Where(sq.Or{
+			sq.Gt{"CreateAt": progress.LastCreateAt},
+			sq.And{sq.Eq{"CreateAt": progress.LastCreateAt}, sq.Gt{"Id": progress.LastPostID}},
+		}).
+		OrderBy("CreateAt ASC", "Id ASC").
+		Limit(backfillBatchSize).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	posts := []*model.Post{}
+	if err = p.db.Select(&posts, query, args...); err != nil {
+		return nil, errors.Wrap(err, "failed to get posts to backfill")
+	}
+
+	return posts, nil
+}
+
+// pruneDeletedPosts removes deleted posts from the index. This server version doesn't notify
+// plugins of deleted posts, so they are found by comparing the index with the Posts table.
+func (p *Plugin) pruneDeletedPosts() error {
+	query, args, err := p.builder.Select("DISTINCT e.PostId").
+		From(embeddingsTable + " e").
+		Join("Posts p ON p.Id = e.PostId").
+		Where(sq.Gt{"p.DeleteAt": 0}).
+		Limit(pruneBatchSize).
+		ToSql()
+	if err != nil {
+		return err
+	}
+
+	postIDs := []string{}
+	if err = p.db.Select(&postIDs, query, args...); err != nil {
+		return errors.Wrap(err, "failed to find deleted posts")
+	}
+	if len(postIDs) == 0 {
+		return nil
+	}
+
+	return p.vectorIndex.ReplacePosts(postIDs, nil)
+}
+
+// IndexerStatus is reported to system admins.
+type IndexerStatus struct {
+	Enabled     bool              `json:"enabled"`
+	Pgvector    bool              `json:"pgvector"`
+	Model       string            `json:"model"`
+	Chunks      int               `json:"chunks"`
+	QueueLength int               `json:"queue_length"`
+	Dropped     int64             `json:"dropped"`
+	Backfill    *BackfillProgress `json:"backfill"`
+}
+
+func (p *Plugin) getIndexerStatus() (*IndexerStatus, error) {
+	status := &IndexerStatus{Enabled: p.semanticSearchEnabled()}
+	if !status.Enabled {
+		return status, nil
+	}
+
+	status.Pgvector = p.vectorIndex.usesPgvector()
+	status.Model = p.getEmbedder().Model()
+	if indexer := p.getIndexer(); indexer != nil {
+		status.QueueLength = indexer.QueueLength()
+		status.Dropped = indexer.Dropped()
+	}
+
+	query, args, err := p.builder.Select("COUNT(*)").From(embeddingsTable).Where(sq.Eq{"Model": status.Model}).ToSql()
+	if err != nil {
+		return nil, err
+	}
+	if err = p.db.Get(&status.Chunks, query, args...); err != nil {
+		return nil, errors.Wrap(err, "failed to count chunks")
+	}
+
+	if status.Backfill, err = p.getBackfillProgress(); err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
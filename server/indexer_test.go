@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEmbedder records the texts it is asked to embed.
+type fakeEmbedder struct {
+	mu    sync.Mutex
+	texts []string
+}
+
+func (f *fakeEmbedder) Model() string   { return "fake-embeddings" }
+func (f *fakeEmbedder) Dimensions() int { return 2 }
+
+func (f *fakeEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.texts = append(f.texts, texts...)
+	vectors := make([][]float32, len(texts))
+	for i := range texts {
+		vectors[i] = []float32{1, 0}
+	}
+	return vectors, nil
+}
+
+func (f *fakeEmbedder) Texts() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.texts...)
+}
+
+func TestPostIndexerQueue(t *testing.T) {
+	var nilIndexer *postIndexer
+	assert.NotPanics(t, func() { nilIndexer.Enqueue(&model.Post{Id: "post"}) })
+
+	indexer := newPostIndexer(&Plugin{})
+	for i := 0; i < indexQueueSize+5; i++ {
+		indexer.Enqueue(&model.Post{Id: model.NewId()})
+	}
+	assert.Equal(t, indexQueueSize, indexer.QueueLength())
+	assert.EqualValues(t, 5, indexer.Dropped(), "posts are dropped instead of blocking once the queue is full")
+
+	indexer.Start()
+	assert.Eventually(t, func() bool { return indexer.QueueLength() == 0 }, time.Second, 10*time.Millisecond)
+	indexer.Stop()
+}
+
+func TestIndexPostsChannelRules(t *testing.T) {
+	for name, tc := range map[string]struct {
+		config      *configuration
+		channelType model.ChannelType
+		policy      string
+		consents    string
+		indexed     bool
+	}{
+		"public channel":               {channelType: model.ChannelTypeOpen, indexed: true},
+		"private channels not allowed": {channelType: model.ChannelTypePrivate},
+		"private channels allowed":     {config: &configuration{AllowPrivateChannels: true}, channelType: model.ChannelTypePrivate, indexed: true},
+		"group messages not allowed":   {channelType: model.ChannelTypeGroup, consents: `{"` + testUserID + `": true, "` + testOtherID + `": true}`},
+		"DM without consent":           {config: &configuration{AllowDirectMessages: true}, channelType: model.ChannelTypeDirect, consents: `{"` + testUserID + `": true}`},
+		"DM with consent":              {config: &configuration{AllowDirectMessages: true}, channelType: model.ChannelTypeDirect, consents: `{"` + testUserID + `": true, "` + testOtherID + `": true}`, indexed: true},
+		"policy disabled":              {channelType: model.ChannelTypeOpen, policy: `{"mode": "disabled"}`},
+		"policy allows the backend":    {channelType: model.ChannelTypeOpen, policy: `{"mode": "enabled", "backend": "openai"}`, indexed: true},
+		"policy restricts the backend": {channelType: model.ChannelTypeOpen, policy: `{"mode": "enabled", "backend": "llama"}`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p, api, _ := newTestPlugin(t, tc.config)
+			db := newFakeDB(p, model.DatabaseDriverPostgres)
+			embedder := &fakeEmbedder{}
+			p.embedder = embedder
+			p.vectorIndex = &vectorIndex{plugin: p}
+			store := mockConversation(api, tc.channelType)
+			if tc.policy != "" {
+				store[channelPolicyKeyPrefix+testChannelID] = []byte(tc.policy)
+			}
+			if tc.consents != "" {
+				store[consentKeyPrefix+testChannelID] = []byte(tc.consents)
+			}
+
+			post := &model.Post{Id: testRootID, ChannelId: testChannelID, UserId: testUserID, Message: "Ship the importer on Friday?"}
+			require.NoError(t, p.indexPosts(context.Background(), []*model.Post{post, {Id: "replyreplyreplyreplyreply1", ChannelId: testChannelID, UserId: testOtherID, Message: "Fine by me"}}))
+
+			deletes := db.Statements("DELETE FROM LLMSummarize_Embeddings")
+			require.Len(t, deletes, 1, "previous chunks are always removed")
+			assert.Equal(t, []driver.Value{testRootID, "replyreplyreplyreplyreply1"}, deletes[0].Args)
+			if tc.indexed {
+				assert.Equal(t, []string{"Ship the importer on Friday?", "Fine by me"}, embedder.Texts())
+				assert.Len(t, db.Statements("INSERT INTO LLMSummarize_Embeddings"), 2)
+			} else {
+				assert.Empty(t, embedder.Texts(), "nothing is sent to the embeddings backend")
+				assert.Empty(t, db.Statements("INSERT INTO LLMSummarize_Embeddings"))
+			}
+		})
+	}
+}
+
+func TestBackfillChannelTypes(t *testing.T) {
+	p, _, _ := newTestPlugin(t, &configuration{AllowDirectMessages: true})
+	db := newFakeDB(p, model.DatabaseDriverPostgres)
+
+	_, err := p.nextBackfillChannel("")
+	require.NoError(t, err)
+	statements := db.Statements("SELECT Id FROM Channels")
+	require.Len(t, statements, 1)
+	assert.Equal(t, "SELECT Id FROM Channels WHERE DeleteAt = $1 AND Type IN ($2,$3) AND Id > $4 ORDER BY Id ASC LIMIT 1", statements[0].SQL)
+	assert.Equal(t, []driver.Value{int64(0), "O", "D", ""}, statements[0].Args)
+}
+
+func TestRemoveChannelFromIndex(t *testing.T) {
+	for name, tc := range map[string]struct {
+		channelType model.ChannelType
+		command     string
+		removed     bool
+	}{
+		"policy disabled":              {channelType: model.ChannelTypeOpen, command: "/summarize channel-policy disable", removed: true},
+		"policy restricts the backend": {channelType: model.ChannelTypeOpen, command: "/summarize channel-policy backend llama", removed: true},
+		"policy enabled":               {channelType: model.ChannelTypeOpen, command: "/summarize channel-policy enable"},
+		"consent revoked":              {channelType: model.ChannelTypeDirect, command: "/summarize consent revoke", removed: true},
+		"consent granted":              {channelType: model.ChannelTypeDirect, command: "/summarize consent grant"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p, api, _ := newTestPlugin(t, &configuration{AllowDirectMessages: true})
+			db := newFakeDB(p, model.DatabaseDriverPostgres)
+			p.vectorIndex = &vectorIndex{plugin: p}
+			mockConversation(api, tc.channelType)
+			api.On("HasPermissionTo", testUserID, model.PermissionManageSystem).Return(true).Maybe()
+
+			_, appErr := p.ExecuteCommand(nil, summarizeArgs(tc.command, ""))
+			require.Nil(t, appErr)
+
+			deletes := db.Statements("DELETE FROM LLMSummarize_Embeddings WHERE ChannelId = $1")
+			if tc.removed {
+				require.Len(t, deletes, 1)
+				assert.Equal(t, []driver.Value{testChannelID}, deletes[0].Args)
+			} else {
+				assert.Empty(t, deletes)
+			}
+		})
+	}
+}
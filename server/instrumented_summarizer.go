@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+)
+
+// instrumentedSummarizer records metrics and logs every call of the wrapped Summarizer. Each call
+// is also checked against and charged to the limits of the requester, see reserveRequest.
+type instrumentedSummarizer struct {
+	Summarizer
+	plugin *Plugin
+}
+
+func (p *Plugin) instrumentSummarizer(summarizer Summarizer) Summarizer {
+	return &instrumentedSummarizer{Summarizer: summarizer, plugin: p}
+}
+
+func (s *instrumentedSummarizer) finish(ctx context.Context, timer *Timer, err error) {
+	duration := timer.Finish()
+	info := s.Summarizer.Info()
+	s.plugin.metrics.ObserveCall(timer.subject, info, duration, err)
+
+	request := requestInfoFromContext(ctx)
+	keyValuePairs := []interface{}{
+		"operation", timer.subject,
+		"backend", info.Backend,
+		"model", info.Model,
+		"duration_ms", duration.Milliseconds(),
+		"user_id", request.UserID,
+		"channel_id", request.ChannelID,
+	}
+	if err != nil {
+		keyValuePairs = append(keyValuePairs, "error_kind", errorKind(err))
+	}
+	s.plugin.API.LogInfo("Summarizer call finished", keyValuePairs...)
+}
+
+func (s *instrumentedSummarizer) SummarizeThread(ctx context.Context, thread, language string) (string, error) {
+	if err := s.plugin.reserveRequest(ctx); err != nil {
+		return "", err
+	}
+
+	timer := NewTimer("summarize_thread")
+	summary, err := s.Summarizer.SummarizeThread(ctx, thread, language)
+	s.finish(ctx, timer, err)
+	return summary, err
+}
+
+func (s *instrumentedSummarizer) SummarizeThreadStructured(ctx context.Context, thread, language string) (*StructuredSummary, error) {
+	if err := s.plugin.reserveRequest(ctx); err != nil {
+		return nil, err
+	}
+
+	timer := NewTimer("summarize_thread_structured")
+	summary, err := s.Summarizer.SummarizeThreadStructured(ctx, thread, language)
+	s.finish(ctx, timer, err)
+	return summary, err
+}
+
+func (s *instrumentedSummarizer) AnswerQuestionOnThread(ctx context.Context, thread, question, language string) (string, error) {
+	if err := s.plugin.reserveRequest(ctx); err != nil {
+		return "", err
+	}
+
+	timer := NewTimer("answer_question")
+	answer, err := s.Summarizer.AnswerQuestionOnThread(ctx, thread, question, language)
+	s.finish(ctx, timer, err)
+	return answer, err
+}
+
+func (s *instrumentedSummarizer) SummarizeSummaries(ctx context.Context, summaries, language string) (string, error) {
+	if err := s.plugin.reserveRequest(ctx); err != nil {
+		return "", err
+	}
+
+	timer := NewTimer("summarize_summaries")
+	digest, err := s.Summarizer.SummarizeSummaries(ctx, summaries, language)
+	s.finish(ctx, timer, err)
+	return digest, err
+}
+
+func (s *instrumentedSummarizer) Translate(ctx context.Context, text, language string) (string, error) {
+	if err := s.plugin.reserveRequest(ctx); err != nil {
+		return "", err
+	}
+
+	timer := NewTimer("translate")
+	translation, err := s.Summarizer.Translate(ctx, text, language)
+	s.finish(ctx, timer, err)
+	return translation, err
+}
+
+func (s *instrumentedSummarizer) TranslateMessages(ctx context.Context, messages []string, language string) ([]string, error) {
+	if err := s.plugin.reserveRequest(ctx); err != nil {
+		return nil, err
+	}
+
+	timer := NewTimer("translate_messages")
+	translations, err := s.Summarizer.TranslateMessages(ctx, messages, language)
+	s.finish(ctx, timer, err)
+	return translations, err
+}
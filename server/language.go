@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+)
+
+// languageNames maps the locales supported by Mattermost to the language name given to the model.
+var languageNames = map[string]string{
+	"bg":    "Bulgarian",
+	"de":    "German",
+	"en":    "English",
+	"en-au": "English",
+	"es":    "Spanish",
+	"fa":    "Persian",
+	"fr":    "French",
+	"hu":    "Hungarian",
+	"it":    "Italian",
+	"ja":    "Japanese",
+	"ko":    "Korean",
+	"nl":    "Dutch",
+	"pl":    "Polish",
+	"pt-br": "Brazilian Portuguese",
+	"ro":    "Romanian",
+	"ru":    "Russian",
+	"sv":    "Swedish",
+	"tr":    "Turkish",
+	"uk":    "Ukrainian",
+	"vi":    "Vietnamese",
+	"zh-cn": "Simplified Chinese",
+	"zh-tw": "Traditional Chinese",
+}
+
+// languageName turns a locale code (es, pt-BR, pt_BR) into a language name. Anything that isn't a
+// known locale is assumed to already be a language name and returned as is.
+func languageName(language string) string {
+	language = strings.TrimSpace(language)
+	if name, ok := languageNames[strings.ReplaceAll(strings.ToLower(language), "_", "-")]; ok {
+		return name
+	}
+
+	return language
+}
+
+// languageInstruction is appended to the system prompts so the response is written in the given
+// language. An empty language leaves the choice to the model.
+func languageInstruction(language string) string {
+	if language == "" {
+		return ""
+	}
+
+	return "\nWrite your response in " + language + ", regardless of the language of the thread.\n"
+}
+
+// resolveLanguage returns the language summaries should be written in for the user: the explicit
+// choice when given, otherwise the locale of their Mattermost account.
+func (p *Plugin) resolveLanguage(userID, explicit string) string {
+	if explicit != "" {
+		return languageName(explicit)
+	}
+
+	user, err := p.pluginAPI.User.Get(userID)
+	if err != nil {
+		p.API.LogWarn("Failed to get user locale", "user_id", userID, "error", err.Error())
+		return ""
+	}
+
+	return languageName(user.Locale)
+}
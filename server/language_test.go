@@ -0,0 +1,15 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLanguageName(t *testing.T) {
+	assert.Equal(t, "Spanish", languageName("es"))
+	assert.Equal(t, "Brazilian Portuguese", languageName("pt-BR"))
+	assert.Equal(t, "Brazilian Portuguese", languageName("pt_BR"))
+	assert.Equal(t, "Klingon", languageName("Klingon"))
+	assert.Equal(t, "", languageName(""))
+}
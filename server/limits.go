@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	pluginapi "github.com/mattermost/mattermost-plugin-api"
+	"github.com/pkg/errors"
+)
+
+const (
+	rateLimitWindow       = time.Hour
+	counterUpdateAttempts = 5
+)
+
+type requestInfoKey struct{}
+
+// RequestInfo identifies who a summarizer call is made on behalf of. It travels in the context
+// so usage reported by the summarizer can be attributed.
+type RequestInfo struct {
+	UserID    string
+	TeamID    string
+	ChannelID string
+}
+
+func withRequestInfo(ctx context.Context, info RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+func requestInfoFromContext(ctx context.Context) RequestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(RequestInfo)
+	return info
+}
+
+// LimitExceededError is returned when a user or team is over a rate limit or token quota.
+type LimitExceededError struct {
+	Limit   string
+	ResetAt time.Time
+}
+
+func (e *LimitExceededError) Error() string {
+	return fmt.Sprintf("You have reached the %s. It resets at %s (in %s).",
+		e.Limit,
+		e.ResetAt.UTC().Format("2006-01-02 15:04 MST"),
+		time.Until(e.ResetAt).Round(time.Minute),
+	)
+}
+
+type quotaPeriod struct {
+	name    string
+	start   func(now time.Time) time.Time
+	resetAt func(now time.Time) time.Time
+	format  string
+}
+
+var (
+	dailyQuota = quotaPeriod{
+		name:    "daily",
+		start:   func(now time.Time) time.Time { return now.Truncate(24 * time.Hour) },
+		resetAt: func(now time.Time) time.Time { return now.Truncate(24 * time.Hour).Add(24 * time.Hour) },
+		format:  "20060102",
+	}
+	monthlyQuota = quotaPeriod{
+		name: "monthly",
+		start: func(now time.Time) time.Time {
+			return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		},
+		resetAt: func(now time.Time) time.Time {
+			return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		},
+		format: "200601",
+	}
+)
+
+func quotaKey(scope, id string, period quotaPeriod, now time.Time) string {
+	return fmt.Sprintf("quota_%s_%s_%s", scope, id, period.start(now).Format(period.format))
+}
+
+func rateLimitKey(scope, id string, now time.Time) string {
+	return fmt.Sprintf("rl_%s_%s_%d", scope, id, now.Truncate(rateLimitWindow).Unix())
+}
+
+// checkLimits verifies the token quotas and the rate limits of the user and team before a request.
+// Counters live in the KV store so limits apply across the cluster. As some requests make several
+// calls to the backend, the limits are checked again before each of them, see reserveRequest.
+func (p *Plugin) checkLimits(userID, teamID string) error {
+	config := p.getConfiguration()
+	now := time.Now().UTC()
+
+	type quotaCheck struct {
+		scope, id, label string
+		period           quotaPeriod
+		quota            int
+	}
+	checks := []quotaCheck{
+		{"u", userID, "your", dailyQuota, config.UserDailyTokenQuota},
+		{"u", userID, "your", monthlyQuota, config.UserMonthlyTokenQuota},
+		{"t", teamID, "your team's", dailyQuota, config.TeamDailyTokenQuota},
+		{"t", teamID, "your team's", monthlyQuota, config.TeamMonthlyTokenQuota},
+	}
+	for _, check := range checks {
+		if check.id == "" || check.quota <= 0 {
+			continue
+		}
+
+		used, err := p.getCounter(quotaKey(check.scope, check.id, check.period, now))
+		if err != nil {
+			return err
+		}
+		if used >= int64(check.quota) {
+			return &LimitExceededError{
+				Limit:   fmt.Sprintf("%s %s token quota", check.label, check.period.name),
+				ResetAt: check.period.resetAt(now),
+			}
+		}
+	}
+
+	rateLimits := []quotaCheck{
+		{scope: "u", id: userID, label: "your", quota: config.UserRequestsPerHour},
+		{scope: "t", id: teamID, label: "your team's", quota: config.TeamRequestsPerHour},
+	}
+	for _, limit := range rateLimits {
+		if limit.id == "" || limit.quota <= 0 {
+			continue
+		}
+
+		count, err := p.getCounter(rateLimitKey(limit.scope, limit.id, now))
+		if err != nil {
+			return err
+		}
+		if count >= int64(limit.quota) {
+			return &LimitExceededError{
+				Limit:   fmt.Sprintf("%s limit of %d requests per hour", limit.label, limit.quota),
+				ResetAt: now.Truncate(rateLimitWindow).Add(rateLimitWindow),
+			}
+		}
+	}
+
+	return nil
+}
+
+// reserveRequest checks the limits of the requester and their team before a call to the backend,
+// and consumes one request from their rate limits when they aren't reached. A translation is
+// charged once per post and a digest once per thread, and stops as soon as a limit is reached.
+func (p *Plugin) reserveRequest(ctx context.Context) error {
+	info := requestInfoFromContext(ctx)
+	if err := p.checkLimits(info.UserID, info.TeamID); err != nil {
+		return err
+	}
+
+	p.chargeRequest(ctx)
+	return nil
+}
+
+// chargeRequest consumes one request from the rate limits of the requester and their team.
+func (p *Plugin) chargeRequest(ctx context.Context) {
+	config := p.getConfiguration()
+	info := requestInfoFromContext(ctx)
+	now := time.Now().UTC()
+
+	for _, limit := range []struct {
+		scope, id string
+		quota     int
+	}{{"u", info.UserID, config.UserRequestsPerHour}, {"t", info.TeamID, config.TeamRequestsPerHour}} {
+		if limit.id == "" || limit.quota <= 0 {
+			continue
+		}
+		key := rateLimitKey(limit.scope, limit.id, now)
+		if _, err := p.incrementCounter(key, 1, rateLimitWindow); err != nil {
+			p.API.LogError("Failed to record request", "key", key, "error", err.Error())
+		}
+	}
+}
+
+// chargeQuotas charges the tokens of a completion to the quotas of the requester and their team.
+func (p *Plugin) chargeQuotas(ctx context.Context, usage TokenUsage) {
+	info := requestInfoFromContext(ctx)
+	now := time.Now().UTC()
+	tokens := int64(usage.PromptTokens + usage.CompletionTokens)
+
+	for _, scope := range []struct{ scope, id string }{{"u", info.UserID}, {"t", info.TeamID}} {
+		if scope.id == "" {
+			continue
+		}
+		for _, period := range []quotaPeriod{dailyQuota, monthlyQuota} {
+			key := quotaKey(scope.scope, scope.id, period, now)
+			ttl := period.resetAt(now).Sub(now)
+			if _, err := p.incrementCounter(key, tokens, ttl); err != nil {
+				p.API.LogError("Failed to record token usage", "key", key, "error", err.Error())
+			}
+		}
+	}
+}
+
+func (p *Plugin) getCounter(key string) (int64, error) {
+	var raw []byte
+	if err := p.pluginAPI.KV.Get(key, &raw); err != nil {
+		return 0, errors.Wrapf(err, "failed to read counter %s", key)
+	}
+	if len(raw) == 0 {
+		return 0, nil
+	}
+
+	return strconv.ParseInt(string(raw), 10, 64)
+}
+
+// incrementCounter atomically adds delta to the counter stored at key, setting it to expire
+// after ttl, and returns the new value.
+func (p *Plugin) incrementCounter(key string, delta int64, ttl time.Duration) (int64, error) {
+	for attempt := 0; attempt < counterUpdateAttempts; attempt++ {
+		var raw []byte
+		if err := p.pluginAPI.KV.Get(key, &raw); err != nil {
+			return 0, errors.Wrapf(err, "failed to read counter %s", key)
+		}
+
+		current := int64(0)
+		if len(raw) > 0 {
+			var err error
+			if current, err = strconv.ParseInt(string(raw), 10, 64); err != nil {
+				return 0, errors.Wrapf(err, "invalid counter %s", key)
+			}
+		}
+
+		next := current + delta
+		var oldValue interface{}
+		if len(raw) > 0 {
+			oldValue = raw
+		}
+		written, err := p.pluginAPI.KV.Set(key, []byte(strconv.FormatInt(next, 10)), pluginapi.SetAtomic(oldValue), pluginapi.SetExpiry(ttl))
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to update counter %s", key)
+		}
+		if written {
+			return next, nil
+		}
+	}
+
+	return 0, errors.Errorf("too much contention updating counter %s", key)
+}
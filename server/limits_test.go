@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotaPeriods(t *testing.T) {
+	now := time.Date(2023, time.January, 31, 23, 59, 0, 0, time.UTC)
+	later := now.Add(2 * time.Minute)
+
+	for name, tc := range map[string]struct {
+		period  quotaPeriod
+		resetAt time.Time
+	}{
+		"daily":   {dailyQuota, time.Date(2023, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		"monthly": {monthlyQuota, time.Date(2023, time.February, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.resetAt, tc.period.resetAt(now))
+			assert.Equal(t, tc.resetAt, tc.period.start(later))
+			assert.NotEqual(t, quotaKey("u", testUserID, tc.period, now), quotaKey("u", testUserID, tc.period, later), "the counter rolls over with the period")
+			assert.Equal(t, quotaKey("u", testUserID, tc.period, later), quotaKey("u", testUserID, tc.period, tc.resetAt))
+		})
+	}
+
+	assert.Equal(t, "quota_u_"+testUserID+"_202301", quotaKey("u", testUserID, monthlyQuota, now))
+	assert.Equal(t, rateLimitKey("u", testUserID, now), rateLimitKey("u", testUserID, now.Add(-30*time.Minute)))
+	assert.NotEqual(t, rateLimitKey("u", testUserID, now), rateLimitKey("u", testUserID, later))
+}
+
+func TestCheckLimits(t *testing.T) {
+	t.Run("no limits configured", func(t *testing.T) {
+		p, _, _ := newTestPlugin(t, nil)
+
+		// Nothing is read or counted when no limit applies.
+		require.NoError(t, p.checkLimits(testUserID, testTeamID))
+		p.chargeRequest(withRequestInfo(context.Background(), RequestInfo{UserID: testUserID, TeamID: testTeamID}))
+	})
+
+	t.Run("rate limits", func(t *testing.T) {
+		p, api, _ := newTestPlugin(t, &configuration{UserRequestsPerHour: 2, TeamRequestsPerHour: 3})
+		store := mockKVStore(api, "rl_")
+		userCtx := withRequestInfo(context.Background(), RequestInfo{UserID: testUserID, TeamID: testTeamID})
+		otherCtx := withRequestInfo(context.Background(), RequestInfo{UserID: testOtherID, TeamID: testTeamID})
+
+		require.NoError(t, p.checkLimits(testUserID, testTeamID))
+		p.chargeRequest(userCtx)
+		require.NoError(t, p.checkLimits(testUserID, testTeamID))
+		p.chargeRequest(userCtx)
+
+		var limitErr *LimitExceededError
+		require.ErrorAs(t, p.checkLimits(testUserID, testTeamID), &limitErr)
+		assert.Equal(t, "your limit of 2 requests per hour", limitErr.Limit)
+		assert.Equal(t, time.Now().UTC().Truncate(time.Hour).Add(time.Hour), limitErr.ResetAt)
+
+		require.NoError(t, p.checkLimits(testOtherID, testTeamID))
+		p.chargeRequest(otherCtx)
+		require.ErrorAs(t, p.checkLimits(testOtherID, testTeamID), &limitErr)
+		assert.Equal(t, "your team's limit of 3 requests per hour", limitErr.Limit)
+
+		// The counters of the previous window don't count.
+		now := time.Now().UTC()
+		for _, scope := range []struct{ scope, id string }{{"u", testUserID}, {"t", testTeamID}} {
+			key := rateLimitKey(scope.scope, scope.id, now)
+			store[rateLimitKey(scope.scope, scope.id, now.Add(-rateLimitWindow))] = store[key]
+			delete(store, key)
+		}
+		require.NoError(t, p.checkLimits(testUserID, testTeamID))
+	})
+
+	t.Run("token quotas", func(t *testing.T) {
+		p, api, _ := newTestPlugin(t, &configuration{UserDailyTokenQuota: 100, TeamMonthlyTokenQuota: 150})
+		store := mockKVStore(api, "quota_")
+		now := time.Now().UTC()
+
+		// Usage from the previous periods is not counted.
+		store[quotaKey("u", testUserID, dailyQuota, now.Add(-24*time.Hour))] = []byte("1000")
+		store[quotaKey("t", testTeamID, monthlyQuota, monthlyQuota.start(now).Add(-time.Hour))] = []byte("1000")
+		require.NoError(t, p.checkLimits(testUserID, testTeamID))
+
+		p.chargeQuotas(withRequestInfo(context.Background(), RequestInfo{UserID: testUserID, TeamID: testTeamID}), TokenUsage{PromptTokens: 80, CompletionTokens: 20})
+		assert.Equal(t, "100", string(store[quotaKey("u", testUserID, dailyQuota, now)]))
+		assert.Equal(t, "100", string(store[quotaKey("u", testUserID, monthlyQuota, now)]))
+		assert.Equal(t, "100", string(store[quotaKey("t", testTeamID, dailyQuota, now)]))
+
+		var limitErr *LimitExceededError
+		require.ErrorAs(t, p.checkLimits(testUserID, testTeamID), &limitErr)
+		assert.Equal(t, "your daily token quota", limitErr.Limit)
+		assert.Equal(t, dailyQuota.resetAt(now), limitErr.ResetAt)
+
+		require.NoError(t, p.checkLimits(testOtherID, testTeamID))
+		p.chargeQuotas(withRequestInfo(context.Background(), RequestInfo{UserID: testOtherID, TeamID: testTeamID}), TokenUsage{PromptTokens: 50})
+		require.ErrorAs(t, p.checkLimits(testOtherID, testTeamID), &limitErr)
+		assert.Equal(t, "your team's monthly token quota", limitErr.Limit)
+		assert.Equal(t, monthlyQuota.resetAt(now), limitErr.ResetAt)
+	})
+
+	t.Run("every backend call is checked and charged", func(t *testing.T) {
+		p, api, fake := newTestPlugin(t, &configuration{UserRequestsPerHour: 3})
+		store := mockKVStore(api, "rl_")
+		api.On("LogInfo", "Summarizer call finished", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+			mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		summarizer := p.instrumentSummarizer(fake)
+		ctx := withRequestInfo(context.Background(), RequestInfo{UserID: testUserID, TeamID: testTeamID})
+
+		// A translation is sent to the backend once per post, until the limit is reached.
+		require.NoError(t, p.checkLimits(testUserID, testTeamID))
+		for _, text := range []string{"hola", "adiós", "gracias"} {
+			_, err := summarizer.Translate(ctx, text, "English")
+			require.NoError(t, err)
+		}
+		_, err := summarizer.Translate(ctx, "de nada", "English")
+		var limitErr *LimitExceededError
+		require.ErrorAs(t, err, &limitErr)
+		assert.Len(t, fake.Calls(), 3, "the backend isn't called past the limit")
+		assert.Equal(t, "3", string(store[rateLimitKey("u", testUserID, time.Now().UTC())]))
+
+		status, message := p.handleLLMError(err)
+		assert.Equal(t, http.StatusTooManyRequests, status)
+		assert.Equal(t, limitErr.Error(), message)
+	})
+
+	t.Run("token quotas stop later calls of a request", func(t *testing.T) {
+		p, api, fake := newTestPlugin(t, &configuration{UserDailyTokenQuota: 100})
+		store := mockKVStore(api, "quota_")
+		api.On("LogInfo", "Summarizer call finished", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+			mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		summarizer := p.instrumentSummarizer(fake)
+		ctx := withRequestInfo(context.Background(), RequestInfo{UserID: testUserID, TeamID: testTeamID})
+
+		_, err := summarizer.SummarizeThread(ctx, "thread", "")
+		require.NoError(t, err)
+		store[quotaKey("u", testUserID, dailyQuota, time.Now().UTC())] = []byte("100")
+		_, err = summarizer.SummarizeSummaries(ctx, "summaries", "")
+		var limitErr *LimitExceededError
+		require.ErrorAs(t, err, &limitErr)
+		assert.Equal(t, "your daily token quota", limitErr.Limit)
+		assert.Equal(t, []string{"SummarizeThread"}, fake.Calls())
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pkg/errors"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+type LLMErrorKind string
+
+const (
+	LLMErrorAuth                LLMErrorKind = "auth"
+	LLMErrorQuotaExceeded       LLMErrorKind = "quota_exceeded"
+	LLMErrorContextTooLong      LLMErrorKind = "context_too_long"
+	LLMErrorContentFiltered     LLMErrorKind = "content_filtered"
+	LLMErrorTimeout             LLMErrorKind = "timeout"
+	LLMErrorUpstreamUnavailable LLMErrorKind = "upstream_unavailable"
+)
+
+// LLMError is returned by summarizers for every failure talking to the LLM backend, so callers
+// can show the user something actionable instead of a generic error.
+type LLMError struct {
+	Kind LLMErrorKind
+	Err  error
+}
+
+func (e *LLMError) Error() string {
+	return string(e.Kind) + ": " + e.Err.Error()
+}
+
+func (e *LLMError) Unwrap() error {
+	return e.Err
+}
+
+// UserMessage is safe to show to end users, it never includes upstream details.
+func (e *LLMError) UserMessage() string {
+	switch e.Kind {
+	case LLMErrorAuth:
+		return "The AI backend rejected the plugin credentials. Please ask a system admin to check the API key in the plugin settings."
+	case LLMErrorQuotaExceeded:
+		return "The AI backend is rate limiting requests or its quota has been used up. Please try again later."
+	case LLMErrorContextTooLong:
+		return "There is too much content to summarize at once. Try narrowing it down with --since, --until or --from."
+	case LLMErrorContentFiltered:
+		return "The AI backend refused to process this content because of its content policy."
+	case LLMErrorTimeout:
+		return "The AI backend took too long to respond. Please try again."
+	default:
+		return "The AI backend is currently unavailable. Please try again in a few minutes."
+	}
+}
+
+func (e *LLMError) StatusCode() int {
+	switch e.Kind {
+	case LLMErrorAuth:
+		return http.StatusBadGateway
+	case LLMErrorQuotaExceeded:
+		return http.StatusTooManyRequests
+	case LLMErrorContextTooLong:
+		return http.StatusRequestEntityTooLarge
+	case LLMErrorContentFiltered:
+		return http.StatusUnprocessableEntity
+	case LLMErrorTimeout:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusServiceUnavailable
+	}
+}
+
+// classifyOpenAIError maps errors returned by the OpenAI client to an LLMError.
+func classifyOpenAIError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var llmErr *LLMError
+	if errors.As(err, &llmErr) {
+		return err
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &LLMError{Kind: LLMErrorTimeout, Err: err}
+	}
+
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		code, _ := apiErr.Code.(string)
+		switch {
+		case code == "context_length_exceeded":
+			return &LLMError{Kind: LLMErrorContextTooLong, Err: err}
+		case code == "content_filter" || code == "content_policy_violation":
+			return &LLMError{Kind: LLMErrorContentFiltered, Err: err}
+		case apiErr.HTTPStatusCode == http.StatusUnauthorized || apiErr.HTTPStatusCode == http.StatusForbidden:
+			return &LLMError{Kind: LLMErrorAuth, Err: err}
+		case apiErr.HTTPStatusCode == http.StatusTooManyRequests:
+			return &LLMError{Kind: LLMErrorQuotaExceeded, Err: err}
+		}
+		return &LLMError{Kind: LLMErrorUpstreamUnavailable, Err: err}
+	}
+
+	var requestErr *openai.RequestError
+	if errors.As(err, &requestErr) {
+		switch requestErr.HTTPStatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return &LLMError{Kind: LLMErrorAuth, Err: err}
+		case http.StatusTooManyRequests:
+			return &LLMError{Kind: LLMErrorQuotaExceeded, Err: err}
+		}
+	}
+
+	return &LLMError{Kind: LLMErrorUpstreamUnavailable, Err: err}
+}
+
+// firstChoice returns the content of the first choice of a completion, treating a missing or
+// filtered choice as an error.
+func firstChoice(resp openai.ChatCompletionResponse) (string, error) {
+	if len(resp.Choices) == 0 {
+		return "", &LLMError{Kind: LLMErrorUpstreamUnavailable, Err: errors.New("completion returned no choices")}
+	}
+
+	choice := resp.Choices[0]
+	if choice.FinishReason == "content_filter" {
+		return "", &LLMError{Kind: LLMErrorContentFiltered, Err: errors.New("completion was stopped by the content filter")}
+	}
+
+	return choice.Message.Content, nil
+}
+
+// handleLLMError logs err with all the available detail and returns the status code and message
+// to give back to the user.
+func (p *Plugin) handleLLMError(err error, keyValuePairs ...interface{}) (int, string) {
+	var limitErr *LimitExceededError
+	if errors.As(err, &limitErr) {
+		return http.StatusTooManyRequests, limitErr.Error()
+	}
+
+	var llmErr *LLMError
+	if !errors.As(err, &llmErr) {
+		p.API.LogError("Summarization failed", append(keyValuePairs, "error", err.Error())...)
+		return http.StatusInternalServerError, "Something went wrong while summarizing. Please try again."
+	}
+
+	p.API.LogError("LLM request failed", append(keyValuePairs, "kind", string(llmErr.Kind), "error", llmErr.Err.Error())...)
+	return llmErr.StatusCode(), llmErr.UserMessage()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestOpenAISummarizer(t *testing.T, handler http.HandlerFunc) *OpenAISummarizer {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	config := openai.DefaultConfig("test-key")
+	config.BaseURL = server.URL + "/v1"
+
+	return &OpenAISummarizer{
+		openaiClient: openai.NewClientWithConfig(config),
+		model:        openai.GPT3Dot5Turbo,
+		timeout:      time.Second,
+	}
+}
+
+func TestOpenAISummarizerErrors(t *testing.T) {
+	for name, tc := range map[string]struct {
+		status int
+		body   string
+		kind   LLMErrorKind
+	}{
+		"auth":             {http.StatusUnauthorized, `{"error": {"message": "Incorrect API key", "type": "invalid_request_error", "code": "invalid_api_key"}}`, LLMErrorAuth},
+		"quota":            {http.StatusTooManyRequests, `{"error": {"message": "You exceeded your current quota", "type": "insufficient_quota", "code": "insufficient_quota"}}`, LLMErrorQuotaExceeded},
+		"context too long": {http.StatusBadRequest, `{"error": {"message": "maximum context length", "type": "invalid_request_error", "code": "context_length_exceeded"}}`, LLMErrorContextTooLong},
+		"unavailable":      {http.StatusServiceUnavailable, `{"error": {"message": "overloaded", "type": "server_error"}}`, LLMErrorUpstreamUnavailable},
+		"no choices":       {http.StatusOK, `{"choices": []}`, LLMErrorUpstreamUnavailable},
+		"content filter":   {http.StatusOK, `{"choices": [{"message": {"role": "assistant", "content": ""}, "finish_reason": "content_filter"}]}`, LLMErrorContentFiltered},
+	} {
+		t.Run(name, func(t *testing.T) {
+			summarizer := newTestOpenAISummarizer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tc.status)
+				_, _ = w.Write([]byte(tc.body))
+			})
+
+			_, err := summarizer.SummarizeThread(context.Background(), "alice: hi", "")
+			var llmErr *LLMError
+			require.True(t, errors.As(err, &llmErr), "unexpected error %v", err)
+			assert.Equal(t, tc.kind, llmErr.Kind)
+			assert.NotEmpty(t, llmErr.UserMessage())
+		})
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		summarizer := newTestOpenAISummarizer(t, func(w http.ResponseWriter, r *http.Request) {
+			// The request context is only cancelled on disconnect once the body has been read.
+			_, _ = io.Copy(io.Discard, r.Body)
+			<-r.Context().Done()
+		})
+		summarizer.timeout = 10 * time.Millisecond
+
+		_, err := summarizer.SummarizeThread(context.Background(), "alice: hi", "")
+		var llmErr *LLMError
+		require.True(t, errors.As(err, &llmErr), "unexpected error %v", err)
+		assert.Equal(t, LLMErrorTimeout, llmErr.Kind)
+		assert.Equal(t, http.StatusGatewayTimeout, llmErr.StatusCode())
+	})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const metricsNamespace = "llm_summarize"
+
+var (
+	durationBuckets = []float64{0.25, 0.5, 1, 2, 5, 10, 20, 30, 60, 120}
+	tokenBuckets    = []float64{100, 250, 500, 1000, 2000, 4000, 8000, 16000, 32000}
+)
+
+// series is a single combination of label values of a metric.
+type series struct {
+	labelValues []string
+	value       float64
+
+	// Only set for histograms, bucketCounts are not cumulative.
+	bucketCounts []uint64
+	count        uint64
+}
+
+type metricVec struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+}
+
+func (v *metricVec) get(labelValues []string) *series {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labelValues: labelValues}
+		if v.buckets != nil {
+			s.bucketCounts = make([]uint64, len(v.buckets))
+		}
+		v.series[key] = s
+	}
+
+	return s
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+len(extra)/2)
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelValueEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelValueEscaper.Replace(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (v *metricVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := v.series[key]
+		if v.buckets == nil {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, s.labelValues), formatValue(s.value))
+			continue
+		}
+
+		cumulative := uint64(0)
+		for i, bucket := range v.buckets {
+			cumulative += s.bucketCounts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, s.labelValues, "le", formatValue(bucket)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, formatLabels(v.labels, s.labelValues), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, formatLabels(v.labels, s.labelValues), s.count)
+	}
+}
+
+// Metrics records the activity of the LLM backends of this plugin instance and exposes it in the
+// Prometheus text format. Every node of a cluster keeps its own metrics. A nil *Metrics records
+// nothing.
+type Metrics struct {
+	mu sync.Mutex
+
+	requests  *metricVec
+	errors    *metricVec
+	duration  *metricVec
+	tokens    *metricVec
+	usageSize *metricVec
+}
+
+func newMetrics() *Metrics {
+	newVec := func(name, help, kind string, buckets []float64, labels ...string) *metricVec {
+		return &metricVec{
+			name:    metricsNamespace + "_" + name,
+			help:    help,
+			kind:    kind,
+			labels:  labels,
+			buckets: buckets,
+			series:  map[string]*series{},
+		}
+	}
+
+	return &Metrics{
+		requests:  newVec("requests_total", "Summarizer calls by operation and outcome.", "counter", nil, "operation", "backend", "model", "status"),
+		errors:    newVec("errors_total", "Failed summarizer calls by kind of error.", "counter", nil, "operation", "backend", "kind"),
+		duration:  newVec("request_duration_seconds", "Duration of summarizer calls, retries included.", "histogram", durationBuckets, "operation", "backend"),
+		tokens:    newVec("tokens_total", "Tokens consumed by completions and embeddings.", "counter", nil, "model", "type"),
+		usageSize: newVec("request_tokens", "Tokens consumed by a single completion or embeddings request.", "histogram", tokenBuckets, "model"),
+	}
+}
+
+func observe(s *series, buckets []float64, value float64) {
+	for i, bucket := range buckets {
+		if value <= bucket {
+			s.bucketCounts[i]++
+			break
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+// errorKind labels an error with its LLMError kind, or "internal" for other failures.
+func errorKind(err error) string {
+	var llmErr *LLMError
+	if errors.As(err, &llmErr) {
+		return string(llmErr.Kind)
+	}
+
+	return "internal"
+}
+
+// ObserveCall records the outcome and duration of a summarizer call.
+func (m *Metrics) ObserveCall(operation string, info SummarizerInfo, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := "success"
+	if err != nil {
+		status = "error"
+		m.errors.get([]string{operation, info.Backend, errorKind(err)}).value++
+	}
+	m.requests.get([]string{operation, info.Backend, info.Model, status}).value++
+	observe(m.duration.get([]string{operation, info.Backend}), m.duration.buckets, duration.Seconds())
+}
+
+// ObserveUsage records the tokens consumed by a request.
+func (m *Metrics) ObserveUsage(usage TokenUsage) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tokens.get([]string{usage.Model, "prompt"}).value += float64(usage.PromptTokens)
+	m.tokens.get([]string{usage.Model, "completion"}).value += float64(usage.CompletionTokens)
+	observe(m.usageSize.get([]string{usage.Model}), m.usageSize.buckets, float64(usage.PromptTokens+usage.CompletionTokens))
+}
+
+// Write writes every metric in the Prometheus text exposition format.
+func (m *Metrics) Write(w io.Writer) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, vec := range []*metricVec{m.requests, m.errors, m.duration, m.tokens, m.usageSize} {
+		vec.write(w)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics := newMetrics()
+	info := SummarizerInfo{Backend: "openai", Model: "gpt-3.5-turbo"}
+
+	metrics.ObserveCall("summarize_thread", info, 300*time.Millisecond, nil)
+	metrics.ObserveCall("summarize_thread", info, 3*time.Second, nil)
+	metrics.ObserveCall("summarize_thread", info, time.Second, &LLMError{Kind: LLMErrorTimeout, Err: errors.New("deadline")})
+	metrics.ObserveCall("translate", info, time.Second, errors.New("boom"))
+	metrics.ObserveUsage(TokenUsage{Model: "gpt-3.5-turbo", PromptTokens: 900, CompletionTokens: 50})
+
+	var sb strings.Builder
+	metrics.Write(&sb)
+	output := sb.String()
+
+	for _, line := range []string{
+		"# TYPE llm_summarize_requests_total counter",
+		`llm_summarize_requests_total{operation="summarize_thread",backend="openai",model="gpt-3.5-turbo",status="success"} 2`,
+		`llm_summarize_requests_total{operation="summarize_thread",backend="openai",model="gpt-3.5-turbo",status="error"} 1`,
+		`llm_summarize_errors_total{operation="summarize_thread",backend="openai",kind="timeout"} 1`,
+		`llm_summarize_errors_total{operation="translate",backend="openai",kind="internal"} 1`,
+		"# TYPE llm_summarize_request_duration_seconds histogram",
+		`llm_summarize_request_duration_seconds_bucket{operation="summarize_thread",backend="openai",le="0.25"} 0`,
+		`llm_summarize_request_duration_seconds_bucket{operation="summarize_thread",backend="openai",le="0.5"} 1`,
+		`llm_summarize_request_duration_seconds_bucket{operation="summarize_thread",backend="openai",le="1"} 2`,
+		`llm_summarize_request_duration_seconds_bucket{operation="summarize_thread",backend="openai",le="5"} 3`,
+		`llm_summarize_request_duration_seconds_bucket{operation="summarize_thread",backend="openai",le="+Inf"} 3`,
+		`llm_summarize_request_duration_seconds_sum{operation="summarize_thread",backend="openai"} 4.3`,
+		`llm_summarize_request_duration_seconds_count{operation="summarize_thread",backend="openai"} 3`,
+		`llm_summarize_tokens_total{model="gpt-3.5-turbo",type="prompt"} 900`,
+		`llm_summarize_tokens_total{model="gpt-3.5-turbo",type="completion"} 50`,
+		`llm_summarize_request_tokens_bucket{model="gpt-3.5-turbo",le="1000"} 1`,
+	} {
+		assert.Contains(t, output, line+"\n")
+	}
+
+	assert.Equal(t, `{name="a \"quoted\\ value\"\n"}`, formatLabels([]string{"name"}, []string{"a \"quoted\\ value\"\n"}))
+
+	// A nil Metrics is a no-op, as in tests that don't activate the plugin.
+	var disabled *Metrics
+	disabled.ObserveCall("translate", info, time.Second, nil)
+	disabled.Write(&sb)
+}
+
+func TestInstrumentedSummarizer(t *testing.T) {
+	p, api, fake := newTestPlugin(t, nil)
+	p.metrics = newMetrics()
+	summarizer := p.instrumentSummarizer(fake)
+
+	ctx := withRequestInfo(context.Background(), RequestInfo{UserID: testUserID, ChannelID: testChannelID})
+	api.On("LogInfo", "Summarizer call finished",
+		"operation", "summarize_thread", "backend", "fake", "model", "fake-model", "duration_ms", mock.AnythingOfType("int64"),
+		"user_id", testUserID, "channel_id", testChannelID).Once()
+	_, err := summarizer.SummarizeThread(ctx, "[1] alice: hi\n\n", "")
+	require.NoError(t, err)
+
+	fake.err = &LLMError{Kind: LLMErrorAuth, Err: errors.New("invalid api key")}
+	api.On("LogInfo", "Summarizer call finished",
+		"operation", "translate", "backend", "fake", "model", "fake-model", "duration_ms", mock.AnythingOfType("int64"),
+		"user_id", testUserID, "channel_id", testChannelID, "error_kind", "auth").Once()
+	_, err = summarizer.Translate(ctx, "hola", "English")
+	assert.Equal(t, fake.err, err)
+
+	assert.Equal(t, SummarizerInfo{Backend: "fake", Model: "fake-model"}, summarizer.Info())
+	assert.Equal(t, []string{"SummarizeThread", "Translate"}, fake.Calls())
+
+	var sb strings.Builder
+	p.metrics.Write(&sb)
+	assert.Contains(t, sb.String(), `llm_summarize_requests_total{operation="summarize_thread",backend="fake",model="fake-model",status="success"} 1`)
+	assert.Contains(t, sb.String(), `llm_summarize_errors_total{operation="translate",backend="fake",kind="auth"} 1`)
+}
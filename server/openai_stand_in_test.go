@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/require"
+)
+
+// openAIFixture is a recorded response of the OpenAI API, stored in testdata/openai.
+type openAIFixture struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body"`
+}
+
+// openAIStandIn is a local replacement for the OpenAI API. It replays fixtures in order, one per
+// request, and records the chat completion requests it received.
+type openAIStandIn struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	fixtures []openAIFixture
+	requests []openai.ChatCompletionRequest
+}
+
+func newOpenAIStandIn(t *testing.T, fixtureNames ...string) *openAIStandIn {
+	standIn := &openAIStandIn{}
+	for _, name := range fixtureNames {
+		content, err := os.ReadFile(filepath.Join("testdata", "openai", name+".json"))
+		require.NoError(t, err)
+
+		var fixture openAIFixture
+		require.NoError(t, json.Unmarshal(content, &fixture))
+		standIn.fixtures = append(standIn.fixtures, fixture)
+	}
+
+	standIn.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request openai.ChatCompletionRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		standIn.mu.Lock()
+		defer standIn.mu.Unlock()
+		if len(standIn.requests) >= len(standIn.fixtures) {
+			t.Errorf("unexpected request %d to %s, only %d fixtures", len(standIn.requests)+1, r.URL.Path, len(standIn.fixtures))
+			http.Error(w, "no fixture left", http.StatusInternalServerError)
+			return
+		}
+		fixture := standIn.fixtures[len(standIn.requests)]
+		standIn.requests = append(standIn.requests, request)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(fixture.Status)
+		_, _ = w.Write(fixture.Body)
+	}))
+	t.Cleanup(standIn.Close)
+
+	return standIn
+}
+
+// APIURL is the base URL to configure the OpenAI client with.
+func (s *openAIStandIn) APIURL() string {
+	return s.URL + "/v1"
+}
+
+func (s *openAIStandIn) Requests() []openai.ChatCompletionRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]openai.ChatCompletionRequest{}, s.requests...)
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	sq "github.com/Masterminds/squirrel"
-	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
 	pluginapi "github.com/mattermost/mattermost-plugin-api"
+	"github.com/mattermost/mattermost-plugin-api/cluster"
 	"github.com/mattermost/mattermost-server/v6/model"
 	"github.com/mattermost/mattermost-server/v6/plugin"
 	"github.com/pkg/errors"
@@ -32,12 +36,38 @@ type Plugin struct {
 	db      *sqlx.DB
 	builder sq.StatementBuilderType
 
-	summarizer Summarizer
+	// backendLock guards summarizer, embedder, indexer and indexerJob, which are rebuilt when
+	// the configuration changes.
+	backendLock sync.RWMutex
+	summarizer  Summarizer
+
+	metrics *Metrics
+
+	// healthLock guards configurationCheckTimer.
+	healthLock              sync.Mutex
+	configurationCheckTimer *time.Timer
+
+	embedder    Embedder
+	vectorIndex *vectorIndex
+	indexer     *postIndexer
+	indexerJob  *cluster.Job
+
+	reminderScheduler *cluster.JobOnceScheduler
+	auditRetentionJob *cluster.Job
+
+	// conversationMembersCache maps the ID of a DM or GM to its human participants.
+	conversationMembersCache sync.Map
 }
 
 type Summarizer interface {
-	SummarizeThread(thread string) (string, error)
-	AnswerQuestionOnThread(thread, question string) (string, error)
+	Info() SummarizerInfo
+	SummarizeThread(ctx context.Context, thread, language string) (string, error)
+	SummarizeThreadStructured(ctx context.Context, thread, language string) (*StructuredSummary, error)
+	AnswerQuestionOnThread(ctx context.Context, thread, question, language string) (string, error)
+	SummarizeSummaries(ctx context.Context, summaries, language string) (string, error)
+	Translate(ctx context.Context, text, language string) (string, error)
+	TranslateMessages(ctx context.Context, messages []string, language string) ([]string, error)
+	CheckHealth(ctx context.Context) *HealthStatus
 }
 
 func (p *Plugin) OnActivate() error {
@@ -57,20 +87,120 @@ func (p *Plugin) OnActivate() error {
 	if err != nil {
 		return err
 	}
-	p.db = sqlx.NewDb(origDB, p.pluginAPI.Store.DriverName())
+	p.setDB(origDB, p.pluginAPI.Store.DriverName())
+
+	if err = p.migrate(); err != nil {
+		return err
+	}
+
+	p.registerCommands()
+
+	p.moveAPIKeyToCredentials()
+
+	config := p.getConfiguration()
+	p.metrics = newMetrics()
+	p.vectorIndex = p.newVectorIndex()
+	if err := p.configureBackends(config); err != nil {
+		return err
+	}
+
+	p.scheduleConfigurationCheck()
+
+	if err := p.startReminderScheduler(); err != nil {
+		return err
+	}
+
+	if err := p.startAuditRetentionJob(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// moveAPIKeyToCredentials migrates a key set in the plugin configuration. A failure leaves the key
+// in the configuration, where it is still used, so it is only logged.
+func (p *Plugin) moveAPIKeyToCredentials() {
+	if err := p.migrateAPIKey(); err != nil {
+		p.API.LogError("Failed to move the OpenAI API key to the encrypted credentials", "error", err.Error())
+	}
+}
+
+// setDB sets up the database handle and the query builder for the driver of the server.
+func (p *Plugin) setDB(db *sql.DB, driverName string) {
+	p.db = sqlx.NewDb(db, driverName)
 
 	builder := sq.StatementBuilder.PlaceholderFormat(sq.Question)
-	if p.pluginAPI.Store.DriverName() == model.DatabaseDriverPostgres {
+	if driverName == model.DatabaseDriverPostgres {
 		builder = builder.PlaceholderFormat(sq.Dollar)
 	}
 
-	if p.pluginAPI.Store.DriverName() == model.DatabaseDriverMysql {
+	if driverName == model.DatabaseDriverMysql {
 		p.db.MapperFunc(func(s string) string { return s })
 	}
+	p.builder = builder
+}
 
-	p.registerCommands()
+func (p *Plugin) getSummarizer() Summarizer {
+	p.backendLock.RLock()
+	defer p.backendLock.RUnlock()
+	return p.summarizer
+}
+
+func (p *Plugin) getEmbedder() Embedder {
+	p.backendLock.RLock()
+	defer p.backendLock.RUnlock()
+	return p.embedder
+}
+
+func (p *Plugin) getIndexer() *postIndexer {
+	p.backendLock.RLock()
+	defer p.backendLock.RUnlock()
+	return p.indexer
+}
 
-	p.summarizer = NewOpenAISummarizer(p.getConfiguration().OpenAIAPIKey)
+// configureBackends builds the summarizer and, with semantic search, the embedder from the
+// configuration, then starts or stops the indexer to match. Calls in flight finish with the
+// previous backends. An embedder that can't be built only disables semantic search.
+func (p *Plugin) configureBackends(config *configuration) error {
+	summarizer := p.instrumentSummarizer(NewOpenAISummarizer(p.apiKeyResolver(CredentialBackendOpenAI), config.OpenAIAPIURL, config.requestTimeout(), config.LLMMaxRetries, p.recordUsage))
+
+	var embedder Embedder
+	if config.EnableSemanticSearch {
+		openAIEmbedder, err := NewOpenAIEmbedder(p.apiKeyResolver(CredentialBackendEmbeddings), config.EmbeddingAPIURL, config.EmbeddingModel, config.EmbeddingDimensions, config.requestTimeout(), config.LLMMaxRetries, p.recordUsage)
+		if err != nil {
+			p.API.LogError("Failed to set up the embeddings backend, semantic search is disabled", "error", err.Error())
+		} else {
+			embedder = openAIEmbedder
+		}
+	}
+	if embedder != nil && p.vectorIndex != nil {
+		p.vectorIndex.setDimensions(embedder.Dimensions())
+	}
+
+	p.backendLock.Lock()
+	p.summarizer = summarizer
+	p.embedder = embedder
+	p.backendLock.Unlock()
+
+	switch {
+	case p.semanticSearchEnabled() && p.getIndexer() == nil:
+		return p.startIndexer()
+	case !p.semanticSearchEnabled() && p.getIndexer() != nil:
+		p.stopIndexer()
+	}
+
+	return nil
+}
+
+func (p *Plugin) OnDeactivate() error {
+	p.stopConfigurationCheck()
+	p.stopIndexer()
+
+	if p.auditRetentionJob != nil {
+		if err := p.auditRetentionJob.Close(); err != nil {
+			p.API.LogError("Failed to close audit retention job", "error", err.Error())
+		}
+	}
 
 	return nil
 }
@@ -82,20 +212,41 @@ func (p *Plugin) registerCommands() {
 		Description:      "Summarize current context",
 		AutoComplete:     true,
 		AutoCompleteDesc: "Summarize current context",
+		AutoCompleteHint: "[--since 24h] [--until 2h] [--from @user] [--only-threads-with-replies] [--structured] [--digest] [--lang es] [question]",
 	})
 }
 
-// ServeHTTP demonstrates a plugin that handles HTTP requests by greeting the world.
-func (p *Plugin) ServeHTTP(c *plugin.Context, w http.ResponseWriter, r *http.Request) {
-	router := gin.Default()
-	router.GET("/summarize", p.handleSummarize)
-	router.ServeHTTP(w, r)
+func (p *Plugin) checkUsageRestrictions(userID, teamID string, channel *model.Channel) error {
+	if !strings.Contains(p.getConfiguration().AllowedUserIDs, userID) {
+		return errors.New("User not authorized")
+	}
+
+	if !strings.Contains(p.getConfiguration().AllowedTeamIDs, teamID) {
+		return errors.New("Can't work on this team.")
+	}
+
+	return p.checkChannelType(channel)
 }
 
-func (p *Plugin) handleSummarize(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{
-		"result": "this is the summary",
-	})
+// checkChannelType returns an error when the plugin isn't allowed to work on the type of channel.
+func (p *Plugin) checkChannelType(channel *model.Channel) error {
+	config := p.getConfiguration()
+	switch channel.Type {
+	case model.ChannelTypePrivate:
+		if !config.AllowPrivateChannels {
+			return errors.New("Can't work on private channels.")
+		}
+	case model.ChannelTypeDirect:
+		if !config.AllowDirectMessages {
+			return errors.New("Can't work on direct messages.")
+		}
+	case model.ChannelTypeGroup:
+		if !config.AllowGroupMessages {
+			return errors.New("Can't work on group messages.")
+		}
+	}
+
+	return nil
 }
 
 func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
@@ -103,106 +254,262 @@ func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*mo
 		return nil, model.NewAppError("Summarize.ExecuteCommand", "app.command.execute.error", nil, "", http.StatusInternalServerError)
 	}
 
-	if !strings.Contains(p.getConfiguration().AllowedUserIDs, args.UserId) {
-		return nil, model.NewAppError("Summarize.ExecuteCommand", "User not authorized", nil, "", http.StatusUnauthorized)
+	channel, err := p.pluginAPI.Channel.Get(args.ChannelId)
+	if err != nil {
+		return nil, model.NewAppError("Summarize.ExecuteCommand", "app.command.execute.error", nil, err.Error(), http.StatusInternalServerError)
 	}
 
-	if !strings.Contains(p.getConfiguration().AllowedTeamIDs, args.TeamId) {
-		return nil, model.NewAppError("Summarize.ExecuteCommand", "Can't work on this team.", nil, "", http.StatusUnauthorized)
+	if err = p.checkUsageRestrictions(args.UserId, args.TeamId, channel); err != nil {
+		return nil, model.NewAppError("Summarize.ExecuteCommand", err.Error(), nil, "", http.StatusUnauthorized)
 	}
 
-	if !p.getConfiguration().AllowPrivateChannels {
-		channel, err := p.pluginAPI.Channel.Get(args.ChannelId)
-		if err != nil {
-			return nil, model.NewAppError("Summarize.ExecuteCommand", "app.command.execute.error", nil, err.Error(), http.StatusInternalServerError)
-		}
+	split := strings.Fields(args.Command)
+	if len(split) == 0 || split[0] != "/summarize" {
+		return &model.CommandResponse{}, nil
+	}
 
-		if channel.Type != model.ChannelTypeOpen {
-			return nil, model.NewAppError("Summarize.ExecuteCommand", "Can't work on private channels.", nil, "", http.StatusUnauthorized)
+	if len(split) > 1 {
+		subcommands := map[string]func(*model.CommandArgs, []string) (*model.CommandResponse, error){
+			"usage":          p.executeUsageCommand,
+			"channel-policy": p.executeChannelPolicyCommand,
+			"consent":        p.executeConsentCommand,
+			"translate":      p.executeTranslateCommand,
+			"ask-all":        p.executeAskAllCommand,
+			"diagnose":       p.executeDiagnoseCommand,
+		}
+		if subcommand, ok := subcommands[split[1]]; ok {
+			response, subcommandErr := subcommand(args, split[2:])
+			if subcommandErr != nil {
+				return nil, model.NewAppError("Summarize.ExecuteCommand", "app.command.execute.error", nil, subcommandErr.Error(), http.StatusInternalServerError)
+			}
+			return response, nil
 		}
 	}
 
-	split := strings.SplitN(strings.TrimSpace(args.Command), " ", 2)
-	command := split[0]
-	/*parameters := []string{}
-	cmd := ""
-	if len(split) > 1 {
-		cmd = split[1]
+	if _, err = p.checkChannelPolicy(channel); err != nil {
+		return ephemeralResponse(args, err.Error()), nil
 	}
-	if len(split) > 2 {
-		parameters = split[2:]
-	}*/
 
-	if command != "/summarize" {
-		return &model.CommandResponse{}, nil
+	structured, flags := extractFlag(split[1:], "--structured")
+	digest, flags := extractFlag(flags, "--digest")
+	language, flags, err := extractOption(flags, "--lang")
+	var filters *SummaryFilters
+	var rest []string
+	if err == nil {
+		filters, rest, err = parseSummaryFilters(flags, time.Now())
+	}
+	if err == nil {
+		err = p.resolveSummaryFilters(filters)
 	}
+	if err == nil && digest {
+		err = checkDigestRequest(args, structured, len(rest) > 0, filters)
+	}
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         err.Error(),
+			ChannelId:    args.ChannelId,
+		}, nil
+	}
+
+	if err = p.checkLimits(args.UserId, args.TeamId); err != nil {
+		var limitErr *LimitExceededError
+		if !errors.As(err, &limitErr) {
+			return nil, model.NewAppError("Summarize.ExecuteCommand", "app.command.execute.error", nil, err.Error(), http.StatusInternalServerError)
+		}
+
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         limitErr.Error(),
+			ChannelId:    args.ChannelId,
+		}, nil
+	}
+
+	ctx := withRequestInfo(context.Background(), RequestInfo{
+		UserID:    args.UserId,
+		TeamID:    args.TeamId,
+		ChannelID: args.ChannelId,
+	})
+
+	language = p.resolveLanguage(args.UserId, language)
 
 	var response *model.CommandResponse
-	var err error
-	if len(split) == 1 {
-		response, err = p.summarizeCurrentContext(c, args)
+	if len(rest) == 0 {
+		response, err = p.summarizeCurrentContext(ctx, args, filters, structured, digest, language)
 	} else {
-		question := split[1]
-		response, err = p.askThreadQuestion(c, args, question)
+		question := strings.Join(rest, " ")
+		response, err = p.askThreadQuestion(ctx, args, question, filters, language)
 	}
 
 	if err != nil {
-		return nil, model.NewAppError("Summarize.ExecuteCommand", "app.command.execute.error", nil, err.Error(), http.StatusInternalServerError)
+		status, message := p.handleLLMError(err, "user_id", args.UserId, "channel_id", args.ChannelId)
+
+		var llmErr *LLMError
+		if !errors.As(err, &llmErr) {
+			return nil, model.NewAppError("Summarize.ExecuteCommand", "app.command.execute.error", nil, err.Error(), status)
+		}
+
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         message,
+			ChannelId:    args.ChannelId,
+		}, nil
 	}
 
 	return response, nil
 }
 
-func (p *Plugin) askThreadQuestion(c *plugin.Context, args *model.CommandArgs, question string) (*model.CommandResponse, error) {
+// getContextData returns the posts of the thread the command was run in, or the recent posts of the
+// channel when it was run outside of a thread.
+func (p *Plugin) getContextData(args *model.CommandArgs, filters *SummaryFilters) (*ThreadData, error) {
 	if args.RootId != "" {
-		threadData, err := p.getThreadAndMeta(args.RootId)
-		if err != nil {
-			return nil, err
+		return p.getThreadAndMeta(args.RootId, filters)
+	}
+
+	return p.getChannelPostsAndMeta(args.ChannelId, filters)
+}
+
+func (p *Plugin) askThreadQuestion(ctx context.Context, args *model.CommandArgs, question string, filters *SummaryFilters, language string) (*model.CommandResponse, error) {
+	threadData, err := p.getQuestionContextData(ctx, args, question, filters)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(threadData.Posts) == 0 {
+		return noPostsResponse(args, filters), nil
+	}
+
+	formattedThread, redactor := p.prepareThread(threadData)
+	p.auditSummarization(ctx, AuditOperationQuestion, args.RootId, threadData, formattedThread)
+	summary, err := p.getSummarizer().AnswerQuestionOnThread(ctx, formattedThread, redactor.RedactText(question), language)
+	if err != nil {
+		return nil, err
+	}
+	summary, _ = p.verifyText(redactor.Restore(summary), threadData, redactor.Restore(formattedThread))
+	summary = p.linkCitations(summary, threadData.Posts)
+
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         summary,
+		ChannelId:    args.ChannelId,
+	}, nil
+}
+
+func (p *Plugin) summarizeCurrentContext(ctx context.Context, args *model.CommandArgs, filters *SummaryFilters, structured, digest bool, language string) (*model.CommandResponse, error) {
+	threadData, err := p.getContextData(args, filters)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(threadData.Posts) == 0 {
+		return noPostsResponse(args, filters), nil
+	}
+
+	if args.RootId == "" && !structured && wantsDigest(digest, threadData) {
+		summary, digestErr := p.summarizeDigest(ctx, args.ChannelId, threadData, language)
+		if digestErr != nil {
+			return nil, digestErr
 		}
+		summary, _ = p.verifyText(summary, threadData)
 
-		formattedThread := formatThread(threadData)
-		summary, err := p.summarizer.AnswerQuestionOnThread(formattedThread, question)
-		if err != nil {
-			return nil, err
+		return ephemeralResponse(args, summary), nil
+	}
+
+	formattedThread, redactor := p.prepareThread(threadData)
+
+	if structured {
+		p.auditSummarization(ctx, AuditOperationSummarizeStructured, args.RootId, threadData, formattedThread)
+		structuredSummary, structuredErr := p.getSummarizer().SummarizeThreadStructured(ctx, formattedThread, language)
+		if structuredErr != nil {
+			return nil, structuredErr
+		}
+		redactor.RestoreStructuredSummary(structuredSummary)
+		_, note := p.verifyStructuredSummary(structuredSummary, threadData, redactor.Restore(formattedThread))
+		taskContext := TaskContext{
+			RequestedBy: args.UserId,
+			ChannelID:   args.ChannelId,
+			RootID:      args.RootId,
 		}
 
 		return &model.CommandResponse{
 			ResponseType: model.CommandResponseTypeEphemeral,
-			Text:         summary,
+			Text:         strings.TrimSpace(structuredSummary.ToMarkdown() + "\n\n" + note),
 			ChannelId:    args.ChannelId,
+			Attachments:  p.actionItemsAttachments(structuredSummary, taskContext),
 		}, nil
 	}
 
+	p.auditSummarization(ctx, AuditOperationSummarize, args.RootId, threadData, formattedThread)
+	summary, err := p.getSummarizer().SummarizeThread(ctx, formattedThread, language)
+	if err != nil {
+		return nil, err
+	}
+	summary, _ = p.verifyText(redactor.Restore(summary), threadData, redactor.Restore(formattedThread))
+
 	return &model.CommandResponse{
 		ResponseType: model.CommandResponseTypeEphemeral,
-		Text:         "Channel questions not implmented",
+		Text:         summary,
 		ChannelId:    args.ChannelId,
 	}, nil
 }
 
-func (p *Plugin) summarizeCurrentContext(c *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, error) {
-	if args.RootId != "" {
-		threadData, err := p.getThreadAndMeta(args.RootId)
-		if err != nil {
-			return nil, err
+// extractFlag removes every occurrence of the given boolean flag from args, reporting whether it
+// was present.
+func extractFlag(args []string, flag string) (bool, []string) {
+	found := false
+	rest := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg == flag {
+			found = true
+			continue
 		}
+		rest = append(rest, arg)
+	}
 
-		formattedThread := formatThread(threadData)
-		summary, err := p.summarizer.SummarizeThread(formattedThread)
-		if err != nil {
-			return nil, err
+	return found, rest
+}
+
+// extractOption removes the given flag and its value from args, accepting both "--flag value" and
+// "--flag=value", and returns the value of its last occurrence.
+func extractOption(args []string, flag string) (string, []string, error) {
+	value := ""
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == flag:
+			if i+1 >= len(args) {
+				return "", nil, errors.Errorf("missing value for %s", flag)
+			}
+			i++
+			value = args[i]
+		case strings.HasPrefix(arg, flag+"="):
+			value = strings.TrimPrefix(arg, flag+"=")
+		default:
+			rest = append(rest, arg)
 		}
+	}
 
-		return &model.CommandResponse{
-			ResponseType: model.CommandResponseTypeEphemeral,
-			Text:         summary,
-			ChannelId:    args.ChannelId,
-		}, nil
+	return value, rest, nil
+}
+
+func ephemeralResponse(args *model.CommandArgs, text string) *model.CommandResponse {
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         text,
+		ChannelId:    args.ChannelId,
+	}
+}
+
+func noPostsResponse(args *model.CommandArgs, filters *SummaryFilters) *model.CommandResponse {
+	text := "There are no posts to summarize."
+	if description := filters.Description(); description != "" {
+		text = fmt.Sprintf("There are no posts matching the filters (%s).", description)
 	}
 
 	return &model.CommandResponse{
 		ResponseType: model.CommandResponseTypeEphemeral,
-		Text:         "Channel summarization not implmented",
+		Text:         text,
 		ChannelId:    args.ChannelId,
-	}, nil
+	}
 }
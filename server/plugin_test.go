@@ -1,28 +1,498 @@
 package main
 
 import (
-	"io"
+	"bytes"
+	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	pluginapi "github.com/mattermost/mattermost-plugin-api"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
+const (
+	testUserID    = "useruseruseruseruseruseru1"
+	testOtherID   = "useruseruseruseruseruseru2"
+	testTeamID    = "teamteamteamteamteamteamt1"
+	testChannelID = "channelchannelchannelchan1"
+	testRootID    = "rootrootrootrootrootrootr1"
+)
+
+// newTestPlugin returns a plugin wired to a mocked server API and a fake summarizer, configured
+// to allow the test user and team. It has no database, so auditing and stored summaries are skipped.
+func newTestPlugin(t *testing.T, config *configuration) (*Plugin, *plugintest.API, *fakeSummarizer) {
+	if config == nil {
+		config = &configuration{}
+	}
+	config.AllowedUserIDs = testUserID
+	config.AllowedTeamIDs = testTeamID
+
+	api := &plugintest.API{}
+	t.Cleanup(func() { api.AssertExpectations(t) })
+
+	summarizer := &fakeSummarizer{}
+	p := &Plugin{summarizer: summarizer}
+	p.SetAPI(api)
+	p.pluginAPI = pluginapi.NewClient(api, nil)
+	p.setConfiguration(config)
+
+	return p, api, summarizer
+}
+
+// mockKVStore keeps the keys starting with any of the prefixes in memory, honoring atomic writes.
+func mockKVStore(api *plugintest.API, prefixes ...string) map[string][]byte {
+	var mu sync.Mutex
+	store := map[string][]byte{}
+	for _, prefix := range prefixes {
+		prefix := prefix
+		matchesPrefix := mock.MatchedBy(func(key string) bool { return strings.HasPrefix(key, prefix) })
+
+		api.On("KVGet", matchesPrefix).Return(func(key string) []byte {
+			mu.Lock()
+			defer mu.Unlock()
+			return store[key]
+		}, nil).Maybe()
+		api.On("KVSetWithOptions", matchesPrefix, mock.Anything, mock.Anything).Return(func(key string, value []byte, options model.PluginKVSetOptions) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			if options.Atomic && !bytes.Equal(store[key], options.OldValue) {
+				return false
+			}
+			store[key] = value
+			return true
+		}, nil).Maybe()
+	}
+
+	return store
+}
+
+// mockChannel makes the channel available along with an enabled policy.
+func mockChannel(api *plugintest.API, channelType model.ChannelType) {
+	api.On("GetChannel", testChannelID).Return(&model.Channel{Id: testChannelID, TeamId: testTeamID, Type: channelType}, nil)
+	api.On("KVGet", channelPolicyKeyPrefix+testChannelID).Return(nil, nil).Maybe()
+}
+
+func mockThread(api *plugintest.API) {
+	posts := model.NewPostList()
+	posts.AddPost(&model.Post{Id: testRootID, ChannelId: testChannelID, UserId: testUserID, Message: "Ship the importer on Friday?", CreateAt: 1})
+	posts.AddPost(&model.Post{Id: "replyreplyreplyreplyreply1", ChannelId: testChannelID, UserId: testOtherID, RootId: testRootID, Message: "Fine by me", CreateAt: 2})
+	posts.AddOrder(testRootID)
+	posts.AddOrder("replyreplyreplyreplyreply1")
+	api.On("GetPostThread", testRootID).Return(posts, nil)
+
+	mockUsers(api)
+}
+
+func mockUsers(api *plugintest.API) {
+	api.On("GetUser", testUserID).Return(&model.User{Id: testUserID, Username: "alice", Locale: "en"}, nil)
+	api.On("GetUser", testOtherID).Return(&model.User{Id: testOtherID, Username: "bob"}, nil)
+}
+
+func summarizeArgs(command, rootID string) *model.CommandArgs {
+	return &model.CommandArgs{
+		Command:   command,
+		UserId:    testUserID,
+		TeamId:    testTeamID,
+		ChannelId: testChannelID,
+		RootId:    rootID,
+	}
+}
+
 func TestServeHTTP(t *testing.T) {
-	assert := assert.New(t)
-	plugin := Plugin{}
-	w := httptest.NewRecorder()
-	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	p, api, _ := newTestPlugin(t, nil)
+	api.On("HasPermissionTo", testUserID, model.PermissionManageSystem).Return(false)
+
+	for name, tc := range map[string]struct {
+		userID string
+		path   string
+		status int
+	}{
+		"unauthenticated":   {"", "/api/v1/summarize/channel/" + testChannelID, http.StatusUnauthorized},
+		"unknown route":     {testUserID, "/api/v1/unknown", http.StatusNotFound},
+		"admin only routes": {testUserID, "/api/v1/admin/usage", http.StatusForbidden},
+		"metrics":           {testUserID, "/metrics", http.StatusForbidden},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.userID != "" {
+				r.Header.Set("Mattermost-User-ID", tc.userID)
+			}
+
+			p.ServeHTTP(nil, w, r)
+
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, tc.status, result.StatusCode)
+		})
+	}
+}
+
+func TestExecuteCommandAuthorization(t *testing.T) {
+	t.Run("missing args", func(t *testing.T) {
+		p, _, _ := newTestPlugin(t, nil)
+		_, appErr := p.ExecuteCommand(nil, nil)
+		require.NotNil(t, appErr)
+		assert.Equal(t, http.StatusInternalServerError, appErr.StatusCode)
+	})
+
+	t.Run("user not allowed", func(t *testing.T) {
+		p, api, summarizer := newTestPlugin(t, nil)
+		mockChannel(api, model.ChannelTypeOpen)
+
+		args := summarizeArgs("/summarize", "")
+		args.UserId = testOtherID
+		_, appErr := p.ExecuteCommand(nil, args)
+		require.NotNil(t, appErr)
+		assert.Equal(t, http.StatusUnauthorized, appErr.StatusCode)
+		assert.Equal(t, "User not authorized", appErr.Id)
+		assert.Empty(t, summarizer.Calls())
+	})
+
+	t.Run("team not allowed", func(t *testing.T) {
+		p, api, _ := newTestPlugin(t, nil)
+		mockChannel(api, model.ChannelTypeOpen)
+
+		args := summarizeArgs("/summarize", "")
+		args.TeamId = "otherteamotherteamotherte1"
+		_, appErr := p.ExecuteCommand(nil, args)
+		require.NotNil(t, appErr)
+		assert.Equal(t, http.StatusUnauthorized, appErr.StatusCode)
+	})
+
+	for channelType, message := range map[model.ChannelType]string{
+		model.ChannelTypePrivate: "Can't work on private channels.",
+		model.ChannelTypeDirect:  "Can't work on direct messages.",
+		model.ChannelTypeGroup:   "Can't work on group messages.",
+	} {
+		t.Run("channel type "+string(channelType)+" not allowed", func(t *testing.T) {
+			p, api, summarizer := newTestPlugin(t, nil)
+			mockChannel(api, channelType)
+
+			_, appErr := p.ExecuteCommand(nil, summarizeArgs("/summarize", testRootID))
+			require.NotNil(t, appErr)
+			assert.Equal(t, message, appErr.Id)
+			assert.Empty(t, summarizer.Calls())
+		})
+	}
+
+	t.Run("private channels allowed", func(t *testing.T) {
+		p, api, summarizer := newTestPlugin(t, &configuration{AllowPrivateChannels: true})
+		mockChannel(api, model.ChannelTypePrivate)
+		mockThread(api)
+
+		response, appErr := p.ExecuteCommand(nil, summarizeArgs("/summarize", testRootID))
+		require.Nil(t, appErr)
+		assert.Equal(t, "summary of 2 posts", response.Text)
+		assert.Equal(t, []string{"SummarizeThread"}, summarizer.Calls())
+	})
+
+	t.Run("channel policy disabled", func(t *testing.T) {
+		p, api, summarizer := newTestPlugin(t, nil)
+		api.On("GetChannel", testChannelID).Return(&model.Channel{Id: testChannelID, TeamId: testTeamID, Type: model.ChannelTypeOpen}, nil)
+		api.On("KVGet", channelPolicyKeyPrefix+testChannelID).Return([]byte(`{"mode": "disabled"}`), nil)
+
+		response, appErr := p.ExecuteCommand(nil, summarizeArgs("/summarize", testRootID))
+		require.Nil(t, appErr)
+		assert.Equal(t, "Summarization has been disabled in this channel by its admins.", response.Text)
+		assert.Empty(t, summarizer.Calls())
+	})
+}
+
+func TestExecuteCommandFlows(t *testing.T) {
+	t.Run("thread summary", func(t *testing.T) {
+		p, api, summarizer := newTestPlugin(t, nil)
+		mockChannel(api, model.ChannelTypeOpen)
+		mockThread(api)
+
+		response, appErr := p.ExecuteCommand(nil, summarizeArgs("/summarize", testRootID))
+		require.Nil(t, appErr)
+		assert.Equal(t, model.CommandResponseTypeEphemeral, response.ResponseType)
+		assert.Equal(t, testChannelID, response.ChannelId)
+		assert.Equal(t, "summary of 2 posts", response.Text)
+		assert.Equal(t, []string{"SummarizeThread"}, summarizer.Calls())
+	})
+
+	t.Run("thread summary through the OpenAI API", func(t *testing.T) {
+		p, api, _ := newTestPlugin(t, nil)
+		mockChannel(api, model.ChannelTypeOpen)
+		mockThread(api)
+		standIn := newOpenAIStandIn(t, "summarize_thread")
+		p.summarizer = NewOpenAISummarizer(staticAPIKey("test-key"), standIn.APIURL(), time.Second, 0, nil)
+
+		response, appErr := p.ExecuteCommand(nil, summarizeArgs("/summarize", testRootID))
+		require.Nil(t, appErr)
+		assert.Equal(t, "@alice proposed shipping the importer on Friday and @bob agreed.", response.Text)
+
+		requests := standIn.Requests()
+		require.Len(t, requests, 1)
+		assert.Equal(t, "[1] alice: Ship the importer on Friday?\n\n[2] bob: Fine by me\n\n", requests[0].Messages[1].Content)
+	})
+
+	t.Run("structured thread summary", func(t *testing.T) {
+		p, api, summarizer := newTestPlugin(t, nil)
+		mockChannel(api, model.ChannelTypeOpen)
+		mockThread(api)
+
+		response, appErr := p.ExecuteCommand(nil, summarizeArgs("/summarize --structured", testRootID))
+		require.Nil(t, appErr)
+		assert.Contains(t, response.Text, "structured summary")
+		assert.Equal(t, []string{"SummarizeThreadStructured"}, summarizer.Calls())
+	})
+
+	t.Run("question on thread", func(t *testing.T) {
+		p, api, summarizer := newTestPlugin(t, nil)
+		mockChannel(api, model.ChannelTypeOpen)
+		mockThread(api)
+
+		response, appErr := p.ExecuteCommand(nil, summarizeArgs("/summarize when do we ship?", testRootID))
+		require.Nil(t, appErr)
+		assert.Equal(t, "answer to when do we ship?", response.Text)
+		assert.Equal(t, []string{"AnswerQuestionOnThread"}, summarizer.Calls())
+	})
+
+	t.Run("channel summary", func(t *testing.T) {
+		p, api, summarizer := newTestPlugin(t, nil)
+		mockChannel(api, model.ChannelTypeOpen)
+		mockUsers(api)
+
+		posts := model.NewPostList()
+		posts.AddPost(&model.Post{Id: "postpostpostpostpostpostp1", ChannelId: testChannelID, UserId: testOtherID, Message: "Deploy is done", CreateAt: 3})
+		posts.AddOrder("postpostpostpostpostpostp1")
+		api.On("GetPostsSince", testChannelID, mock.AnythingOfType("int64")).Return(posts, nil)
+
+		response, appErr := p.ExecuteCommand(nil, summarizeArgs("/summarize", ""))
+		require.Nil(t, appErr)
+		assert.Equal(t, "summary of 1 posts", response.Text)
+		assert.Equal(t, []string{"SummarizeThread"}, summarizer.Calls())
+	})
+
+	t.Run("channel summary until a time in the past", func(t *testing.T) {
+		p, api, summarizer := newTestPlugin(t, nil)
+		mockChannel(api, model.ChannelTypeOpen)
+		mockUsers(api)
+
+		// The default window ends at --until instead of now.
+		since := time.Now().Add(-48*time.Hour - defaultChannelSummaryWindow)
+		posts := model.NewPostList()
+		posts.AddPost(&model.Post{Id: "postpostpostpostpostpostp1", ChannelId: testChannelID, UserId: testOtherID, Message: "Deploy is done", CreateAt: model.GetMillisForTime(since.Add(time.Hour))})
+		posts.AddOrder("postpostpostpostpostpostp1")
+		api.On("GetPostsSince", testChannelID, mock.MatchedBy(func(millis int64) bool {
+			delta := time.Duration(millis-model.GetMillisForTime(since)) * time.Millisecond
+			return delta > -time.Minute && delta < time.Minute
+		})).Return(posts, nil)
+
+		response, appErr := p.ExecuteCommand(nil, summarizeArgs("/summarize --until 48h", ""))
+		require.Nil(t, appErr)
+		assert.Equal(t, "summary of 1 posts", response.Text)
+		assert.Equal(t, []string{"SummarizeThread"}, summarizer.Calls())
+	})
+
+	t.Run("no posts", func(t *testing.T) {
+		p, api, summarizer := newTestPlugin(t, nil)
+		mockChannel(api, model.ChannelTypeOpen)
+		api.On("GetUser", testUserID).Return(&model.User{Id: testUserID, Username: "alice"}, nil)
+		api.On("GetPostsSince", testChannelID, mock.AnythingOfType("int64")).Return(model.NewPostList(), nil)
+
+		response, appErr := p.ExecuteCommand(nil, summarizeArgs("/summarize", ""))
+		require.Nil(t, appErr)
+		assert.Equal(t, "There are no posts to summarize.", response.Text)
+		assert.Empty(t, summarizer.Calls())
+	})
+
+	t.Run("invalid filters", func(t *testing.T) {
+		p, api, summarizer := newTestPlugin(t, nil)
+		mockChannel(api, model.ChannelTypeOpen)
+
+		response, appErr := p.ExecuteCommand(nil, summarizeArgs("/summarize --lang", testRootID))
+		require.Nil(t, appErr)
+		assert.Equal(t, "missing value for --lang", response.Text)
+		assert.Empty(t, summarizer.Calls())
+	})
+
+	t.Run("other commands are ignored", func(t *testing.T) {
+		p, api, summarizer := newTestPlugin(t, nil)
+		mockChannel(api, model.ChannelTypeOpen)
+
+		for _, command := range []string{"/other", "", "   "} {
+			response, appErr := p.ExecuteCommand(nil, summarizeArgs(command, ""))
+			require.Nil(t, appErr)
+			assert.Equal(t, &model.CommandResponse{}, response)
+		}
+		assert.Empty(t, summarizer.Calls())
+	})
+}
+
+func TestExecuteCommandErrors(t *testing.T) {
+	t.Run("channel lookup fails", func(t *testing.T) {
+		p, api, _ := newTestPlugin(t, nil)
+		api.On("GetChannel", testChannelID).Return(nil, model.NewAppError("GetChannel", "app.channel.get.existing.app_error", nil, "", http.StatusNotFound))
+
+		_, appErr := p.ExecuteCommand(nil, summarizeArgs("/summarize", ""))
+		require.NotNil(t, appErr)
+		assert.Equal(t, http.StatusInternalServerError, appErr.StatusCode)
+	})
+
+	t.Run("thread lookup fails", func(t *testing.T) {
+		p, api, summarizer := newTestPlugin(t, nil)
+		mockChannel(api, model.ChannelTypeOpen)
+		api.On("GetUser", testUserID).Return(&model.User{Id: testUserID, Username: "alice"}, nil)
+		api.On("GetPostThread", testRootID).Return(nil, model.NewAppError("GetPostThread", "app.post.get.app_error", nil, "", http.StatusInternalServerError))
+		api.On("LogError", "Summarization failed", "user_id", testUserID, "channel_id", testChannelID, "error", mock.Anything)
+
+		_, appErr := p.ExecuteCommand(nil, summarizeArgs("/summarize", testRootID))
+		require.NotNil(t, appErr)
+		assert.Equal(t, http.StatusInternalServerError, appErr.StatusCode)
+		assert.Empty(t, summarizer.Calls())
+	})
+
+	t.Run("backend failure", func(t *testing.T) {
+		p, api, summarizer := newTestPlugin(t, nil)
+		mockChannel(api, model.ChannelTypeOpen)
+		mockThread(api)
+		summarizer.err = &LLMError{Kind: LLMErrorAuth, Err: errors.New("invalid api key")}
+		api.On("LogError", "LLM request failed", "user_id", testUserID, "channel_id", testChannelID, "kind", "auth", "error", "invalid api key")
+
+		response, appErr := p.ExecuteCommand(nil, summarizeArgs("/summarize", testRootID))
+		require.Nil(t, appErr)
+		assert.Equal(t, summarizer.err.(*LLMError).UserMessage(), response.Text)
+		assert.Equal(t, []string{"SummarizeThread"}, summarizer.Calls())
+	})
+}
+
+func TestHandleSummarizePost(t *testing.T) {
+	for name, tc := range map[string]struct {
+		userID      string
+		body        string
+		canRead     bool
+		policy      string
+		status      int
+		expectedErr string
+		ephemeral   bool
+		summarized  bool
+	}{
+		"unauthenticated":             {status: http.StatusUnauthorized},
+		"channel the user can't read": {userID: testUserID, status: http.StatusForbidden, expectedErr: "you don't have access to this channel"},
+		"channel policy violation": {
+			userID:      testUserID,
+			canRead:     true,
+			policy:      `{"mode": "disabled"}`,
+			status:      http.StatusForbidden,
+			expectedErr: "Summarization has been disabled in this channel by its admins.",
+		},
+		"invalid destination": {userID: testUserID, body: `{"destination": "channel"}`, status: http.StatusBadRequest, expectedErr: "destination must be rhs or ephemeral"},
+		"rhs by default":      {userID: testUserID, canRead: true, status: http.StatusOK, summarized: true},
+		"rhs":                 {userID: testUserID, body: `{"destination": "rhs"}`, canRead: true, status: http.StatusOK, summarized: true},
+		"ephemeral": {
+			userID:     testUserID,
+			body:       `{"destination": "ephemeral"}`,
+			canRead:    true,
+			status:     http.StatusOK,
+			ephemeral:  true,
+			summarized: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p, api, summarizer := newTestPlugin(t, nil)
+			p.botid = "botbotbotbotbotbotbotbotb1"
+			api.On("GetPost", "replyreplyreplyreplyreply1").Return(&model.Post{Id: "replyreplyreplyreplyreply1", ChannelId: testChannelID, RootId: testRootID}, nil).Maybe()
+			api.On("HasPermissionToChannel", testUserID, testChannelID, model.PermissionReadChannel).Return(tc.canRead).Maybe()
+			api.On("GetChannel", testChannelID).Return(&model.Channel{Id: testChannelID, TeamId: testTeamID, Type: model.ChannelTypeOpen}, nil).Maybe()
+			store := mockKVStore(api, channelPolicyKeyPrefix)
+			if tc.policy != "" {
+				store[channelPolicyKeyPrefix+testChannelID] = []byte(tc.policy)
+			}
+			if tc.summarized {
+				mockThread(api)
+			}
+			if tc.ephemeral {
+				api.On("SendEphemeralPost", testUserID, mock.MatchedBy(func(post *model.Post) bool {
+					return post.UserId == p.botid && post.ChannelId == testChannelID && post.RootId == testRootID && post.Message == "summary of 2 posts"
+				})).Return(&model.Post{}).Once()
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/post/replyreplyreplyreplyreply1/summarize", strings.NewReader(tc.body))
+			if tc.userID != "" {
+				r.Header.Set("Mattermost-User-ID", tc.userID)
+			}
+			p.ServeHTTP(nil, w, r)
+
+			require.Equal(t, tc.status, w.Code, w.Body.String())
+			if tc.summarized {
+				assert.Equal(t, []string{"SummarizeThread"}, summarizer.Calls())
+			} else {
+				assert.Empty(t, summarizer.Calls())
+			}
+			if tc.status != http.StatusOK {
+				if tc.expectedErr != "" {
+					assert.JSONEq(t, `{"error": "`+tc.expectedErr+`"}`, w.Body.String())
+				}
+				return
+			}
+
+			var response map[string]interface{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, "summary of 2 posts", response["result"])
+			assert.Equal(t, testRootID, response["root_id"], "the whole thread of the post is summarized")
+			assert.Equal(t, testChannelID, response["channel_id"])
+			assert.EqualValues(t, 2, response["post_count"])
+		})
+	}
+}
+
+func TestExtractOption(t *testing.T) {
+	value, rest, err := extractOption([]string{"--lang", "es", "--since", "2d", "why?"}, "--lang")
+	require.NoError(t, err)
+	assert.Equal(t, "es", value)
+	assert.Equal(t, []string{"--since", "2d", "why?"}, rest)
+
+	value, rest, err = extractOption([]string{"--lang=fr"}, "--lang")
+	require.NoError(t, err)
+	assert.Equal(t, "fr", value)
+	assert.Empty(t, rest)
+
+	_, _, err = extractOption([]string{"--lang"}, "--lang")
+	assert.Error(t, err)
+}
+
+func TestConfigureBackends(t *testing.T) {
+	p, api, _ := newTestPlugin(t, nil)
+	mockCredentialStore(api)
+	api.On("LogInfo", "Summarizer call finished", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+
+	first := newOpenAIStandIn(t, "summarize_thread")
+	second := newOpenAIStandIn(t, "summarize_thread")
 
-	plugin.ServeHTTP(nil, w, r)
+	// A new API URL applies to the next call, without restarting the plugin.
+	for _, standIn := range []*openAIStandIn{first, second} {
+		config := &configuration{OpenAIAPIKey: "sk-test", OpenAIAPIURL: standIn.APIURL()}
+		p.setConfiguration(config)
+		require.NoError(t, p.configureBackends(config))
+		_, err := p.getSummarizer().SummarizeThread(context.Background(), "[1] alice: hi\n\n", "")
+		require.NoError(t, err)
+	}
+	assert.Len(t, first.Requests(), 1)
+	assert.Len(t, second.Requests(), 1)
 
-	result := w.Result()
-	assert.NotNil(result)
-	defer result.Body.Close()
-	bodyBytes, err := io.ReadAll(result.Body)
-	assert.Nil(err)
-	bodyString := string(bodyBytes)
+	// Any model name is passed to the embeddings API.
+	require.NoError(t, p.configureBackends(&configuration{EnableSemanticSearch: true, EmbeddingModel: "nomic-embed-text"}))
+	require.NotNil(t, p.getEmbedder())
+	assert.Equal(t, "nomic-embed-text", p.getEmbedder().Model())
 
-	assert.Equal("Hello, world!", bodyString)
+	// An embedder that can't be set up disables semantic search without failing the activation.
+	api.On("LogError", "Failed to set up the embeddings backend, semantic search is disabled", "error", `invalid embedding API URL "localhost:8080"`).Once()
+	require.NoError(t, p.configureBackends(&configuration{EnableSemanticSearch: true, EmbeddingAPIURL: "localhost:8080"}))
+	assert.Nil(t, p.getEmbedder())
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/mattermost/mattermost-server/v6/model"
 )
@@ -9,45 +10,72 @@ import (
 type ThreadData struct {
 	Posts     []*model.Post
 	UsersByID map[string]*model.User
+
+	// ChannelsByID is only set when the posts come from several channels.
+	ChannelsByID map[string]*model.Channel
 }
 
-func (p *Plugin) getThreadAndMeta(postID string) (*ThreadData, error) {
+func (p *Plugin) getThreadAndMeta(postID string, filters *SummaryFilters) (*ThreadData, error) {
 	posts, err := p.pluginAPI.Post.GetPostThread(postID)
 	if err != nil {
 		return nil, err
 	}
 
-	userIDsUnique := make(map[string]bool)
-	for _, post := range posts.Posts {
-		userIDsUnique[post.UserId] = true
+	return p.getPostsMeta(filters.Apply(posts.ToSlice()))
+}
+
+func (p *Plugin) getChannelPostsAndMeta(channelID string, filters *SummaryFilters) (*ThreadData, error) {
+	// Without --since, the default window ends at --until, or now.
+	since := filters.Since
+	if since.IsZero() {
+		end := filters.Until
+		if end.IsZero() {
+			end = model.GetTimeForMillis(model.GetMillis())
+		}
+		since = end.Add(-defaultChannelSummaryWindow)
 	}
-	userIDs := make([]string, 0, len(userIDsUnique))
-	for userID := range userIDsUnique {
-		userIDs = append(userIDs, userID)
+
+	posts, err := p.pluginAPI.Post.GetPostsSince(channelID, model.GetMillisForTime(since))
+	if err != nil {
+		return nil, err
 	}
 
+	postsSlice := filters.Apply(posts.ToSlice())
+	sort.Slice(postsSlice, func(i, j int) bool {
+		return postsSlice[i].CreateAt < postsSlice[j].CreateAt
+	})
+
+	return p.getPostsMeta(postsSlice)
+}
+
+func (p *Plugin) getPostsMeta(posts []*model.Post) (*ThreadData, error) {
 	usersByID := make(map[string]*model.User)
-	for _, userID := range userIDs {
-		user, err := p.pluginAPI.User.Get(userID)
+	for _, post := range posts {
+		if _, ok := usersByID[post.UserId]; ok {
+			continue
+		}
+		user, err := p.pluginAPI.User.Get(post.UserId)
 		if err != nil {
 			return nil, err
 		}
-		usersByID[userID] = user
+		usersByID[post.UserId] = user
 	}
 
-	postsSlice := posts.ToSlice()
-
 	return &ThreadData{
-		Posts:     postsSlice,
+		Posts:     posts,
 		UsersByID: usersByID,
 	}, nil
-
 }
 
+// formatThread numbers the posts so the model can cite them, see linkCitations.
 func formatThread(data *ThreadData) string {
 	result := ""
-	for _, post := range data.Posts {
-		result += fmt.Sprintf("%s: %s\n\n", data.UsersByID[post.UserId].Username, post.Message)
+	for i, post := range data.Posts {
+		author := data.UsersByID[post.UserId].Username
+		if channel, ok := data.ChannelsByID[post.ChannelId]; ok {
+			author += " in " + channelLabel(channel)
+		}
+		result += fmt.Sprintf("[%d] %s: %s\n\n", i+1, author, post.Message)
 	}
 
 	return result
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+type redactionRule struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+// builtinRedactionRules catch the most common personal data and credentials pasted in chats.
+// Secrets come first so that, for example, a token containing an @ isn't treated as an email.
+var builtinRedactionRules = []redactionRule{
+	{"PRIVATE_KEY", regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`)},
+	{"SECRET", regexp.MustCompile(`\b(?:sk|pk|rk)-[A-Za-z0-9_-]{16,}\b`)},
+	{"SECRET", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"SECRET", regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{30,}\b`)},
+	{"SECRET", regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}\b`)},
+	{"SECRET", regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}\b`)},
+	{"SECRET", regexp.MustCompile(`(?i)\b(bearer|token|password|passwd|secret|api[_-]?key)(\s*[:=]\s*|\s+)[^\s'"]{8,}`)},
+	{"EMAIL", regexp.MustCompile(`\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`)},
+	{"PHONE", regexp.MustCompile(`(?:\+\d{1,3}[\s.-]?)?(?:\(\d{2,4}\)[\s.-]?|\b\d{2,4}[\s.-])\d{3,4}[\s.-]\d{3,4}\b`)},
+}
+
+// parseRedactionRules parses the custom rules setting: one rule per line, either a bare regular
+// expression or NAME=regular expression. Blank lines and lines starting with # are ignored.
+func parseRedactionRules(setting string) ([]redactionRule, error) {
+	rules := []redactionRule{}
+	for i, line := range strings.Split(setting, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, expression := "REDACTED", line
+		if before, after, found := strings.Cut(line, "="); found && regexp.MustCompile(`^[A-Z_]+$`).MatchString(before) {
+			name, expression = before, after
+		}
+
+		pattern, err := regexp.Compile(expression)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid redaction rule on line %d", i+1)
+		}
+		rules = append(rules, redactionRule{name: name, pattern: pattern})
+	}
+
+	return rules, nil
+}
+
+// Redactor removes sensitive data from a thread before it is sent to the summarizer, and maps
+// pseudonyms in the response back to the real usernames. Authors are pseudonymized in the post
+// prefix, and everyone else when @mentioned, as lookupUser resolves them.
+type Redactor struct {
+	rules        []redactionRule
+	pseudonymize bool
+	lookupUser   func(username string) (*model.User, error)
+
+	// pseudonyms maps usernames to pseudonyms, and usernames the other way around.
+	pseudonyms map[string]string
+	usernames  map[string]string
+	// notUsers holds the mentions that don't resolve to a user, so they are only looked up once.
+	notUsers map[string]bool
+}
+
+func NewRedactor(rules []redactionRule, pseudonymize bool, lookupUser func(username string) (*model.User, error)) *Redactor {
+	return &Redactor{
+		rules:        rules,
+		pseudonymize: pseudonymize,
+		lookupUser:   lookupUser,
+		pseudonyms:   map[string]string{},
+		usernames:    map[string]string{},
+		notUsers:     map[string]bool{},
+	}
+}
+
+// pseudonym derives a stable name from the user ID, so the same person gets the same pseudonym
+// across requests without storing a mapping.
+func pseudonym(userID string) string {
+	sum := sha256.Sum256([]byte(userID))
+	return "user_" + hex.EncodeToString(sum[:])[:8]
+}
+
+// Redact formats the thread with formatThread, with sensitive data replaced.
+func (r *Redactor) Redact(data *ThreadData) string {
+	redacted := &ThreadData{
+		Posts:        make([]*model.Post, 0, len(data.Posts)),
+		UsersByID:    make(map[string]*model.User, len(data.UsersByID)),
+		ChannelsByID: data.ChannelsByID,
+	}
+
+	for userID, user := range data.UsersByID {
+		userCopy := *user
+		if r.pseudonymize {
+			userCopy.Username = r.addUser(userID, user.Username)
+		}
+		redacted.UsersByID[userID] = &userCopy
+	}
+
+	for _, post := range data.Posts {
+		postCopy := post.Clone()
+		postCopy.Message = r.RedactText(post.Message)
+		redacted.Posts = append(redacted.Posts, postCopy)
+	}
+
+	return formatThread(redacted)
+}
+
+func (r *Redactor) addUser(userID, username string) string {
+	alias := pseudonym(userID)
+	r.pseudonyms[username] = alias
+	r.usernames[alias] = username
+	return alias
+}
+
+// mentionAlias returns the pseudonym of the user a mention resolves to.
+func (r *Redactor) mentionAlias(username string) (string, bool) {
+	username = strings.ToLower(username)
+	if alias, ok := r.pseudonyms[username]; ok {
+		return alias, true
+	}
+	if specialMentions[username] || r.notUsers[username] || r.lookupUser == nil {
+		return "", false
+	}
+
+	user, err := r.lookupUser(username)
+	if err != nil || user == nil {
+		r.notUsers[username] = true
+		return "", false
+	}
+
+	return r.addUser(user.Id, user.Username), true
+}
+
+// RedactText applies the redaction rules and pseudonyms to a single piece of text. Only @mentions
+// are pseudonymized, so that words which happen to be usernames are left alone.
+func (r *Redactor) RedactText(text string) string {
+	for _, rule := range r.rules {
+		text = rule.pattern.ReplaceAllString(text, "["+rule.name+"]")
+	}
+
+	if !r.pseudonymize {
+		return text
+	}
+
+	var redacted strings.Builder
+	last := 0
+	for _, match := range mentionPattern.FindAllStringSubmatchIndex(text, -1) {
+		alias, ok := r.mentionAlias(text[match[2]:match[3]])
+		if !ok {
+			continue
+		}
+		redacted.WriteString(text[last:match[2]])
+		redacted.WriteString(alias)
+		last = match[3]
+	}
+	redacted.WriteString(text[last:])
+
+	return redacted.String()
+}
+
+// Restore replaces the pseudonyms in a summarizer response with the real usernames.
+func (r *Redactor) Restore(text string) string {
+	for alias, username := range r.usernames {
+		text = regexp.MustCompile(`@?\b`+regexp.QuoteMeta(alias)+`\b`).ReplaceAllString(text, "@"+username)
+	}
+
+	return text
+}
+
+// RestoreStructuredSummary applies Restore to every field of a structured summary.
+func (r *Redactor) RestoreStructuredSummary(summary *StructuredSummary) {
+	restoreAll := func(items []string) {
+		for i := range items {
+			items[i] = r.Restore(items[i])
+		}
+	}
+
+	summary.TLDR = r.Restore(summary.TLDR)
+	restoreAll(summary.Decisions)
+	restoreAll(summary.OpenQuestions)
+	restoreAll(summary.Participants)
+	for i := range summary.ActionItems {
+		summary.ActionItems[i].Description = r.Restore(summary.ActionItems[i].Description)
+		summary.ActionItems[i].Owner = r.Restore(summary.ActionItems[i].Owner)
+	}
+}
+
+// prepareThread formats the thread for the summarizer with the configured redaction applied.
+// The returned Redactor must be used to restore the response.
+func (p *Plugin) prepareThread(data *ThreadData) (string, *Redactor) {
+	redactor := p.newRedactor()
+	return redactor.Redact(data), redactor
+}
+
+// newRedactor returns a Redactor with the configured rules.
+func (p *Plugin) newRedactor() *Redactor {
+	config := p.getConfiguration()
+
+	rules := []redactionRule{}
+	if config.RedactBuiltinPatterns {
+		rules = append(rules, builtinRedactionRules...)
+	}
+	rules = append(rules, config.redactionRules...)
+
+	var lookupUser func(username string) (*model.User, error)
+	if config.PseudonymizeUsernames {
+		lookupUser = p.pluginAPI.User.GetByUsername
+	}
+
+	return NewRedactor(rules, config.PseudonymizeUsernames, lookupUser)
+}
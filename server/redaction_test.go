@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactor(t *testing.T) {
+	data := &ThreadData{
+		Posts: []*model.Post{
+			{UserId: "alice-id", Message: "Ping me at alice@example.com or +1 555-123-4567, the key is sk-abcdefghijklmnopqrstuvwx"},
+			{UserId: "bob-id", Message: "@alice the ticket is INC-1234, token: hunter2hunter2"},
+		},
+		UsersByID: map[string]*model.User{
+			"alice-id": {Id: "alice-id", Username: "alice"},
+			"bob-id":   {Id: "bob-id", Username: "bob"},
+		},
+	}
+
+	customRules, err := parseRedactionRules("# incident tickets\nTICKET=INC-[0-9]+\n")
+	require.NoError(t, err)
+
+	t.Run("redacts builtin and custom patterns", func(t *testing.T) {
+		redactor := NewRedactor(append(builtinRedactionRules, customRules...), false, nil)
+		thread := redactor.Redact(data)
+
+		assert.Contains(t, thread, "alice: Ping me at [EMAIL] or [PHONE], the key is [SECRET]")
+		assert.Contains(t, thread, "bob: @alice the ticket is [TICKET], [SECRET]")
+		assert.Equal(t, "alice@example.com", data.Posts[0].Message[11:28], "original posts must not be modified")
+	})
+
+	t.Run("pseudonymizes and restores usernames", func(t *testing.T) {
+		redactor := NewRedactor(nil, true, nil)
+		thread := redactor.Redact(data)
+
+		alice, bob := pseudonym("alice-id"), pseudonym("bob-id")
+		assert.NotContains(t, thread, "@alice")
+		assert.NotContains(t, thread, "bob")
+		assert.Contains(t, thread, alice+": Ping me at alice@example.com", "emails are left to the redaction rules")
+		assert.Contains(t, thread, bob+": @"+alice+" the ticket")
+		assert.Equal(t, alice, pseudonym("alice-id"), "pseudonyms must be stable")
+
+		assert.Equal(t, "@alice asked @bob to fix it", redactor.Restore(alice+" asked @"+bob+" to fix it"))
+
+		summary := &StructuredSummary{TLDR: alice + " agreed", Participants: []string{alice, bob}, ActionItems: []ActionItem{{Description: "Deploy", Owner: bob}}}
+		redactor.RestoreStructuredSummary(summary)
+		assert.Equal(t, "@alice agreed", summary.TLDR)
+		assert.Equal(t, []string{"@alice", "@bob"}, summary.Participants)
+		assert.Equal(t, "@bob", summary.ActionItems[0].Owner)
+	})
+
+	t.Run("pseudonymizes every mentioned user", func(t *testing.T) {
+		lookups := []string{}
+		redactor := NewRedactor(nil, true, func(username string) (*model.User, error) {
+			lookups = append(lookups, username)
+			if username == "carol" {
+				return &model.User{Id: "carol-id", Username: "carol"}, nil
+			}
+			return nil, errors.New("not found")
+		})
+		thread := redactor.Redact(&ThreadData{
+			Posts: []*model.Post{
+				{UserId: "admin-id", Message: "@Carol and @ghost, the test admin account is ready. Ask @admin, @channel or carol@example.com."},
+				{UserId: "admin-id", Message: "cc @carol."},
+			},
+			UsersByID: map[string]*model.User{"admin-id": {Id: "admin-id", Username: "admin"}},
+		})
+
+		admin, carol := pseudonym("admin-id"), pseudonym("carol-id")
+		assert.Contains(t, thread, admin+": @"+carol+" and @ghost, the test admin account is ready. Ask @"+admin+", @channel or carol@example.com.",
+			"only mentions resolving to users are replaced, not words or emails")
+		assert.Contains(t, thread, admin+": cc @"+carol+".")
+		assert.Equal(t, []string{"carol", "ghost"}, lookups, "each mention is looked up once")
+		assert.Equal(t, "@carol will ask @admin", redactor.Restore(carol+" will ask @"+admin))
+	})
+
+	_, err = parseRedactionRules("BROKEN=[")
+	assert.Error(t, err)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-plugin-api/cluster"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	reminderKeyPrefix = "reminder_"
+	reminderHour      = 9
+)
+
+type Reminder struct {
+	UserID      string      `json:"user_id"`
+	Item        ActionItem  `json:"item"`
+	TaskContext TaskContext `json:"task_context"`
+}
+
+// ReminderTaskSink notifies each action item owner through a DM from the bot, and schedules a
+// second DM on the morning of the due date when there is one.
+type ReminderTaskSink struct {
+	plugin *Plugin
+}
+
+func (s *ReminderTaskSink) PushActionItems(taskContext TaskContext, items []ActionItem) (string, error) {
+	p := s.plugin
+
+	created := 0
+	skipped := []string{}
+	for _, item := range items {
+		username := strings.TrimPrefix(item.Owner, "@")
+		if username == "" {
+			skipped = append(skipped, item.Description)
+			continue
+		}
+
+		// Owners outside of the channel would learn about its content from the reminder.
+		owner, err := p.pluginAPI.User.GetByUsername(username)
+		if err != nil || !p.pluginAPI.User.HasPermissionToChannel(owner.Id, taskContext.ChannelID, model.PermissionReadChannel) {
+			skipped = append(skipped, item.Description)
+			continue
+		}
+
+		if err := p.sendReminder(owner.Id, item, taskContext, false); err != nil {
+			return "", err
+		}
+
+		if item.DueDate != "" {
+			if err := p.scheduleReminder(owner, item, taskContext); err != nil {
+				return "", err
+			}
+		}
+		created++
+	}
+
+	result := fmt.Sprintf("Created reminders for %d action items.", created)
+	if len(skipped) > 0 {
+		result += fmt.Sprintf(" Skipped %d without a known owner in this channel: %s", len(skipped), strings.Join(skipped, "; "))
+	}
+
+	return result, nil
+}
+
+func (p *Plugin) startReminderScheduler() error {
+	p.reminderScheduler = cluster.GetJobOnceScheduler(p.API)
+	if err := p.reminderScheduler.SetCallback(p.runReminder); err != nil {
+		return errors.Wrap(err, "failed to set reminder callback")
+	}
+
+	return p.reminderScheduler.Start()
+}
+
+func (p *Plugin) scheduleReminder(owner *model.User, item ActionItem, taskContext TaskContext) error {
+	location, err := time.LoadLocation(owner.GetPreferredTimezone())
+	if err != nil {
+		location = time.UTC
+	}
+
+	dueDate, err := time.ParseInLocation("2006-01-02", item.DueDate, location)
+	if err != nil {
+		return err
+	}
+	runAt := dueDate.Add(reminderHour * time.Hour)
+	if runAt.Before(time.Now()) {
+		return nil
+	}
+
+	key := reminderKeyPrefix + model.NewId()
+	if _, err := p.pluginAPI.KV.Set(key, Reminder{UserID: owner.Id, Item: item, TaskContext: taskContext}); err != nil {
+		return errors.Wrap(err, "failed to store reminder")
+	}
+
+	if _, err := p.reminderScheduler.ScheduleOnce(key, runAt); err != nil {
+		return errors.Wrap(err, "failed to schedule reminder")
+	}
+
+	return nil
+}
+
+func (p *Plugin) runReminder(key string) {
+	if !strings.HasPrefix(key, reminderKeyPrefix) {
+		return
+	}
+
+	var reminder Reminder
+	if err := p.pluginAPI.KV.Get(key, &reminder); err != nil {
+		p.API.LogError("Failed to load reminder", "key", key, "error", err.Error())
+		return
+	}
+	if reminder.UserID == "" {
+		return
+	}
+
+	if err := p.sendReminder(reminder.UserID, reminder.Item, reminder.TaskContext, true); err != nil {
+		p.API.LogError("Failed to send reminder", "key", key, "error", err.Error())
+		return
+	}
+
+	if err := p.pluginAPI.KV.Delete(key); err != nil {
+		p.API.LogError("Failed to delete reminder", "key", key, "error", err.Error())
+	}
+}
+
+func (p *Plugin) sendReminder(userID string, item ActionItem, taskContext TaskContext, due bool) error {
+	message := fmt.Sprintf("You have a new action item: **%s**", item.Description)
+	if due {
+		message = fmt.Sprintf("Reminder, this action item is due today: **%s**", item.Description)
+	} else if item.DueDate != "" {
+		message += fmt.Sprintf(" (due %s)", item.DueDate)
+	}
+
+	if taskContext.RootID != "" {
+		message += fmt.Sprintf("\n\nFrom this [thread](%s).", p.permalink(taskContext.RootID))
+	}
+
+	return p.pluginAPI.Post.DM(p.botid, userID, &model.Post{Message: message})
+}
+
+func (p *Plugin) permalink(postID string) string {
+	siteURL := ""
+	if config := p.API.GetConfig(); config != nil && config.ServiceSettings.SiteURL != nil {
+		siteURL = *config.ServiceSettings.SiteURL
+	}
+
+	return fmt.Sprintf("%s/_redirect/pl/%s", strings.TrimSuffix(siteURL, "/"), postID)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+// semanticSearchEnabled reports whether questions can be answered from the vector index.
+func (p *Plugin) semanticSearchEnabled() bool {
+	return p.getConfiguration().EnableSemanticSearch && p.getEmbedder() != nil && p.vectorIndex != nil
+}
+
+// isIndexable reports whether a post belongs in the vector index.
+func (p *Plugin) isIndexable(post *model.Post) bool {
+	return post.DeleteAt == 0 &&
+		!post.IsSystemMessage() &&
+		post.UserId != p.botid &&
+		strings.TrimSpace(post.Message) != ""
+}
+
+// isChannelIndexable reports whether the posts of the channel may be sent to the embeddings
+// backend. Like for summaries, the type of channel must be allowed, its policy must allow it and,
+// in DMs and GMs, every participant must have consented.
+func (p *Plugin) isChannelIndexable(channelID string) (bool, error) {
+	channel, err := p.pluginAPI.Channel.Get(channelID)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to get channel %s", channelID)
+	}
+	if p.checkChannelType(channel) != nil {
+		return false, nil
+	}
+
+	policy, err := p.getChannelPolicy(channel.Id)
+	if err != nil {
+		return false, err
+	}
+	violation, err := p.channelPolicyViolation(channel, policy, embeddingsBackend)
+	if err != nil {
+		return false, err
+	}
+
+	return violation == "", nil
+}
+
+// indexableChannelTypes returns the types of channels whose posts may be indexed.
+func (p *Plugin) indexableChannelTypes() []string {
+	types := []string{string(model.ChannelTypeOpen)}
+	for _, channelType := range []model.ChannelType{model.ChannelTypePrivate, model.ChannelTypeDirect, model.ChannelTypeGroup} {
+		if p.checkChannelType(&model.Channel{Type: channelType}) == nil {
+			types = append(types, string(channelType))
+		}
+	}
+
+	return types
+}
+
+// removeChannelFromIndex deletes the chunks of the channel once its posts may no longer be indexed.
+func (p *Plugin) removeChannelFromIndex(channelID string) error {
+	if p.vectorIndex == nil {
+		return nil
+	}
+
+	return p.vectorIndex.DeleteChannel(channelID)
+}
+
+// indexPosts embeds the given posts and replaces their chunks in the vector index. Posts that
+// shouldn't be searchable, like deleted posts, system messages or posts of channels that can't be
+// summarized, are removed from it instead.
+func (p *Plugin) indexPosts(ctx context.Context, posts []*model.Post) error {
+	embedder := p.getEmbedder()
+	if embedder == nil || p.vectorIndex == nil {
+		return nil
+	}
+
+	redactor := p.newRedactor()
+	postIDs := make([]string, 0, len(posts))
+	indexableChannels := map[string]bool{}
+	indexed := &ThreadData{}
+	chunks := []*PostChunk{}
+	texts := []string{}
+	for _, post := range posts {
+		postIDs = append(postIDs, post.Id)
+		if !p.isIndexable(post) {
+			continue
+		}
+
+		indexable, checked := indexableChannels[post.ChannelId]
+		if !checked {
+			var err error
+			if indexable, err = p.isChannelIndexable(post.ChannelId); err != nil {
+				return err
+			}
+			indexableChannels[post.ChannelId] = indexable
+		}
+		if !indexable {
+			continue
+		}
+
+		indexed.Posts = append(indexed.Posts, post)
+		for i, content := range chunkText(redactor.RedactText(post.Message), maxChunkLength) {
+			chunks = append(chunks, &PostChunk{
+				Id:         fmt.Sprintf("%s_%d", post.Id, i),
+				PostId:     post.Id,
+				ChannelId:  post.ChannelId,
+				UserId:     post.UserId,
+				ChunkIndex: i,
+				Content:    content,
+				CreateAt:   post.CreateAt,
+				Model:      embedder.Model(),
+			})
+			texts = append(texts, content)
+		}
+	}
+
+	if len(texts) > 0 {
+		p.auditSummarization(ctx, AuditOperationEmbed, "", indexed, strings.Join(texts, "\n\n"))
+		vectors, err := embedder.Embed(ctx, texts)
+		if err != nil {
+			return errors.Wrap(err, "failed to embed posts")
+		}
+		for i, chunk := range chunks {
+			chunk.Embedding = encodeVector(vectors[i])
+		}
+	}
+
+	return p.vectorIndex.ReplacePosts(postIDs, chunks)
+}
+
+// retrieveRelevantPosts returns the posts of the channels that are most related to the question,
+// in chronological order. Unlike summaries, the search isn't limited to recent posts unless the
+// filters say so.
+func (p *Plugin) retrieveRelevantPosts(ctx context.Context, channelIDs []string, question string, filters *SummaryFilters) (*ThreadData, error) {
+	embedder := p.getEmbedder()
+	if embedder == nil {
+		return nil, errors.New("semantic search is disabled")
+	}
+
+	vectors, err := embedder.Embed(ctx, []string{p.newRedactor().RedactText(question)})
+	if err != nil {
+		return nil, err
+	}
+
+	search := VectorSearch{
+		ChannelIDs: channelIDs,
+		Model:      embedder.Model(),
+		TopK:       p.getConfiguration().semanticSearchTopK(),
+	}
+	if !filters.Since.IsZero() {
+		search.Since = model.GetMillisForTime(filters.Since)
+	}
+	if !filters.Until.IsZero() {
+		search.Until = model.GetMillisForTime(filters.Until)
+	}
+
+	matches, err := p.vectorIndex.Search(vectors[0], search)
+	if err != nil {
+		return nil, err
+	}
+
+	posts := []*model.Post{}
+	seen := map[string]bool{}
+	for _, match := range matches {
+		if seen[match.PostId] {
+			continue
+		}
+		seen[match.PostId] = true
+
+		post, err := p.pluginAPI.Post.GetPost(match.PostId)
+		if err != nil {
+			p.API.LogWarn("Failed to get indexed post", "post_id", match.PostId, "error", err.Error())
+			continue
+		}
+		posts = append(posts, post)
+	}
+
+	posts = filters.Apply(posts)
+	sort.Slice(posts, func(i, j int) bool {
+		return posts[i].CreateAt < posts[j].CreateAt
+	})
+
+	return p.getPostsMeta(posts)
+}
+
+// getQuestionContextData returns the posts a question is answered from. Questions on a channel
+// use the posts most related to the question when semantic search is enabled, and fall back to
+// the recent posts when nothing relevant has been indexed.
+func (p *Plugin) getQuestionContextData(ctx context.Context, args *model.CommandArgs, question string, filters *SummaryFilters) (*ThreadData, error) {
+	if args.RootId == "" && p.semanticSearchEnabled() {
+		data, err := p.retrieveRelevantPosts(ctx, []string{args.ChannelId}, question, filters)
+		if err != nil {
+			return nil, err
+		}
+		if len(data.Posts) > 0 {
+			return data, nil
+		}
+	}
+
+	return p.getContextData(args, filters)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+// migrations are applied in order on every activation, so each statement must be idempotent.
+var migrations = map[string][]string{
+	model.DatabaseDriverPostgres: {
+		`CREATE TABLE IF NOT EXISTS LLMSummarize_Usage (
+			Id VARCHAR(26) PRIMARY KEY,
+			CreateAt BIGINT NOT NULL,
+			UserId VARCHAR(26) NOT NULL,
+			TeamId VARCHAR(26) NOT NULL,
+			ChannelId VARCHAR(26) NOT NULL,
+			Model VARCHAR(64) NOT NULL,
+			PromptTokens INTEGER NOT NULL,
+			CompletionTokens INTEGER NOT NULL,
+			Cost DOUBLE PRECISION NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_llmsummarize_usage_createat ON LLMSummarize_Usage (CreateAt)`,
+		`CREATE INDEX IF NOT EXISTS idx_llmsummarize_usage_userid ON LLMSummarize_Usage (UserId)`,
+		`CREATE TABLE IF NOT EXISTS LLMSummarize_Audit (
+			Id VARCHAR(26) PRIMARY KEY,
+			CreateAt BIGINT NOT NULL,
+			UserId VARCHAR(26) NOT NULL,
+			TeamId VARCHAR(26) NOT NULL,
+			ChannelId VARCHAR(26) NOT NULL,
+			RootId VARCHAR(26) NOT NULL,
+			Operation VARCHAR(64) NOT NULL,
+			Backend VARCHAR(64) NOT NULL,
+			Model VARCHAR(64) NOT NULL,
+			PostIds TEXT NOT NULL,
+			Content TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_llmsummarize_audit_createat ON LLMSummarize_Audit (CreateAt)`,
+		`CREATE INDEX IF NOT EXISTS idx_llmsummarize_audit_userid ON LLMSummarize_Audit (UserId)`,
+		`CREATE INDEX IF NOT EXISTS idx_llmsummarize_audit_channelid ON LLMSummarize_Audit (ChannelId)`,
+		`CREATE TABLE IF NOT EXISTS LLMSummarize_AuditPosts (
+			AuditId VARCHAR(26) NOT NULL,
+			PostId VARCHAR(26) NOT NULL,
+			CreateAt BIGINT NOT NULL,
+			PRIMARY KEY (AuditId, PostId)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_llmsummarize_auditposts_postid ON LLMSummarize_AuditPosts (PostId)`,
+		`CREATE INDEX IF NOT EXISTS idx_llmsummarize_auditposts_createat ON LLMSummarize_AuditPosts (CreateAt)`,
+		`CREATE TABLE IF NOT EXISTS LLMSummarize_Summaries (
+			Id VARCHAR(64) PRIMARY KEY,
+			ChannelId VARCHAR(26) NOT NULL,
+			Scope VARCHAR(16) NOT NULL,
+			ScopeId VARCHAR(26) NOT NULL,
+			Language VARCHAR(64) NOT NULL,
+			SourceHash VARCHAR(64) NOT NULL,
+			PostCount INTEGER NOT NULL,
+			Model VARCHAR(64) NOT NULL,
+			Summary TEXT NOT NULL,
+			UpdateAt BIGINT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_llmsummarize_summaries_channelid ON LLMSummarize_Summaries (ChannelId)`,
+		`CREATE TABLE IF NOT EXISTS LLMSummarize_Embeddings (
+			Id VARCHAR(64) PRIMARY KEY,
+			PostId VARCHAR(26) NOT NULL,
+			ChannelId VARCHAR(26) NOT NULL,
+			UserId VARCHAR(26) NOT NULL,
+			ChunkIndex INTEGER NOT NULL,
+			Content TEXT NOT NULL,
+			CreateAt BIGINT NOT NULL,
+			Model VARCHAR(64) NOT NULL,
+			Embedding BYTEA NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_llmsummarize_embeddings_postid ON LLMSummarize_Embeddings (PostId)`,
+		`CREATE INDEX IF NOT EXISTS idx_llmsummarize_embeddings_channelid_createat ON LLMSummarize_Embeddings (ChannelId, CreateAt)`,
+	},
+	model.DatabaseDriverMysql: {
+		`CREATE TABLE IF NOT EXISTS LLMSummarize_Usage (
+			Id VARCHAR(26) PRIMARY KEY,
+			CreateAt BIGINT NOT NULL,
+			UserId VARCHAR(26) NOT NULL,
+			TeamId VARCHAR(26) NOT NULL,
+			ChannelId VARCHAR(26) NOT NULL,
+			Model VARCHAR(64) NOT NULL,
+			PromptTokens INTEGER NOT NULL,
+			CompletionTokens INTEGER NOT NULL,
+			Cost DOUBLE PRECISION NOT NULL,
+			INDEX idx_llmsummarize_usage_createat (CreateAt),
+			INDEX idx_llmsummarize_usage_userid (UserId)
+		) DEFAULT CHARACTER SET utf8mb4`,
+		`CREATE TABLE IF NOT EXISTS LLMSummarize_Audit (
+			Id VARCHAR(26) PRIMARY KEY,
+			CreateAt BIGINT NOT NULL,
+			UserId VARCHAR(26) NOT NULL,
+			TeamId VARCHAR(26) NOT NULL,
+			ChannelId VARCHAR(26) NOT NULL,
+			RootId VARCHAR(26) NOT NULL,
+			Operation VARCHAR(64) NOT NULL,
+			Backend VARCHAR(64) NOT NULL,
+			Model VARCHAR(64) NOT NULL,
+			PostIds MEDIUMTEXT NOT NULL,
+			Content MEDIUMTEXT NOT NULL,
+			INDEX idx_llmsummarize_audit_createat (CreateAt),
+			INDEX idx_llmsummarize_audit_userid (UserId),
+			INDEX idx_llmsummarize_audit_channelid (ChannelId)
+		) DEFAULT CHARACTER SET utf8mb4`,
+		`CREATE TABLE IF NOT EXISTS LLMSummarize_AuditPosts (
+			AuditId VARCHAR(26) NOT NULL,
+			PostId VARCHAR(26) NOT NULL,
+			CreateAt BIGINT NOT NULL,
+			PRIMARY KEY (AuditId, PostId),
+			INDEX idx_llmsummarize_auditposts_postid (PostId),
+			INDEX idx_llmsummarize_auditposts_createat (CreateAt)
+		) DEFAULT CHARACTER SET utf8mb4`,
+		`CREATE TABLE IF NOT EXISTS LLMSummarize_Summaries (
+			Id VARCHAR(64) PRIMARY KEY,
+			ChannelId VARCHAR(26) NOT NULL,
+			Scope VARCHAR(16) NOT NULL,
+			ScopeId VARCHAR(26) NOT NULL,
+			Language VARCHAR(64) NOT NULL,
+			SourceHash VARCHAR(64) NOT NULL,
+			PostCount INTEGER NOT NULL,
+			Model VARCHAR(64) NOT NULL,
+			Summary MEDIUMTEXT NOT NULL,
+			UpdateAt BIGINT NOT NULL,
+			INDEX idx_llmsummarize_summaries_channelid (ChannelId)
+		) DEFAULT CHARACTER SET utf8mb4`,
+		`CREATE TABLE IF NOT EXISTS LLMSummarize_Embeddings (
+			Id VARCHAR(64) PRIMARY KEY,
+			PostId VARCHAR(26) NOT NULL,
+			ChannelId VARCHAR(26) NOT NULL,
+			UserId VARCHAR(26) NOT NULL,
+			ChunkIndex INTEGER NOT NULL,
+			Content MEDIUMTEXT NOT NULL,
+			CreateAt BIGINT NOT NULL,
+			Model VARCHAR(64) NOT NULL,
+			Embedding MEDIUMBLOB NOT NULL,
+			INDEX idx_llmsummarize_embeddings_postid (PostId),
+			INDEX idx_llmsummarize_embeddings_channelid_createat (ChannelId, CreateAt)
+		) DEFAULT CHARACTER SET utf8mb4`,
+	},
+}
+
+func (p *Plugin) migrate() error {
+	driverName := p.pluginAPI.Store.DriverName()
+	statements, ok := migrations[driverName]
+	if !ok {
+		return errors.Errorf("unsupported database driver %s", driverName)
+	}
+
+	for _, statement := range statements {
+		if _, err := p.db.Exec(statement); err != nil {
+			return errors.Wrapf(err, "failed to run migration %q", statement)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStatement is a statement run against a fakeDB.
+type fakeStatement struct {
+	SQL  string
+	Args []driver.Value
+}
+
+// fakeRows is the result of a query run against a fakeDB.
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+	next    int
+}
+
+// fakeDB is a database/sql driver recording the statements it runs. Queries return the rows of
+// the first registered result whose prefix matches, and no rows otherwise.
+type fakeDB struct {
+	mu           sync.Mutex
+	statements   []fakeStatement
+	results      map[string]*fakeRows
+	rowsAffected int64
+	committed    int
+	rolledBack   int
+
+	// foldColumns lower cases the column names, as Postgres does with unquoted identifiers.
+	foldColumns bool
+}
+
+// newFakeDB sets up the plugin to use a fakeDB behind the given driver.
+func newFakeDB(p *Plugin, driverName string) *fakeDB {
+	db := &fakeDB{results: map[string]*fakeRows{}, foldColumns: driverName == model.DatabaseDriverPostgres}
+	p.setDB(sql.OpenDB(db), driverName)
+	return db
+}
+
+func (db *fakeDB) returnRows(prefix string, columns []string, values ...[]driver.Value) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.results[prefix] = &fakeRows{columns: columns, values: values}
+}
+
+// Statements returns the statements run so far starting with prefix.
+func (db *fakeDB) Statements(prefix string) []fakeStatement {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var statements []fakeStatement
+	for _, statement := range db.statements {
+		if strings.HasPrefix(statement.SQL, prefix) {
+			statements = append(statements, statement)
+		}
+	}
+	return statements
+}
+
+func (db *fakeDB) record(query string, args []driver.Value) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.statements = append(db.statements, fakeStatement{SQL: strings.Join(strings.Fields(query), " "), Args: args})
+}
+
+func (db *fakeDB) Connect(context.Context) (driver.Conn, error) { return &fakeConn{db: db}, nil }
+func (db *fakeDB) Driver() driver.Driver                        { return db }
+func (db *fakeDB) Open(string) (driver.Conn, error)             { return &fakeConn{db: db}, nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db: c.db, query: query}, nil
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return c, nil }
+
+func (c *fakeConn) Commit() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.committed++
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.rolledBack++
+	return nil
+}
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.record(s.query, args)
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	return driver.RowsAffected(s.db.rowsAffected), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.record(s.query, args)
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	for prefix, rows := range s.db.results {
+		if strings.HasPrefix(strings.Join(strings.Fields(s.query), " "), prefix) {
+			columns := rows.columns
+			if s.db.foldColumns {
+				columns = make([]string, len(rows.columns))
+				for i, column := range rows.columns {
+					columns[i] = strings.ToLower(column)
+				}
+			}
+			return &fakeRows{columns: columns, values: rows.values}, nil
+		}
+	}
+	return &fakeRows{}, nil
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.values) {
+		return io.EOF
+	}
+	copy(dest, r.values[r.next])
+	r.next++
+	return nil
+}
+
+func TestMigrate(t *testing.T) {
+	for _, driverName := range []string{model.DatabaseDriverPostgres, model.DatabaseDriverMysql} {
+		t.Run(driverName, func(t *testing.T) {
+			p, api, _ := newTestPlugin(t, nil)
+			db := newFakeDB(p, driverName)
+			api.On("GetConfig").Return(&model.Config{SqlSettings: model.SqlSettings{DriverName: model.NewString(driverName)}})
+
+			require.NoError(t, p.migrate())
+			assert.Len(t, db.Statements("CREATE TABLE IF NOT EXISTS LLMSummarize_Audit "), 1)
+			assert.Len(t, db.Statements("CREATE TABLE IF NOT EXISTS LLMSummarize_AuditPosts"), 1)
+			assert.Equal(t, len(migrations[driverName]), len(db.Statements("")), "only the migrations are run")
+		})
+	}
+
+	t.Run("unsupported driver", func(t *testing.T) {
+		p, api, _ := newTestPlugin(t, nil)
+		newFakeDB(p, model.DatabaseDriverPostgres)
+		api.On("GetConfig").Return(&model.Config{SqlSettings: model.SqlSettings{DriverName: model.NewString("sqlite3")}})
+		assert.Error(t, p.migrate())
+	})
+}
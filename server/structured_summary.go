@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const StructuredSummarySystemMessage = `You are a helpful assistant that summarizes threads into a structured report. Given a thread, respond ONLY with a JSON object, without any surrounding text or markdown, that follows this schema:
+
+{
+  "tldr": string, // a summary of the thread using less than 30 words
+  "decisions": [string], // decisions that were agreed on
+  "action_items": [{"description": string, "owner": string, "due_date": string}], // owner is the username responsible or "", due_date is YYYY-MM-DD or ""
+  "open_questions": [string], // questions that were raised and not answered
+  "participants": [string] // usernames of everyone who took part in the thread
+}
+
+Use empty lists when there is nothing to report. Never invent owners, dates or participants that are not in the thread.
+`
+
+type ActionItem struct {
+	Description string `json:"description"`
+	Owner       string `json:"owner"`
+	DueDate     string `json:"due_date"`
+}
+
+// StructuredSummary is the result of summarizing a thread in structured mode.
+type StructuredSummary struct {
+	TLDR          string       `json:"tldr"`
+	Decisions     []string     `json:"decisions"`
+	ActionItems   []ActionItem `json:"action_items"`
+	OpenQuestions []string     `json:"open_questions"`
+	Participants  []string     `json:"participants"`
+}
+
+// parseStructuredSummary decodes and validates the model output. Models tend to wrap JSON in
+// markdown code fences even when asked not to, so those are stripped first.
+func parseStructuredSummary(content string) (*StructuredSummary, error) {
+	content = strings.TrimSpace(content)
+	content = strings.TrimPrefix(content, "```json")
+	content = strings.TrimPrefix(content, "```")
+	content = strings.TrimSuffix(content, "```")
+
+	decoder := json.NewDecoder(strings.NewReader(content))
+	decoder.DisallowUnknownFields()
+
+	var summary StructuredSummary
+	if err := decoder.Decode(&summary); err != nil {
+		return nil, errors.Wrap(err, "response is not valid JSON for the schema")
+	}
+
+	if err := summary.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &summary, nil
+}
+
+func (s *StructuredSummary) Validate() error {
+	if strings.TrimSpace(s.TLDR) == "" {
+		return errors.New("tldr is required")
+	}
+
+	for i, item := range s.ActionItems {
+		if strings.TrimSpace(item.Description) == "" {
+			return errors.Errorf("action_items[%d].description is required", i)
+		}
+		if item.DueDate != "" {
+			if _, err := time.Parse("2006-01-02", item.DueDate); err != nil {
+				return errors.Errorf("action_items[%d].due_date must be formatted as YYYY-MM-DD", i)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ToMarkdown renders the summary as a Mattermost message.
+func (s *StructuredSummary) ToMarkdown() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "**TL;DR:** %s\n", s.TLDR)
+
+	writeList := func(title string, items []string) {
+		if len(items) == 0 {
+			return
+		}
+		fmt.Fprintf(&b, "\n#### %s\n", title)
+		for _, item := range items {
+			fmt.Fprintf(&b, "- %s\n", item)
+		}
+	}
+
+	writeList("Decisions", s.Decisions)
+
+	if len(s.ActionItems) > 0 {
+		b.WriteString("\n#### Action items\n")
+		b.WriteString("| Action | Owner | Due |\n")
+		b.WriteString("| --- | --- | --- |\n")
+		for _, item := range s.ActionItems {
+			owner := "-"
+			if item.Owner != "" {
+				owner = "@" + strings.TrimPrefix(item.Owner, "@")
+			}
+			due := "-"
+			if item.DueDate != "" {
+				due = item.DueDate
+			}
+			fmt.Fprintf(&b, "| %s | %s | %s |\n", escapeTableCell(item.Description), owner, due)
+		}
+	}
+
+	writeList("Open questions", s.OpenQuestions)
+
+	if len(s.Participants) > 0 {
+		participants := make([]string, 0, len(s.Participants))
+		for _, participant := range s.Participants {
+			participants = append(participants, "@"+strings.TrimPrefix(participant, "@"))
+		}
+		fmt.Fprintf(&b, "\n**Participants:** %s\n", strings.Join(participants, ", "))
+	}
+
+	return b.String()
+}
+
+func escapeTableCell(text string) string {
+	text = strings.ReplaceAll(text, "|", "\\|")
+	return strings.ReplaceAll(text, "\n", " ")
+}
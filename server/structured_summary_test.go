@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStructuredSummary(t *testing.T) {
+	summary, err := parseStructuredSummary("```json\n" + `{
+		"tldr": "The deploy was rolled back.",
+		"decisions": ["Roll back to 7.1"],
+		"action_items": [{"description": "Write the postmortem", "owner": "alice", "due_date": "2023-05-12"}],
+		"open_questions": [],
+		"participants": ["alice", "bob"]
+	}` + "\n```")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", summary.ActionItems[0].Owner)
+
+	markdown := summary.ToMarkdown()
+	assert.Contains(t, markdown, "**TL;DR:** The deploy was rolled back.")
+	assert.Contains(t, markdown, "| Write the postmortem | @alice | 2023-05-12 |")
+	assert.Contains(t, markdown, "**Participants:** @alice, @bob")
+	assert.NotContains(t, markdown, "Open questions")
+
+	_, err = parseStructuredSummary(`{"tldr": ""}`)
+	assert.Error(t, err)
+
+	_, err = parseStructuredSummary(`{"tldr": "ok", "action_items": [{"description": "x", "due_date": "next week"}]}`)
+	assert.Error(t, err)
+
+	_, err = parseStructuredSummary(`{"tldr": "ok", "summary": "unexpected"}`)
+	assert.Error(t, err)
+
+	_, err = parseStructuredSummary(`Here is the summary!`)
+	assert.Error(t, err)
+}
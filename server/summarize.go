@@ -2,14 +2,43 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
 
+	"github.com/pkg/errors"
 	openai "github.com/sashabaranov/go-openai"
 )
 
+// TokenUsage is the token consumption of a single completion.
+type TokenUsage struct {
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// UsageHandler is notified of the usage of every successful completion. The context is the one
+// given to the summarizer call.
+type UsageHandler func(ctx context.Context, usage TokenUsage)
+
+// SummarizerInfo identifies the backend and model behind a Summarizer.
+type SummarizerInfo struct {
+	Backend string
+	Model   string
+}
+
 type OpenAISummarizer struct {
 	openaiClient *openai.Client
+	model        string
+	timeout      time.Duration
+	onUsage      UsageHandler
 }
 
+// summaryPromptVersion must be increased whenever the prompts change, so that the thread and day
+// summaries stored for digests are computed again with the new prompts.
+const summaryPromptVersion = 1
+
 const (
 	SummarizeThreadSystemMessage = `You are a helpful assistant that summarizes threads. Given a thread, return a summary of the thread using less than 30 words. Do not refer to the thread, just give the summary. Include who was speaking.
 
@@ -17,24 +46,77 @@ Then answer any questions the user has about the thread. Keep your responses sho
 `
 
 	AnswerThreadQuestionSystemMessage = `You are a helpful assistant that answers questions about threads. Give a short answer that correctly answers questions asked.
+
+Every post of the thread starts with its number in square brackets. Cite the posts that support your answer by their number, like [3] or [2][5]. Only cite posts that exist in the thread.
+`
+
+	SummarizeSummariesSystemMessage = `You are a helpful assistant that writes digests of busy channels. Given summaries of conversations, each preceded by a heading, combine them into a single summary using less than 100 words. Focus on the most important topics and decisions, and include who was involved. Do not refer to the summaries, just give the digest.
+`
+
+	TranslateSystemMessage = `You are a helpful assistant that translates chat messages and summaries. Translate the text given by the user into %s, keeping its meaning, formatting and @mentions untouched. Respond only with the translation.
+`
+
+	TranslateMessagesSystemMessage = `You are a helpful assistant that translates chat messages. The user gives a JSON array of messages. Translate each of them into %s, keeping its meaning, formatting and @mentions untouched. Respond only with a JSON array of strings holding the translations, in the same order and with exactly one element per message.
 `
 )
 
-func NewOpenAISummarizer(apiKey string) *OpenAISummarizer {
+// NewOpenAISummarizer creates a summarizer backed by the chat completions API. The API key is
+// resolved for every request. An empty apiURL uses OpenAI itself.
+func NewOpenAISummarizer(apiKey APIKeyResolver, apiURL string, timeout time.Duration, maxRetries int, onUsage UsageHandler) *OpenAISummarizer {
+	config := openai.DefaultConfig("")
+	if apiURL != "" {
+		config.BaseURL = strings.TrimSuffix(apiURL, "/")
+	}
+	config.HTTPClient = newAuthenticatedClient(apiKey, maxRetries)
+
 	return &OpenAISummarizer{
-		openaiClient: openai.NewClient(apiKey),
+		openaiClient: openai.NewClientWithConfig(config),
+		model:        openai.GPT3Dot5Turbo,
+		timeout:      timeout,
+		onUsage:      onUsage,
 	}
 }
 
-func (s *OpenAISummarizer) SummarizeThread(thread string) (string, error) {
-	resp, err := s.openaiClient.CreateChatCompletion(
-		context.Background(),
+func (s *OpenAISummarizer) Info() SummarizerInfo {
+	return SummarizerInfo{
+		Backend: "openai",
+		Model:   s.model,
+	}
+}
+
+// createChatCompletion bounds the whole completion, retries included, by the configured timeout.
+func (s *OpenAISummarizer) createChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	resp, err := s.openaiClient.CreateChatCompletion(ctx, request)
+	if err != nil {
+		return resp, classifyOpenAIError(err)
+	}
+
+	if s.onUsage != nil {
+		s.onUsage(ctx, TokenUsage{
+			Model:            request.Model,
+			PromptTokens:     resp.Usage.PromptTokens,
+			CompletionTokens: resp.Usage.CompletionTokens,
+		})
+	}
+
+	return resp, nil
+}
+
+func (s *OpenAISummarizer) SummarizeThread(ctx context.Context, thread, language string) (string, error) {
+	resp, err := s.createChatCompletion(
+		ctx,
 		openai.ChatCompletionRequest{
-			Model: openai.GPT3Dot5Turbo,
+			Model: s.model,
 			Messages: []openai.ChatCompletionMessage{
 				{
 					Role:    openai.ChatMessageRoleSystem,
-					Content: SummarizeThreadSystemMessage,
+					Content: SummarizeThreadSystemMessage + languageInstruction(language),
 				},
 				{
 					Role:    openai.ChatMessageRoleUser,
@@ -46,20 +128,19 @@ func (s *OpenAISummarizer) SummarizeThread(thread string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	summary := resp.Choices[0].Message.Content
 
-	return summary, nil
+	return firstChoice(resp)
 }
 
-func (s *OpenAISummarizer) AnswerQuestionOnThread(thread string, question string) (string, error) {
-	resp, err := s.openaiClient.CreateChatCompletion(
-		context.Background(),
+func (s *OpenAISummarizer) AnswerQuestionOnThread(ctx context.Context, thread, question, language string) (string, error) {
+	resp, err := s.createChatCompletion(
+		ctx,
 		openai.ChatCompletionRequest{
-			Model: openai.GPT3Dot5Turbo,
+			Model: s.model,
 			Messages: []openai.ChatCompletionMessage{
 				{
 					Role:    openai.ChatMessageRoleSystem,
-					Content: AnswerThreadQuestionSystemMessage,
+					Content: AnswerThreadQuestionSystemMessage + languageInstruction(language),
 				},
 				{
 					Role:    openai.ChatMessageRoleUser,
@@ -75,7 +156,210 @@ func (s *OpenAISummarizer) AnswerQuestionOnThread(thread string, question string
 	if err != nil {
 		return "", err
 	}
-	summary := resp.Choices[0].Message.Content
 
-	return summary, nil
+	return firstChoice(resp)
+}
+
+// SummarizeThreadStructured asks for a JSON summary following StructuredSummarySystemMessage. The
+// client library in use doesn't support function calling or JSON mode, so the schema is enforced by
+// validating the response and giving the model one chance to correct an invalid answer. Only the
+// values are written in the requested language, the keys of the schema stay untouched.
+func (s *OpenAISummarizer) SummarizeThreadStructured(ctx context.Context, thread, language string) (*StructuredSummary, error) {
+	messages := []openai.ChatCompletionMessage{
+		{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: StructuredSummarySystemMessage + languageInstruction(language),
+		},
+		{
+			Role:    openai.ChatMessageRoleUser,
+			Content: thread,
+		},
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < 2; attempt++ {
+		resp, err := s.createChatCompletion(
+			ctx,
+			openai.ChatCompletionRequest{
+				Model:       s.model,
+				Messages:    messages,
+				Temperature: 0,
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+		content, err := firstChoice(resp)
+		if err != nil {
+			return nil, err
+		}
+
+		summary, err := parseStructuredSummary(content)
+		if err == nil {
+			return summary, nil
+		}
+		lastErr = err
+
+		messages = append(messages,
+			openai.ChatCompletionMessage{
+				Role:    openai.ChatMessageRoleAssistant,
+				Content: content,
+			},
+			openai.ChatCompletionMessage{
+				Role:    openai.ChatMessageRoleUser,
+				Content: "That response is invalid: " + err.Error() + ". Respond again with only the corrected JSON object.",
+			},
+		)
+	}
+
+	return nil, errors.Wrap(lastErr, "model did not return a valid structured summary")
+}
+
+// SummarizeSummaries combines summaries of threads or days into a digest, so large channels can
+// be summarized hierarchically without sending every post at once.
+func (s *OpenAISummarizer) SummarizeSummaries(ctx context.Context, summaries, language string) (string, error) {
+	resp, err := s.createChatCompletion(
+		ctx,
+		openai.ChatCompletionRequest{
+			Model: s.model,
+			Messages: []openai.ChatCompletionMessage{
+				{
+					Role:    openai.ChatMessageRoleSystem,
+					Content: SummarizeSummariesSystemMessage + languageInstruction(language),
+				},
+				{
+					Role:    openai.ChatMessageRoleUser,
+					Content: summaries,
+				},
+			},
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return firstChoice(resp)
+}
+
+// Translate translates a single post, or a summary that was already generated so it doesn't need
+// to be computed again from the thread.
+func (s *OpenAISummarizer) Translate(ctx context.Context, text, language string) (string, error) {
+	resp, err := s.createChatCompletion(
+		ctx,
+		openai.ChatCompletionRequest{
+			Model: s.model,
+			Messages: []openai.ChatCompletionMessage{
+				{
+					Role:    openai.ChatMessageRoleSystem,
+					Content: fmt.Sprintf(TranslateSystemMessage, language),
+				},
+				{
+					Role:    openai.ChatMessageRoleUser,
+					Content: text,
+				},
+			},
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return firstChoice(resp)
+}
+
+// TranslateMessages translates several posts in a single completion, returning the translations
+// in the same order. Like SummarizeThreadStructured, the model gets one chance to correct a
+// response that isn't an array of the expected length.
+func (s *OpenAISummarizer) TranslateMessages(ctx context.Context, texts []string, language string) ([]string, error) {
+	encoded, err := json.Marshal(texts)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []openai.ChatCompletionMessage{
+		{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: fmt.Sprintf(TranslateMessagesSystemMessage, language),
+		},
+		{
+			Role:    openai.ChatMessageRoleUser,
+			Content: string(encoded),
+		},
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < 2; attempt++ {
+		resp, err := s.createChatCompletion(
+			ctx,
+			openai.ChatCompletionRequest{
+				Model:       s.model,
+				Messages:    messages,
+				Temperature: 0,
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+		content, err := firstChoice(resp)
+		if err != nil {
+			return nil, err
+		}
+
+		translations, err := parseTranslations(content, len(texts))
+		if err == nil {
+			return translations, nil
+		}
+		lastErr = err
+
+		messages = append(messages,
+			openai.ChatCompletionMessage{
+				Role:    openai.ChatMessageRoleAssistant,
+				Content: content,
+			},
+			openai.ChatCompletionMessage{
+				Role:    openai.ChatMessageRoleUser,
+				Content: "That response is invalid: " + err.Error() + ". Respond again with only the corrected JSON array.",
+			},
+		)
+	}
+
+	return nil, errors.Wrap(lastErr, "model did not return valid translations")
+}
+
+func parseTranslations(content string, expected int) ([]string, error) {
+	content = strings.TrimSpace(content)
+	content = strings.TrimPrefix(content, "```json")
+	content = strings.TrimPrefix(content, "```")
+	content = strings.TrimSuffix(content, "```")
+
+	var translations []string
+	if err := json.Unmarshal([]byte(content), &translations); err != nil {
+		return nil, errors.Wrap(err, "response is not a JSON array of strings")
+	}
+	if len(translations) != expected {
+		return nil, errors.Errorf("expected %d translations, got %d", expected, len(translations))
+	}
+
+	return translations, nil
+}
+
+// CheckHealth sends the cheapest possible completion to check the credentials and the model. The
+// check is not charged to anyone's quota.
+func (s *OpenAISummarizer) CheckHealth(ctx context.Context) *HealthStatus {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	timer := NewTimer("health_check")
+	_, err := s.openaiClient.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model:     s.model,
+		MaxTokens: 1,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: "ping",
+			},
+		},
+	})
+
+	return newHealthStatus(s.Info(), timer.Finish(), classifyOpenAIError(err))
 }
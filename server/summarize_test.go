@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAISummarizer(t *testing.T) {
+	t.Run("summarize thread", func(t *testing.T) {
+		standIn := newOpenAIStandIn(t, "summarize_thread")
+		usages := []TokenUsage{}
+		summarizer := NewOpenAISummarizer(staticAPIKey("test-key"), standIn.APIURL(), time.Second, 0, func(ctx context.Context, usage TokenUsage) {
+			usages = append(usages, usage)
+		})
+
+		summary, err := summarizer.SummarizeThread(context.Background(), "[1] alice: ship it friday?\n\n[2] bob: ok\n\n", "Spanish")
+		require.NoError(t, err)
+		assert.Equal(t, "@alice proposed shipping the importer on Friday and @bob agreed.", summary)
+		assert.Equal(t, []TokenUsage{{Model: openai.GPT3Dot5Turbo, PromptTokens: 120, CompletionTokens: 16}}, usages)
+
+		requests := standIn.Requests()
+		require.Len(t, requests, 1)
+		require.Len(t, requests[0].Messages, 2)
+		assert.Contains(t, requests[0].Messages[0].Content, "Write your response in Spanish")
+		assert.Equal(t, "[1] alice: ship it friday?\n\n[2] bob: ok\n\n", requests[0].Messages[1].Content)
+	})
+
+	t.Run("structured summary", func(t *testing.T) {
+		standIn := newOpenAIStandIn(t, "summarize_thread_structured")
+		summarizer := NewOpenAISummarizer(staticAPIKey("test-key"), standIn.APIURL(), time.Second, 0, nil)
+
+		summary, err := summarizer.SummarizeThreadStructured(context.Background(), "[1] alice: ship it friday?\n\n", "")
+		require.NoError(t, err)
+		assert.Equal(t, "The importer ships on Friday.", summary.TLDR)
+		assert.Equal(t, []ActionItem{{Description: "Write the release notes", Owner: "@bob"}}, summary.ActionItems)
+		assert.Len(t, standIn.Requests(), 1)
+	})
+
+	t.Run("question", func(t *testing.T) {
+		standIn := newOpenAIStandIn(t, "answer_question")
+		summarizer := NewOpenAISummarizer(staticAPIKey("test-key"), standIn.APIURL(), time.Second, 0, nil)
+
+		answer, err := summarizer.AnswerQuestionOnThread(context.Background(), "[1] alice: ship it friday?\n\n", "when?", "")
+		require.NoError(t, err)
+		assert.Equal(t, "On Friday [1][2].", answer)
+
+		requests := standIn.Requests()
+		require.Len(t, requests, 1)
+		require.Len(t, requests[0].Messages, 3)
+		assert.Equal(t, "when?", requests[0].Messages[2].Content)
+	})
+
+	t.Run("translate messages", func(t *testing.T) {
+		standIn := newOpenAIStandIn(t, "translate_messages_short", "translate_messages")
+		summarizer := NewOpenAISummarizer(staticAPIKey("test-key"), standIn.APIURL(), time.Second, 0, nil)
+
+		translations, err := summarizer.TranslateMessages(context.Background(), []string{"¿Enviamos el importador el viernes, @user_1?", "Me parece bien"}, "English")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Shall we ship the importer on Friday, @user_1?", "Fine by me"}, translations)
+
+		// The response with a missing translation is corrected once.
+		requests := standIn.Requests()
+		require.Len(t, requests, 2)
+		assert.Contains(t, requests[0].Messages[0].Content, "into English")
+		assert.Equal(t, `["¿Enviamos el importador el viernes, @user_1?","Me parece bien"]`, requests[0].Messages[1].Content)
+		require.Len(t, requests[1].Messages, 4)
+		assert.Contains(t, requests[1].Messages[3].Content, "expected 2 translations, got 1")
+	})
+
+	t.Run("invalid api key", func(t *testing.T) {
+		standIn := newOpenAIStandIn(t, "invalid_api_key")
+		summarizer := NewOpenAISummarizer(staticAPIKey("sk-test"), standIn.APIURL(), time.Second, 2, nil)
+
+		_, err := summarizer.SummarizeThread(context.Background(), "[1] alice: hi\n\n", "")
+		var llmErr *LLMError
+		require.True(t, errors.As(err, &llmErr), "unexpected error %v", err)
+		assert.Equal(t, LLMErrorAuth, llmErr.Kind)
+		// Authentication failures are not retried.
+		assert.Len(t, standIn.Requests(), 1)
+	})
+}
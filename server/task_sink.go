@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	pluginapi "github.com/mattermost/mattermost-plugin-api"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+
+	root "github.com/mattermost/mattermost-plugin-starter-template"
+)
+
+const (
+	TaskSinkReminders = "reminders"
+	TaskSinkTracker   = "tracker"
+
+	webhookTimeout = 10 * time.Second
+
+	// actionItemsSigningKeyKey holds the secret signing the context of the action item buttons.
+	actionItemsSigningKeyKey = "action_items_signing_key"
+
+	// actionItemsUsedKeyPrefix marks the buttons that were already clicked.
+	actionItemsUsedKeyPrefix = "actions_used_"
+)
+
+// TaskContext describes where a set of action items came from.
+type TaskContext struct {
+	RequestedBy string `json:"requested_by"`
+	TeamID      string `json:"team_id"`
+	ChannelID   string `json:"channel_id"`
+	RootID      string `json:"root_id,omitempty"`
+}
+
+// TaskSink receives the action items extracted from a structured summary.
+type TaskSink interface {
+	PushActionItems(taskContext TaskContext, items []ActionItem) (string, error)
+}
+
+// NoopTaskSink discards every action item. It is used when no external tracker is configured.
+type NoopTaskSink struct{}
+
+func (NoopTaskSink) PushActionItems(taskContext TaskContext, items []ActionItem) (string, error) {
+	return "No task tracker is configured, the action items were not sent anywhere.", nil
+}
+
+// WebhookTaskSink sends the action items as JSON to an external tracker. When a secret is
+// configured the body is signed with HMAC-SHA256 in the X-Summarize-Signature header.
+type WebhookTaskSink struct {
+	URL        string
+	Secret     string
+	HTTPClient *http.Client
+}
+
+type webhookPayload struct {
+	Source  string       `json:"source"`
+	Context TaskContext  `json:"context"`
+	Items   []ActionItem `json:"items"`
+}
+
+func (s *WebhookTaskSink) PushActionItems(taskContext TaskContext, items []ActionItem) (string, error) {
+	body, err := json.Marshal(webhookPayload{
+		Source:  "mattermost-summarize",
+		Context: taskContext,
+		Items:   items,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if s.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(s.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Summarize-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	client := s.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to reach the task tracker")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", errors.Errorf("task tracker responded with status %d", resp.StatusCode)
+	}
+
+	return "Sent the action items to the task tracker.", nil
+}
+
+func (p *Plugin) getTaskSink(name string) (TaskSink, error) {
+	switch name {
+	case TaskSinkReminders:
+		return &ReminderTaskSink{plugin: p}, nil
+	case TaskSinkTracker:
+		config := p.getConfiguration()
+		if config.TaskWebhookURL == "" {
+			return NoopTaskSink{}, nil
+		}
+		return &WebhookTaskSink{
+			URL:    config.TaskWebhookURL,
+			Secret: config.TaskWebhookSecret,
+		}, nil
+	}
+
+	return nil, errors.Errorf("unknown task sink %q", name)
+}
+
+// actionItemsSigningKey returns the secret signing the action item buttons, generating it the
+// first time. Only the first node to store it wins, so every node of a cluster shares it.
+func (p *Plugin) actionItemsSigningKey() ([]byte, error) {
+	var key []byte
+	if err := p.pluginAPI.KV.Get(actionItemsSigningKeyKey, &key); err != nil {
+		return nil, errors.Wrap(err, "failed to get the action items signing key")
+	}
+	if len(key) > 0 {
+		return key, nil
+	}
+
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, errors.Wrap(err, "failed to generate the action items signing key")
+	}
+	if _, err := p.pluginAPI.KV.Set(actionItemsSigningKeyKey, key, pluginapi.SetAtomic(nil)); err != nil {
+		return nil, errors.Wrap(err, "failed to store the action items signing key")
+	}
+
+	// Another node may have stored its key first.
+	key = nil
+	if err := p.pluginAPI.KV.Get(actionItemsSigningKeyKey, &key); err != nil {
+		return nil, errors.Wrap(err, "failed to get the action items signing key")
+	}
+	if len(key) == 0 {
+		return nil, errors.New("the action items signing key is missing")
+	}
+
+	return key, nil
+}
+
+// signActionItems authenticates the action items along with who requested them and where, so the
+// buttons can't be replayed with other items, in another channel or by another user.
+func (p *Plugin) signActionItems(taskContext TaskContext, items string) (string, error) {
+	key, err := p.actionItemsSigningKey()
+	if err != nil {
+		return "", err
+	}
+
+	encodedContext, err := json.Marshal(taskContext)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(encodedContext)
+	mac.Write([]byte{0})
+	mac.Write([]byte(items))
+
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyActionItems returns the task context and the action items of a button, failing when its
+// context wasn't signed by this plugin.
+func (p *Plugin) verifyActionItems(integrationContext map[string]interface{}) (TaskContext, []ActionItem, error) {
+	value := func(key string) string {
+		s, _ := integrationContext[key].(string)
+		return s
+	}
+
+	taskContext := TaskContext{
+		RequestedBy: value("requested_by"),
+		ChannelID:   value("channel_id"),
+		RootID:      value("root_id"),
+	}
+	items := value("items")
+
+	expected, err := p.signActionItems(taskContext, items)
+	if err != nil {
+		return TaskContext{}, nil, err
+	}
+	if !hmac.Equal([]byte(expected), []byte(value("signature"))) {
+		return TaskContext{}, nil, errors.New("invalid signature")
+	}
+
+	var actionItems []ActionItem
+	if err := json.Unmarshal([]byte(items), &actionItems); err != nil {
+		return TaskContext{}, nil, errors.Wrap(err, "failed to decode action items")
+	}
+
+	return taskContext, actionItems, nil
+}
+
+func actionItemsUsedKey(sink, signature string) string {
+	hash := sha256.Sum256([]byte(sink + "\x00" + signature))
+	return actionItemsUsedKeyPrefix + hex.EncodeToString(hash[:16])
+}
+
+// claimActionItems marks the button of the sink for the signed action items as used, reporting
+// false when it already was. The atomic write makes sure a button only fires once, even when
+// clicked on several nodes at the same time.
+func (p *Plugin) claimActionItems(sink, signature string) (bool, error) {
+	claimed, err := p.pluginAPI.KV.Set(actionItemsUsedKey(sink, signature), model.GetMillis(), pluginapi.SetAtomic(nil))
+	if err != nil {
+		return false, errors.Wrap(err, "failed to mark the action items as used")
+	}
+
+	return claimed, nil
+}
+
+// releaseActionItems lets a button be clicked again after its action items failed to be pushed.
+func (p *Plugin) releaseActionItems(sink, signature string) error {
+	return p.pluginAPI.KV.Delete(actionItemsUsedKey(sink, signature))
+}
+
+// actionItemsAttachments returns the buttons that let the requester push the action items of a
+// structured summary to a task sink. Their context is signed, see verifyActionItems.
+func (p *Plugin) actionItemsAttachments(summary *StructuredSummary, taskContext TaskContext) []*model.SlackAttachment {
+	if len(summary.ActionItems) == 0 {
+		return nil
+	}
+
+	items, err := json.Marshal(summary.ActionItems)
+	if err != nil {
+		p.API.LogError("Failed to encode action items", "error", err.Error())
+		return nil
+	}
+
+	signature, err := p.signActionItems(taskContext, string(items))
+	if err != nil {
+		p.API.LogError("Failed to sign action items", "error", err.Error())
+		return nil
+	}
+
+	action := func(name, sink string) *model.PostAction {
+		return &model.PostAction{
+			Name: name,
+			Integration: &model.PostActionIntegration{
+				URL: fmt.Sprintf("/plugins/%s/api/v1/actions/action-items", root.Manifest.Id),
+				Context: map[string]interface{}{
+					"sink":         sink,
+					"items":        string(items),
+					"requested_by": taskContext.RequestedBy,
+					"channel_id":   taskContext.ChannelID,
+					"root_id":      taskContext.RootID,
+					"signature":    signature,
+				},
+			},
+		}
+	}
+
+	actions := []*model.PostAction{action("Create reminders", TaskSinkReminders)}
+	if p.getConfiguration().TaskWebhookURL != "" {
+		actions = append(actions, action("Send to task tracker", TaskSinkTracker))
+	}
+
+	return []*model.SlackAttachment{{
+		Text:    fmt.Sprintf("%d action items found.", len(summary.ActionItems)),
+		Actions: actions,
+	}}
+}
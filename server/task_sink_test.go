@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookTaskSink(t *testing.T) {
+	var received webhookPayload
+	var signature string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get("X-Summarize-Signature")
+		body, _ = io.ReadAll(r.Body)
+		_ = json.Unmarshal(body, &received)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	sink := &WebhookTaskSink{URL: server.URL, Secret: "secret"}
+	items := []ActionItem{{Description: "Write the postmortem", Owner: "alice", DueDate: "2023-05-12"}}
+
+	_, err := sink.PushActionItems(TaskContext{RequestedBy: "user1", ChannelID: "channel1"}, items)
+	require.NoError(t, err)
+
+	assert.Equal(t, items, received.Items)
+	assert.Equal(t, "channel1", received.Context.ChannelID)
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), signature)
+}
+
+func TestWebhookTaskSinkError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	sink := &WebhookTaskSink{URL: server.URL}
+	_, err := sink.PushActionItems(TaskContext{}, []ActionItem{{Description: "x"}})
+	assert.Error(t, err)
+}
+
+func mockSigningKey(api *plugintest.API) {
+	api.On("KVGet", actionItemsSigningKeyKey).Return([]byte("0123456789abcdef0123456789abcdef"), nil)
+}
+
+func TestReminderTaskSink(t *testing.T) {
+	p, api, _ := newTestPlugin(t, nil)
+	p.botid = "botbotbotbotbotbotbotbotb1"
+	api.On("GetUserByUsername", "alice").Return(&model.User{Id: testUserID, Username: "alice"}, nil)
+	api.On("GetUserByUsername", "bob").Return(&model.User{Id: testOtherID, Username: "bob"}, nil)
+	api.On("GetUserByUsername", "ghost").Return(nil, model.NewAppError("GetUserByUsername", "not_found", nil, "", http.StatusNotFound))
+	api.On("HasPermissionToChannel", testUserID, testChannelID, model.PermissionReadChannel).Return(true)
+	api.On("HasPermissionToChannel", testOtherID, testChannelID, model.PermissionReadChannel).Return(false)
+	api.On("GetConfig").Return(&model.Config{ServiceSettings: model.ServiceSettings{SiteURL: model.NewString("https://chat.example.com")}})
+	api.On("GetDirectChannel", p.botid, testUserID).Return(&model.Channel{Id: "dmdmdmdmdmdmdmdmdmdmdmdmd1"}, nil)
+	api.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+		return post.ChannelId == "dmdmdmdmdmdmdmdmdmdmdmdmd1" && post.UserId == p.botid &&
+			strings.Contains(post.Message, "**Write the postmortem**") &&
+			strings.Contains(post.Message, "https://chat.example.com/_redirect/pl/"+testRootID)
+	})).Return(&model.Post{}, nil).Once()
+
+	sink := &ReminderTaskSink{plugin: p}
+	result, err := sink.PushActionItems(TaskContext{RequestedBy: testUserID, ChannelID: testChannelID, RootID: testRootID}, []ActionItem{
+		{Description: "Write the postmortem", Owner: "@alice"},
+		{Description: "Not a member", Owner: "bob"},
+		{Description: "Unknown owner", Owner: "ghost"},
+		{Description: "No owner"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Created reminders for 1 action items. Skipped 3 without a known owner in this channel: Not a member; Unknown owner; No owner", result)
+}
+
+func TestHandleActionItems(t *testing.T) {
+	taskContext := TaskContext{RequestedBy: testUserID, ChannelID: testChannelID, RootID: testRootID}
+	summary := &StructuredSummary{ActionItems: []ActionItem{{Description: "Write the postmortem", Owner: "ghost"}}}
+
+	newButtonContext := func(t *testing.T, p *Plugin) map[string]interface{} {
+		attachments := p.actionItemsAttachments(summary, taskContext)
+		require.Len(t, attachments, 1)
+		require.NotEmpty(t, attachments[0].Actions)
+		return attachments[0].Actions[0].Integration.Context
+	}
+
+	post := func(p *Plugin, userID string, buttonContext map[string]interface{}) (int, string) {
+		body, err := json.Marshal(&model.PostActionIntegrationRequest{UserId: userID, Context: buttonContext})
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/actions/action-items", bytes.NewReader(body))
+		r.Header.Set("Mattermost-User-ID", userID)
+		p.ServeHTTP(nil, w, r)
+
+		response := &model.PostActionIntegrationResponse{}
+		_ = json.Unmarshal(w.Body.Bytes(), response)
+		return w.Code, response.EphemeralText
+	}
+
+	t.Run("signed action items", func(t *testing.T) {
+		p, api, _ := newTestPlugin(t, nil)
+		mockSigningKey(api)
+		mockChannel(api, model.ChannelTypeOpen)
+		api.On("HasPermissionToChannel", testUserID, testChannelID, model.PermissionReadChannel).Return(true)
+		api.On("GetUserByUsername", "ghost").Return(nil, model.NewAppError("GetUserByUsername", "not_found", nil, "", http.StatusNotFound))
+
+		mockKVStore(api, actionItemsUsedKeyPrefix)
+
+		buttonContext := newButtonContext(t, p)
+		status, text := post(p, testUserID, buttonContext)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "Created reminders for 0 action items. Skipped 1 without a known owner in this channel: Write the postmortem", text)
+
+		// The button only fires once.
+		status, text = post(p, testUserID, buttonContext)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "These action items were already sent.", text)
+		api.AssertNumberOfCalls(t, "GetUserByUsername", 1)
+	})
+
+	t.Run("a failed push can be retried", func(t *testing.T) {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+			}
+		}))
+		defer server.Close()
+
+		p, api, _ := newTestPlugin(t, &configuration{TaskWebhookURL: server.URL})
+		mockSigningKey(api)
+		mockChannel(api, model.ChannelTypeOpen)
+		api.On("HasPermissionToChannel", testUserID, testChannelID, model.PermissionReadChannel).Return(true)
+		api.On("LogError", "Failed to push action items", "sink", TaskSinkTracker, "error", "task tracker responded with status 502").Once()
+		mockKVStore(api, actionItemsUsedKeyPrefix)
+
+		attachments := p.actionItemsAttachments(summary, taskContext)
+		require.Len(t, attachments[0].Actions, 2)
+		buttonContext := attachments[0].Actions[1].Integration.Context
+
+		_, text := post(p, testUserID, buttonContext)
+		assert.Equal(t, "Failed to process the action items: task tracker responded with status 502", text)
+		_, text = post(p, testUserID, buttonContext)
+		assert.Equal(t, "Sent the action items to the task tracker.", text)
+		_, text = post(p, testUserID, buttonContext)
+		assert.Equal(t, "These action items were already sent.", text)
+		assert.Equal(t, 2, requests)
+	})
+
+	t.Run("forged action items", func(t *testing.T) {
+		p, api, _ := newTestPlugin(t, nil)
+		mockSigningKey(api)
+
+		for name, tamper := range map[string]func(map[string]interface{}){
+			"items":     func(c map[string]interface{}) { c["items"] = `[{"description": "Spam", "owner": "everyone"}]` },
+			"channel":   func(c map[string]interface{}) { c["channel_id"] = "otherchannelotherchannel1" },
+			"signature": func(c map[string]interface{}) { delete(c, "signature") },
+		} {
+			buttonContext := newButtonContext(t, p)
+			tamper(buttonContext)
+			status, _ := post(p, testUserID, buttonContext)
+			assert.Equal(t, http.StatusForbidden, status, name)
+		}
+	})
+
+	t.Run("another user", func(t *testing.T) {
+		p, api, _ := newTestPlugin(t, nil)
+		mockSigningKey(api)
+
+		status, _ := post(p, testOtherID, newButtonContext(t, p))
+		assert.Equal(t, http.StatusForbidden, status)
+	})
+
+	t.Run("no longer in the channel", func(t *testing.T) {
+		p, api, _ := newTestPlugin(t, nil)
+		mockSigningKey(api)
+		api.On("HasPermissionToChannel", testUserID, testChannelID, model.PermissionReadChannel).Return(false)
+
+		status, _ := post(p, testUserID, newButtonContext(t, p))
+		assert.Equal(t, http.StatusForbidden, status)
+	})
+
+	t.Run("channel policy keeps results private", func(t *testing.T) {
+		p, api, _ := newTestPlugin(t, nil)
+		mockSigningKey(api)
+		api.On("KVGet", channelPolicyKeyPrefix+testChannelID).Return([]byte(`{"mode": "no-public-posts"}`), nil)
+		mockChannel(api, model.ChannelTypeOpen)
+		api.On("HasPermissionToChannel", testUserID, testChannelID, model.PermissionReadChannel).Return(true)
+
+		status, text := post(p, testUserID, newButtonContext(t, p))
+		assert.Equal(t, http.StatusOK, status)
+		assert.Contains(t, text, "doesn't allow sharing summary results")
+	})
+}
@@ -1,20 +1,20 @@
 package main
 
 import (
-	"fmt"
 	"time"
 )
 
+// Timer measures the duration of an operation.
 type Timer struct {
 	start   time.Time
 	subject string
 }
 
 func NewTimer(subject string) *Timer {
-	fmt.Println("Starting " + subject)
 	return &Timer{start: time.Now(), subject: subject}
 }
 
-func (t *Timer) Finish() {
-	fmt.Printf("Done "+t.subject+"! Time taken: %v\n", time.Since(t.start))
+// Finish returns the time elapsed since the timer was started.
+func (t *Timer) Finish() time.Duration {
+	return time.Since(t.start)
 }
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	pluginapi "github.com/mattermost/mattermost-plugin-api"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	translationKeyPrefix = "tr_"
+	translationCacheTTL  = 30 * 24 * time.Hour
+
+	// maxTranslatedPosts bounds the backend requests of a single translation, as the recent posts
+	// of a busy channel can number in the hundreds. Only the most recent ones are translated.
+	maxTranslatedPosts = 100
+	// Posts are translated in batches of at most translationBatchSize posts and, unless a single
+	// post is longer, translationBatchLength characters, so the translations fit in a completion.
+	translationBatchSize   = 20
+	translationBatchLength = 4000
+)
+
+// PostTranslation is the translation of a single post.
+type PostTranslation struct {
+	PostID   string `json:"post_id"`
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
+	Message  string `json:"message"`
+}
+
+// cachedTranslation is stored in the KV store. EditAt invalidates the translation once the post
+// is edited.
+type cachedTranslation struct {
+	Message string
+	EditAt  int64
+}
+
+// translationKey fits the language, which may be a free-form name, within the KV key length limit.
+func translationKey(postID, language string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(language)))
+	return translationKeyPrefix + postID + "_" + hex.EncodeToString(sum[:])[:8]
+}
+
+// translatePosts translates the posts of the thread into the given language, preserving their
+// order. Only the last maxTranslatedPosts are translated, and only the posts without a cached
+// translation are sent to the summarizer, in batches.
+func (p *Plugin) translatePosts(ctx context.Context, rootID string, data *ThreadData, language string) ([]PostTranslation, error) {
+	redactor := p.newRedactor()
+	redactor.Redact(data)
+
+	posts := data.Posts
+	if len(posts) > maxTranslatedPosts {
+		posts = posts[len(posts)-maxTranslatedPosts:]
+	}
+
+	translations := make([]PostTranslation, len(posts))
+	pending := &ThreadData{UsersByID: data.UsersByID}
+	for i, post := range posts {
+		translations[i] = PostTranslation{
+			PostID:   post.Id,
+			UserID:   post.UserId,
+			Username: data.UsersByID[post.UserId].Username,
+		}
+
+		var cached *cachedTranslation
+		if err := p.pluginAPI.KV.Get(translationKey(post.Id, language), &cached); err != nil {
+			return nil, errors.Wrap(err, "failed to get cached translation")
+		}
+		if cached != nil && cached.EditAt == post.EditAt {
+			translations[i].Message = cached.Message
+			continue
+		}
+
+		pending.Posts = append(pending.Posts, post)
+	}
+
+	if len(pending.Posts) == 0 {
+		return translations, nil
+	}
+
+	redactedMessages := make([]string, len(pending.Posts))
+	for i, post := range pending.Posts {
+		redactedMessages[i] = redactor.RedactText(post.Message)
+	}
+	p.auditSummarization(ctx, AuditOperationTranslate, rootID, pending, strings.Join(redactedMessages, "\n\n"))
+
+	// Each batch is checked against the limits of the user, and cached as soon as it is
+	// translated so a request stopped by a limit doesn't lose the batches already paid for.
+	translated := map[string]string{}
+	for _, batch := range translationBatches(redactedMessages) {
+		messages, err := p.getSummarizer().TranslateMessages(ctx, redactedMessages[batch.start:batch.end], language)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, message := range messages {
+			post := pending.Posts[batch.start+i]
+			message = redactor.Restore(message)
+			translated[post.Id] = message
+
+			cached := &cachedTranslation{Message: message, EditAt: post.EditAt}
+			if _, err := p.pluginAPI.KV.Set(translationKey(post.Id, language), cached, pluginapi.SetExpiry(translationCacheTTL)); err != nil {
+				p.API.LogWarn("Failed to cache translation", "post_id", post.Id, "error", err.Error())
+			}
+		}
+	}
+
+	for i := range translations {
+		if message, ok := translated[translations[i].PostID]; ok {
+			translations[i].Message = message
+		}
+	}
+
+	return translations, nil
+}
+
+type translationBatch struct {
+	start, end int
+}
+
+// translationBatches splits the messages into the batches sent to the summarizer together.
+func translationBatches(messages []string) []translationBatch {
+	batches := []translationBatch{}
+	start, length := 0, 0
+	for i, message := range messages {
+		if i > start && (i-start == translationBatchSize || length+len(message) > translationBatchLength) {
+			batches = append(batches, translationBatch{start, i})
+			start, length = i, 0
+		}
+		length += len(message)
+	}
+	if start < len(messages) {
+		batches = append(batches, translationBatch{start, len(messages)})
+	}
+
+	return batches
+}
+
+// formatTranslations renders the translated posts the same way the thread is shown to the model,
+// one post per paragraph prefixed by its author.
+func formatTranslations(translations []PostTranslation, language string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "#### Translation into %s\n\n", language)
+	for _, translation := range translations {
+		fmt.Fprintf(&sb, "**@%s**: %s\n\n", translation.Username, translation.Message)
+	}
+
+	return strings.TrimSpace(sb.String())
+}
+
+// executeTranslateCommand translates the thread, or the recent posts of the channel, into the
+// language given as parameter or the locale of the user.
+func (p *Plugin) executeTranslateCommand(args *model.CommandArgs, params []string) (*model.CommandResponse, error) {
+	channel, err := p.pluginAPI.Channel.Get(args.ChannelId)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = p.checkChannelPolicy(channel); err != nil {
+		return ephemeralResponse(args, err.Error()), nil
+	}
+
+	language := p.resolveLanguage(args.UserId, strings.Join(params, " "))
+	if language == "" {
+		return ephemeralResponse(args, "Usage: `/summarize translate [language]`"), nil
+	}
+
+	if err = p.checkLimits(args.UserId, args.TeamId); err != nil {
+		var limitErr *LimitExceededError
+		if errors.As(err, &limitErr) {
+			return ephemeralResponse(args, limitErr.Error()), nil
+		}
+		return nil, err
+	}
+
+	filters := &SummaryFilters{}
+	data, err := p.getContextData(args, filters)
+	if err != nil {
+		return nil, err
+	}
+	if len(data.Posts) == 0 {
+		return ephemeralResponse(args, "There are no posts to translate."), nil
+	}
+
+	ctx := withRequestInfo(context.Background(), RequestInfo{
+		UserID:    args.UserId,
+		TeamID:    args.TeamId,
+		ChannelID: args.ChannelId,
+	})
+
+	translations, err := p.translatePosts(ctx, args.RootId, data, language)
+	if err != nil {
+		var llmErr *LLMError
+		var limitErr *LimitExceededError
+		if errors.As(err, &llmErr) || errors.As(err, &limitErr) {
+			_, message := p.handleLLMError(err, "user_id", args.UserId, "channel_id", args.ChannelId)
+			return ephemeralResponse(args, message), nil
+		}
+		return nil, err
+	}
+
+	result := formatTranslations(translations, language)
+	if len(data.Posts) > maxTranslatedPosts {
+		result += fmt.Sprintf("\n\n_Only the last %d of %d posts were translated._", maxTranslatedPosts, len(data.Posts))
+	}
+
+	return ephemeralResponse(args, result), nil
+}
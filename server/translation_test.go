@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTranslationKey(t *testing.T) {
+	postID := "abcdefghijklmnopqrstuvwxyz"
+
+	assert.Equal(t, translationKey(postID, "Spanish"), translationKey(postID, "spanish"))
+	assert.NotEqual(t, translationKey(postID, "Spanish"), translationKey(postID, "French"))
+	assert.LessOrEqual(t, len(translationKey(postID, "Brazilian Portuguese")), 50)
+}
+
+func TestFormatTranslations(t *testing.T) {
+	result := formatTranslations([]PostTranslation{
+		{PostID: "1", Username: "alice", Message: "Hola"},
+		{PostID: "2", Username: "bob", Message: "¿Qué tal?"},
+	}, "Spanish")
+
+	assert.Equal(t, "#### Translation into Spanish\n\n**@alice**: Hola\n\n**@bob**: ¿Qué tal?", result)
+}
+
+func TestHandleTranslateSummary(t *testing.T) {
+	request := func(p *Plugin, postID, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/post/"+postID+"/summary/translate", strings.NewReader(body))
+		r.Header.Set("Mattermost-User-ID", testUserID)
+		p.ServeHTTP(nil, w, r)
+		return w
+	}
+
+	t.Run("the summary is redacted and audited like the thread", func(t *testing.T) {
+		p, api, summarizer := newTestPlugin(t, &configuration{PseudonymizeUsernames: true, RedactBuiltinPatterns: true, AuditIncludeContent: true})
+		db := newFakeDB(p, model.DatabaseDriverPostgres)
+		api.On("GetPost", testRootID).Return(&model.Post{Id: testRootID, ChannelId: testChannelID}, nil)
+		api.On("HasPermissionToChannel", testUserID, testChannelID, model.PermissionReadChannel).Return(true)
+		mockChannel(api, model.ChannelTypeOpen)
+		mockThread(api)
+
+		w := request(p, testRootID, `{"summary": "@alice asks @bob to mail ops@example.com", "language": "fr"}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, "[French] @alice asks @bob to mail [EMAIL]", response["result"])
+		assert.Equal(t, testRootID, response["root_id"])
+		assert.Equal(t, []string{"Translate"}, summarizer.Calls())
+
+		entries := db.Statements("INSERT INTO LLMSummarize_Audit ")
+		require.Len(t, entries, 1)
+		sent := "@" + pseudonym(testUserID) + " asks @" + pseudonym(testOtherID) + " to mail [EMAIL]"
+		assert.Contains(t, entries[0].Args, driver.Value(sent), "only the redacted summary is sent")
+		assert.Contains(t, entries[0].Args, driver.Value(AuditOperationTranslate))
+		assert.Contains(t, entries[0].Args, driver.Value(`["`+testRootID+`","replyreplyreplyreplyreply1"]`))
+	})
+
+	t.Run("the channel of the post is authorized", func(t *testing.T) {
+		p, api, summarizer := newTestPlugin(t, nil)
+		api.On("GetPost", testRootID).Return(&model.Post{Id: testRootID, ChannelId: testChannelID}, nil)
+		api.On("HasPermissionToChannel", testUserID, testChannelID, model.PermissionReadChannel).Return(false)
+
+		assert.Equal(t, http.StatusForbidden, request(p, testRootID, `{"summary": "Summary", "language": "fr"}`).Code)
+		assert.Empty(t, summarizer.Calls())
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		p, api, summarizer := newTestPlugin(t, nil)
+		api.On("GetPost", "unknown").Return(nil, model.NewAppError("GetPost", "not_found", nil, "", http.StatusNotFound))
+
+		assert.Equal(t, http.StatusBadRequest, request(p, testRootID, `{"language": "fr"}`).Code)
+		assert.Equal(t, http.StatusBadRequest, request(p, testRootID, `not json`).Code)
+		assert.Equal(t, http.StatusNotFound, request(p, "unknown", `{"summary": "Summary"}`).Code)
+		assert.Empty(t, summarizer.Calls())
+	})
+}
+
+func TestTranslatePosts(t *testing.T) {
+	p, api, summarizer := newTestPlugin(t, nil)
+	store := mockKVStore(api, translationKeyPrefix)
+	data := &ThreadData{
+		Posts: []*model.Post{
+			{Id: testRootID, UserId: testUserID, Message: "¿Enviamos el importador el viernes?"},
+			{Id: "replyreplyreplyreplyreply1", UserId: testOtherID, RootId: testRootID, Message: "Me parece bien"},
+		},
+		UsersByID: map[string]*model.User{
+			testUserID:  {Id: testUserID, Username: "alice"},
+			testOtherID: {Id: testOtherID, Username: "bob"},
+		},
+	}
+
+	translations, err := p.translatePosts(context.Background(), testRootID, data, "English")
+	require.NoError(t, err)
+	assert.Equal(t, []PostTranslation{
+		{PostID: testRootID, UserID: testUserID, Username: "alice", Message: "[English] ¿Enviamos el importador el viernes?"},
+		{PostID: "replyreplyreplyreplyreply1", UserID: testOtherID, Username: "bob", Message: "[English] Me parece bien"},
+	}, translations)
+	assert.Equal(t, []string{"TranslateMessages"}, summarizer.Calls(), "the posts are translated together")
+	assert.Len(t, store, 2)
+
+	t.Run("cache hit", func(t *testing.T) {
+		cached, err := p.translatePosts(context.Background(), testRootID, data, "english")
+		require.NoError(t, err)
+		assert.Equal(t, translations, cached)
+		assert.Len(t, summarizer.Calls(), 1, "cached translations aren't sent again")
+	})
+
+	t.Run("cache miss after an edit", func(t *testing.T) {
+		data.Posts[1].Message = "Me parece bien, pero el lunes"
+		data.Posts[1].EditAt = 5
+
+		edited, err := p.translatePosts(context.Background(), testRootID, data, "English")
+		require.NoError(t, err)
+		assert.Equal(t, translations[0], edited[0])
+		assert.Equal(t, "[English] Me parece bien, pero el lunes", edited[1].Message)
+		assert.Len(t, summarizer.Calls(), 2, "only the edited post is translated again")
+	})
+
+	t.Run("another language", func(t *testing.T) {
+		_, err := p.translatePosts(context.Background(), testRootID, data, "French")
+		require.NoError(t, err)
+		assert.Len(t, summarizer.Calls(), 3)
+	})
+}
+
+func TestTranslatePostsBatches(t *testing.T) {
+	newThread := func(count int, message string) *ThreadData {
+		data := &ThreadData{UsersByID: map[string]*model.User{testUserID: {Id: testUserID, Username: "alice"}}}
+		for i := 0; i < count; i++ {
+			data.Posts = append(data.Posts, &model.Post{Id: fmt.Sprintf("post%d", i), UserId: testUserID, Message: message})
+		}
+		return data
+	}
+
+	t.Run("long threads are capped and batched", func(t *testing.T) {
+		p, api, summarizer := newTestPlugin(t, nil)
+		mockKVStore(api, translationKeyPrefix)
+
+		translations, err := p.translatePosts(context.Background(), "", newThread(maxTranslatedPosts+30, "hola"), "English")
+		require.NoError(t, err)
+		require.Len(t, translations, maxTranslatedPosts)
+		assert.Equal(t, "post30", translations[0].PostID, "the most recent posts are translated")
+		assert.Equal(t, "[English] hola", translations[maxTranslatedPosts-1].Message)
+		assert.Len(t, summarizer.Calls(), maxTranslatedPosts/translationBatchSize)
+	})
+
+	t.Run("batches are bounded by length", func(t *testing.T) {
+		assert.Equal(t, []translationBatch{{0, 2}, {2, 4}, {4, 5}}, translationBatches([]string{
+			strings.Repeat("a", 1500), strings.Repeat("b", 1500), strings.Repeat("c", 1500), strings.Repeat("d", 1500), strings.Repeat("e", 5000),
+		}))
+		assert.Equal(t, []translationBatch{{0, 1}}, translationBatches([]string{strings.Repeat("a", 5000)}), "long posts are sent alone")
+		assert.Empty(t, translationBatches(nil))
+	})
+
+	t.Run("limits are checked before each batch", func(t *testing.T) {
+		p, api, fake := newTestPlugin(t, &configuration{UserRequestsPerHour: 2})
+		p.summarizer = p.instrumentSummarizer(fake)
+		store := mockKVStore(api, translationKeyPrefix, "rl_")
+		api.On("LogInfo", "Summarizer call finished", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+			mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		ctx := withRequestInfo(context.Background(), RequestInfo{UserID: testUserID, TeamID: testTeamID})
+
+		_, err := p.translatePosts(ctx, "", newThread(3*translationBatchSize, "hola"), "English")
+		var limitErr *LimitExceededError
+		require.ErrorAs(t, err, &limitErr)
+		assert.Len(t, fake.Calls(), 2)
+		cached := 0
+		for key := range store {
+			if strings.HasPrefix(key, translationKeyPrefix) {
+				cached++
+			}
+		}
+		assert.Equal(t, 2*translationBatchSize, cached, "the batches translated before the limit are kept")
+	})
+}
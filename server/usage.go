@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+const usageTable = "LLMSummarize_Usage"
+
+// ModelPrice is the price in USD per 1000 tokens.
+type ModelPrice struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+var defaultModelPrices = map[string]ModelPrice{
+	"gpt-3.5-turbo":          {Prompt: 0.0015, Completion: 0.002},
+	"gpt-4":                  {Prompt: 0.03, Completion: 0.06},
+	"text-embedding-ada-002": {Prompt: 0.0001},
+}
+
+// parseModelPrices parses the price table setting, a JSON object keyed by model name. An empty
+// setting falls back to the default prices.
+func parseModelPrices(setting string) (map[string]ModelPrice, error) {
+	if strings.TrimSpace(setting) == "" {
+		return defaultModelPrices, nil
+	}
+
+	prices := map[string]ModelPrice{}
+	if err := json.Unmarshal([]byte(setting), &prices); err != nil {
+		return nil, errors.Wrap(err, "the model price table must be a JSON object like {\"gpt-3.5-turbo\": {\"prompt\": 0.0015, \"completion\": 0.002}}")
+	}
+
+	return prices, nil
+}
+
+// estimateCost prices the usage with the entry matching the model, or the longest entry the
+// model name starts with so that dated snapshots (gpt-4-0613) use the price of their family.
+func estimateCost(prices map[string]ModelPrice, usage TokenUsage) float64 {
+	price, ok := prices[usage.Model]
+	if !ok {
+		names := make([]string, 0, len(prices))
+		for name := range prices {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+		for _, name := range names {
+			if strings.HasPrefix(usage.Model, name) {
+				price = prices[name]
+				break
+			}
+		}
+	}
+
+	return float64(usage.PromptTokens)/1000*price.Prompt + float64(usage.CompletionTokens)/1000*price.Completion
+}
+
+// UsageRecord is a single LLM call, as stored in the usage table.
+type UsageRecord struct {
+	Id               string  `json:"id"`
+	CreateAt         int64   `json:"create_at"`
+	UserId           string  `json:"user_id"`
+	TeamId           string  `json:"team_id"`
+	ChannelId        string  `json:"channel_id"`
+	Model            string  `json:"model"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+// UsageSummary aggregates usage records by model or by user.
+type UsageSummary struct {
+	Name             string
+	Requests         int
+	PromptTokens     int
+	CompletionTokens int
+	Cost             float64
+}
+
+type UsageQuery struct {
+	Since  int64
+	Until  int64
+	UserID string
+	TeamID string
+}
+
+func (q UsageQuery) apply(builder sq.SelectBuilder) sq.SelectBuilder {
+	if q.Since != 0 {
+		builder = builder.Where(sq.GtOrEq{"CreateAt": q.Since})
+	}
+	if q.Until != 0 {
+		builder = builder.Where(sq.LtOrEq{"CreateAt": q.Until})
+	}
+	if q.UserID != "" {
+		builder = builder.Where(sq.Eq{"UserId": q.UserID})
+	}
+	if q.TeamID != "" {
+		builder = builder.Where(sq.Eq{"TeamId": q.TeamID})
+	}
+
+	return builder
+}
+
+// recordUsage is called by the summarizer after every completion. It records the token metrics,
+// charges the quotas and stores the call for cost reporting.
+func (p *Plugin) recordUsage(ctx context.Context, usage TokenUsage) {
+	p.metrics.ObserveUsage(usage)
+	p.chargeQuotas(ctx, usage)
+
+	if p.db == nil {
+		return
+	}
+
+	info := requestInfoFromContext(ctx)
+	record := UsageRecord{
+		Id:               model.NewId(),
+		CreateAt:         model.GetMillis(),
+		UserId:           info.UserID,
+		TeamId:           info.TeamID,
+		ChannelId:        info.ChannelID,
+		Model:            usage.Model,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		Cost:             estimateCost(p.getConfiguration().modelPrices, usage),
+	}
+
+	query, args, err := p.builder.Insert(usageTable).
+		SetMap(map[string]interface{}{
+			"Id":               record.Id,
+			"CreateAt":         record.CreateAt,
+			"UserId":           record.UserId,
+			"TeamId":           record.TeamId,
+			"ChannelId":        record.ChannelId,
+			"Model":            record.Model,
+			"PromptTokens":     record.PromptTokens,
+			"CompletionTokens": record.CompletionTokens,
+			"Cost":             record.Cost,
+		}).
+		ToSql()
+	if err == nil {
+		_, err = p.db.Exec(query, args...)
+	}
+	if err != nil {
+		p.API.LogError("Failed to record usage", "user_id", info.UserID, "error", err.Error())
+	}
+}
+
+func (p *Plugin) getUsageRecords(q UsageQuery) ([]UsageRecord, error) {
+	query, args, err := q.apply(p.builder.Select("*").From(usageTable)).OrderBy("CreateAt ASC").ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	records := []UsageRecord{}
+	if err := p.db.Select(&records, query, args...); err != nil {
+		return nil, errors.Wrap(err, "failed to get usage records")
+	}
+
+	return records, nil
+}
+
+// getUsageSummary aggregates the matching usage by the given column, either Model or UserId.
+func (p *Plugin) getUsageSummary(q UsageQuery, groupBy string) ([]UsageSummary, error) {
+	query, args, err := q.apply(p.builder.
+		Select(
+			groupBy+" AS Name",
+			"COUNT(*) AS Requests",
+			"COALESCE(SUM(PromptTokens), 0) AS PromptTokens",
+			"COALESCE(SUM(CompletionTokens), 0) AS CompletionTokens",
+			"COALESCE(SUM(Cost), 0) AS Cost",
+		).
+		From(usageTable)).
+		GroupBy(groupBy).
+		OrderBy("Cost DESC").
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := []UsageSummary{}
+	if err := p.db.Select(&summaries, query, args...); err != nil {
+		return nil, errors.Wrap(err, "failed to get usage summary")
+	}
+
+	return summaries, nil
+}
+
+// executeUsageCommand reports the LLM usage of the requesting user. System admins can report on
+// another user with --from, or on everyone with --all.
+func (p *Plugin) executeUsageCommand(args *model.CommandArgs, params []string) (*model.CommandResponse, error) {
+	all, flags := extractFlag(params, "--all")
+	now := time.Now()
+	filters, _, err := parseSummaryFilters(flags, now)
+	if err == nil {
+		err = p.resolveSummaryFilters(filters)
+	}
+	if err != nil {
+		return ephemeralResponse(args, err.Error()), nil
+	}
+
+	isAdmin := p.pluginAPI.User.HasPermissionTo(args.UserId, model.PermissionManageSystem)
+	if (all || filters.FromUserID != "") && !isAdmin {
+		return ephemeralResponse(args, "Only system admins can see the usage of other users."), nil
+	}
+
+	since := filters.Since
+	if since.IsZero() {
+		since = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	}
+	query := UsageQuery{
+		Since:  model.GetMillisForTime(since),
+		UserID: args.UserId,
+	}
+	if !filters.Until.IsZero() {
+		query.Until = model.GetMillisForTime(filters.Until)
+	}
+	if filters.FromUserID != "" {
+		query.UserID = filters.FromUserID
+	}
+
+	groupBy, column := "Model", "Model"
+	if all {
+		query.UserID = ""
+		groupBy, column = "UserId", "User"
+	}
+
+	summaries, err := p.getUsageSummary(query, groupBy)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(summaries) == 0 {
+		return ephemeralResponse(args, fmt.Sprintf("No LLM usage since %s.", since.Format("2006-01-02"))), nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "#### LLM usage since %s\n", since.Format("2006-01-02"))
+	fmt.Fprintf(&b, "| %s | Requests | Prompt tokens | Completion tokens | Estimated cost |\n", column)
+	b.WriteString("| --- | ---: | ---: | ---: | ---: |\n")
+
+	total := UsageSummary{Name: "**Total**"}
+	for _, summary := range summaries {
+		name := summary.Name
+		if all {
+			name = p.usernameOrID(summary.Name)
+		}
+		fmt.Fprintf(&b, "| %s | %d | %d | %d | $%.4f |\n", name, summary.Requests, summary.PromptTokens, summary.CompletionTokens, summary.Cost)
+
+		total.Requests += summary.Requests
+		total.PromptTokens += summary.PromptTokens
+		total.CompletionTokens += summary.CompletionTokens
+		total.Cost += summary.Cost
+	}
+	if len(summaries) > 1 {
+		fmt.Fprintf(&b, "| %s | %d | %d | %d | $%.4f |\n", total.Name, total.Requests, total.PromptTokens, total.CompletionTokens, total.Cost)
+	}
+
+	return ephemeralResponse(args, b.String()), nil
+}
+
+func (p *Plugin) usernameOrID(userID string) string {
+	if userID == "" {
+		return "-"
+	}
+
+	user, err := p.pluginAPI.User.Get(userID)
+	if err != nil {
+		return userID
+	}
+
+	return "@" + user.Username
+}
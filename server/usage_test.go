@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimateCost(t *testing.T) {
+	prices, err := parseModelPrices(`{"gpt-4": {"prompt": 0.03, "completion": 0.06}, "gpt-4-32k": {"prompt": 0.06, "completion": 0.12}}`)
+	require.NoError(t, err)
+
+	assert.InDelta(t, 0.06, estimateCost(prices, TokenUsage{Model: "gpt-4", PromptTokens: 1000, CompletionTokens: 500}), 1e-9)
+	assert.InDelta(t, 0.12, estimateCost(prices, TokenUsage{Model: "gpt-4-32k-0613", PromptTokens: 1000, CompletionTokens: 500}), 1e-9)
+	assert.Zero(t, estimateCost(prices, TokenUsage{Model: "unknown", PromptTokens: 1000}))
+
+	prices, err = parseModelPrices("")
+	require.NoError(t, err)
+	assert.Equal(t, defaultModelPrices, prices)
+
+	_, err = parseModelPrices("gpt-4=0.03")
+	assert.Error(t, err)
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	embeddingsTable = "LLMSummarize_Embeddings"
+
+	// maxChunkLength is the maximum number of characters embedded together. Most posts fit in a
+	// single chunk.
+	maxChunkLength = 1000
+
+	embeddingVectorIndex = "LLMSummarize_Embeddings_Vector_Idx"
+
+	// maxIndexedDimensions is the largest vector pgvector builds an approximate index for. Longer
+	// vectors are still searched in the database, without an index.
+	maxIndexedDimensions = 2000
+)
+
+// PostChunk is a piece of a post along with its embedding.
+type PostChunk struct {
+	Id         string
+	PostId     string
+	ChannelId  string
+	UserId     string
+	ChunkIndex int
+	Content    string
+	CreateAt   int64
+	Model      string
+	Embedding  []byte
+}
+
+// VectorMatch is a chunk returned by a search, with its cosine similarity to the query.
+type VectorMatch struct {
+	Id        string
+	PostId    string
+	ChannelId string
+	Content   string
+	CreateAt  int64
+	Score     float64
+}
+
+// VectorSearch restricts a search to some channels and a time range.
+type VectorSearch struct {
+	ChannelIDs []string
+	Model      string
+	Since      int64
+	Until      int64
+	TopK       int
+}
+
+// vectorIndex stores post chunks in the plugin tables. With pgvector the similarity search runs
+// in the database, otherwise the candidate embeddings are scored in the plugin.
+type vectorIndex struct {
+	plugin *Plugin
+
+	// extension is whether the pgvector extension is installed in the database.
+	extension bool
+
+	lock sync.RWMutex
+	// dimensions is the length of the EmbeddingVector column, or 0 when pgvector isn't used.
+	dimensions int
+}
+
+// newVectorIndex checks whether the pgvector extension is installed. The plugin never installs it,
+// as that needs more privileges than the server has on the database.
+func (p *Plugin) newVectorIndex() *vectorIndex {
+	index := &vectorIndex{plugin: p}
+	if p.pluginAPI.Store.DriverName() != model.DatabaseDriverPostgres {
+		return index
+	}
+
+	if err := p.db.Get(&index.extension, `SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'vector')`); err != nil {
+		p.API.LogWarn("Failed to check for pgvector, using brute-force vector search", "error", err.Error())
+		return index
+	}
+	if !index.extension {
+		p.API.LogInfo("pgvector is not installed, using brute-force vector search")
+	}
+
+	return index
+}
+
+// usesPgvector returns whether the similarity search runs in the database.
+func (idx *vectorIndex) usesPgvector() bool {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	return idx.dimensions > 0
+}
+
+// setDimensions sets up the EmbeddingVector column for vectors of the given length, along with an
+// approximate nearest neighbor index. The search falls back to brute force when pgvector isn't
+// installed, the length isn't known or the column can't be set up.
+func (idx *vectorIndex) setDimensions(dimensions int) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	if !idx.extension || dimensions <= 0 {
+		idx.dimensions = 0
+		return
+	}
+	if idx.dimensions == dimensions {
+		return
+	}
+
+	if err := idx.createVectorColumn(dimensions); err != nil {
+		idx.plugin.API.LogError("Failed to set up the pgvector column, using brute-force vector search", "error", err.Error())
+		idx.dimensions = 0
+		return
+	}
+	idx.dimensions = dimensions
+}
+
+// createVectorColumn replaces the EmbeddingVector column when its type doesn't match the vectors.
+// The chunks of the previous model lose their vectors, which no search uses anymore.
+func (idx *vectorIndex) createVectorColumn(dimensions int) error {
+	p := idx.plugin
+	columnType := fmt.Sprintf("vector(%d)", dimensions)
+
+	var existingTypes []string
+	if err := p.db.Select(&existingTypes, `SELECT format_type(atttypid, atttypmod) FROM pg_attribute WHERE attrelid = 'llmsummarize_embeddings'::regclass AND attname = 'embeddingvector' AND NOT attisdropped`); err != nil {
+		return errors.Wrap(err, "failed to read the pgvector column")
+	}
+
+	if len(existingTypes) == 0 || existingTypes[0] != columnType {
+		for _, statement := range []string{
+			`DROP INDEX IF EXISTS ` + embeddingVectorIndex,
+			`ALTER TABLE LLMSummarize_Embeddings DROP COLUMN IF EXISTS EmbeddingVector`,
+			`ALTER TABLE LLMSummarize_Embeddings ADD COLUMN EmbeddingVector ` + columnType,
+		} {
+			if _, err := p.db.Exec(statement); err != nil {
+				return errors.Wrap(err, "failed to create the pgvector column")
+			}
+		}
+	}
+
+	if dimensions > maxIndexedDimensions {
+		p.API.LogInfo("Embeddings are too long for a pgvector index, searching them without one", "dimensions", dimensions)
+		return nil
+	}
+
+	// HNSW needs pgvector 0.5.0, older versions only have IVFFlat.
+	_, err := p.db.Exec(`CREATE INDEX IF NOT EXISTS ` + embeddingVectorIndex + ` ON LLMSummarize_Embeddings USING hnsw (EmbeddingVector vector_cosine_ops)`)
+	if err != nil {
+		_, err = p.db.Exec(`CREATE INDEX IF NOT EXISTS ` + embeddingVectorIndex + ` ON LLMSummarize_Embeddings USING ivfflat (EmbeddingVector vector_cosine_ops) WITH (lists = 100)`)
+	}
+	if err != nil {
+		p.API.LogWarn("Failed to create the pgvector index, searching without one", "error", err.Error())
+	}
+
+	return nil
+}
+
+// chunkText splits text in pieces of at most maxLength characters, cutting on whitespace when
+// possible.
+func chunkText(text string, maxLength int) []string {
+	text = strings.TrimSpace(text)
+	chunks := []string{}
+	for utf8.RuneCountInString(text) > maxLength {
+		runes := []rune(text)
+		cut := maxLength
+		for i := maxLength; i > maxLength/2; i-- {
+			if runes[i] == ' ' || runes[i] == '\n' {
+				cut = i
+				break
+			}
+		}
+		chunks = append(chunks, strings.TrimSpace(string(runes[:cut])))
+		text = strings.TrimSpace(string(runes[cut:]))
+	}
+	if text != "" {
+		chunks = append(chunks, text)
+	}
+
+	return chunks
+}
+
+func encodeVector(vector []float32) []byte {
+	encoded := make([]byte, 4*len(vector))
+	for i, value := range vector {
+		binary.LittleEndian.PutUint32(encoded[4*i:], math.Float32bits(value))
+	}
+
+	return encoded
+}
+
+func decodeVector(encoded []byte) []float32 {
+	vector := make([]float32, len(encoded)/4)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(encoded[4*i:]))
+	}
+
+	return vector
+}
+
+// pgvectorLiteral formats a vector the way pgvector parses it.
+func pgvectorLiteral(vector []float32) string {
+	parts := make([]string, len(vector))
+	for i, value := range vector {
+		parts[i] = strconv.FormatFloat(float64(value), 'f', -1, 32)
+	}
+
+	return "[" + strings.Join(parts, ",") + "]"
+}
+
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// ReplacePosts replaces every chunk of the given posts with the new ones.
+func (idx *vectorIndex) ReplacePosts(postIDs []string, chunks []*PostChunk) error {
+	p := idx.plugin
+
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "failed to start transaction")
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	pgvector := idx.usesPgvector()
+	if len(postIDs) > 0 {
+		query, args, err := p.builder.Delete(embeddingsTable).Where(sq.Eq{"PostId": postIDs}).ToSql()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(query, args...); err != nil {
+			return errors.Wrap(err, "failed to delete chunks")
+		}
+	}
+
+	for _, chunk := range chunks {
+		values := map[string]interface{}{
+			"Id":         chunk.Id,
+			"PostId":     chunk.PostId,
+			"ChannelId":  chunk.ChannelId,
+			"UserId":     chunk.UserId,
+			"ChunkIndex": chunk.ChunkIndex,
+			"Content":    chunk.Content,
+			"CreateAt":   chunk.CreateAt,
+			"Model":      chunk.Model,
+			"Embedding":  chunk.Embedding,
+		}
+		if pgvector {
+			values["EmbeddingVector"] = sq.Expr("?::vector", pgvectorLiteral(decodeVector(chunk.Embedding)))
+		}
+
+		query, args, err := p.builder.Insert(embeddingsTable).SetMap(values).ToSql()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(query, args...); err != nil {
+			return errors.Wrap(err, "failed to insert chunk")
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DeletePost removes the chunks of a post from the index.
+func (idx *vectorIndex) DeletePost(postID string) error {
+	return idx.ReplacePosts([]string{postID}, nil)
+}
+
+// DeleteChannel removes the chunks of every post of a channel from the index.
+func (idx *vectorIndex) DeleteChannel(channelID string) error {
+	p := idx.plugin
+
+	query, args, err := p.builder.Delete(embeddingsTable).Where(sq.Eq{"ChannelId": channelID}).ToSql()
+	if err != nil {
+		return err
+	}
+	if _, err = p.db.Exec(query, args...); err != nil {
+		return errors.Wrap(err, "failed to delete channel chunks")
+	}
+
+	return nil
+}
+
+func (s VectorSearch) apply(builder sq.SelectBuilder) sq.SelectBuilder {
+	builder = builder.From(embeddingsTable).Where(sq.Eq{"ChannelId": s.ChannelIDs, "Model": s.Model})
+	if s.Since > 0 {
+		builder = builder.Where(sq.GtOrEq{"CreateAt": s.Since})
+	}
+	if s.Until > 0 {
+		builder = builder.Where(sq.LtOrEq{"CreateAt": s.Until})
+	}
+
+	return builder
+}
+
+// Search returns the chunks closest to the query, most similar first.
+func (idx *vectorIndex) Search(query []float32, search VectorSearch) ([]VectorMatch, error) {
+	if len(search.ChannelIDs) == 0 || search.TopK <= 0 {
+		return []VectorMatch{}, nil
+	}
+
+	if idx.usesPgvector() {
+		return idx.searchPgvector(query, search)
+	}
+
+	return idx.searchBruteForce(query, search)
+}
+
+func (idx *vectorIndex) searchPgvector(query []float32, search VectorSearch) ([]VectorMatch, error) {
+	p := idx.plugin
+	literal := pgvectorLiteral(query)
+
+	sqlQuery, args, err := search.apply(p.builder.Select("Id", "PostId", "ChannelId", "Content", "CreateAt").
+		Column(sq.Expr("1 - (EmbeddingVector <=> ?::vector) AS Score", literal))).
+		Where("EmbeddingVector IS NOT NULL").
+		OrderByClause("EmbeddingVector <=> ?::vector", literal).
+		Limit(uint64(search.TopK)).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	matches := []VectorMatch{}
+	if err := p.db.Select(&matches, sqlQuery, args...); err != nil {
+		return nil, errors.Wrap(err, "failed to search chunks")
+	}
+
+	return matches, nil
+}
+
+func (idx *vectorIndex) searchBruteForce(query []float32, search VectorSearch) ([]VectorMatch, error) {
+	p := idx.plugin
+
+	sqlQuery, args, err := search.apply(p.builder.Select("Id", "PostId", "ChannelId", "Content", "CreateAt", "Embedding")).ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := p.db.Queryx(sqlQuery, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to search chunks")
+	}
+	defer rows.Close()
+
+	matches := []VectorMatch{}
+	for rows.Next() {
+		var chunk PostChunk
+		if err := rows.StructScan(&chunk); err != nil {
+			return nil, errors.Wrap(err, "failed to read chunk")
+		}
+		matches = append(matches, VectorMatch{
+			Id:        chunk.Id,
+			PostId:    chunk.PostId,
+			ChannelId: chunk.ChannelId,
+			Content:   chunk.Content,
+			CreateAt:  chunk.CreateAt,
+			Score:     cosineSimilarity(query, decodeVector(chunk.Embedding)),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read chunks")
+	}
+
+	return topMatches(matches, search.TopK), nil
+}
+
+// topMatches sorts the matches by decreasing similarity and keeps the first k.
+func topMatches(matches []VectorMatch, k int) []VectorMatch {
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+	if len(matches) > k {
+		matches = matches[:k]
+	}
+
+	return matches
+}
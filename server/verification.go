@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	mentionPattern         = regexp.MustCompile(`(?:^|[^\w@])@([a-zA-Z0-9][a-zA-Z0-9._-]*[a-zA-Z0-9_]|[a-zA-Z0-9])`)
+	quotePattern           = regexp.MustCompile(`"([^"\n]{8,})"|“([^”\n]{8,})”`)
+	sentencePattern        = regexp.MustCompile(`[^.!?\n]+[.!?]*`)
+	capitalizedNamePattern = regexp.MustCompile(`\p{Lu}\p{Ll}+(?:[ \t]+\p{Lu}\p{Ll}+)*`)
+	threadWordPattern      = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+	// specialMentions notify groups of people rather than naming anyone.
+	specialMentions = map[string]bool{"all": true, "channel": true, "here": true}
+
+	// calendarWords are capitalized without being names.
+	calendarWords = map[string]bool{
+		"monday": true, "tuesday": true, "wednesday": true, "thursday": true, "friday": true, "saturday": true, "sunday": true,
+		"january": true, "february": true, "march": true, "april": true, "may": true, "june": true, "july": true,
+		"august": true, "september": true, "october": true, "november": true, "december": true,
+	}
+)
+
+// Verification reports the claims of a response that the thread doesn't back.
+type Verification struct {
+	Verified          bool     `json:"verified"`
+	UnknownUsers      []string `json:"unknown_users"`
+	UnsupportedQuotes []string `json:"unsupported_quotes"`
+}
+
+func (v *Verification) addUnknownUser(name string) {
+	for _, existing := range v.UnknownUsers {
+		if existing == name {
+			return
+		}
+	}
+	v.UnknownUsers = append(v.UnknownUsers, name)
+	v.Verified = false
+}
+
+func (v *Verification) addUnsupportedQuote(quote string) {
+	v.UnsupportedQuotes = append(v.UnsupportedQuotes, quote)
+	v.Verified = false
+}
+
+// Note describes the problems found, for appending to the response.
+func (v *Verification) Note() string {
+	if v.Verified {
+		return ""
+	}
+
+	problems := []string{}
+	for _, name := range v.UnknownUsers {
+		problems = append(problems, fmt.Sprintf("%s didn't take part in the conversation", name))
+	}
+	for _, quote := range v.UnsupportedQuotes {
+		problems = append(problems, fmt.Sprintf("%q doesn't appear in it", quote))
+	}
+
+	return "_Could not verify this response: " + strings.Join(problems, "; ") + "._"
+}
+
+// verifier checks responses against the thread they were generated from. People are recognized
+// by @mention and by capitalized name in free text, and by username or display name in the fields
+// of structured summaries. The users of the thread are known, along with those @mentioned in it.
+type verifier struct {
+	names   map[string]bool
+	sources []string
+	// words are the words of the thread, so that capitalized words it uses aren't taken for names.
+	words map[string]bool
+}
+
+func newVerifier(data *ThreadData, extraSources ...string) *verifier {
+	v := &verifier{names: map[string]bool{}, words: map[string]bool{}}
+	for _, user := range data.UsersByID {
+		for _, name := range []string{user.Username, user.Nickname, user.FirstName, user.LastName, user.GetFullName()} {
+			if name = strings.TrimSpace(name); name != "" {
+				v.names[strings.ToLower(name)] = true
+			}
+		}
+		// Usernames like bob.smith name the user by the parts as well.
+		for _, part := range threadWordPattern.FindAllString(strings.ToLower(user.Username), -1) {
+			v.names[part] = true
+		}
+	}
+
+	sources := []string{}
+	for _, post := range data.Posts {
+		sources = append(sources, post.Message)
+		for _, match := range mentionPattern.FindAllStringSubmatch(post.Message, -1) {
+			v.names[strings.ToLower(match[1])] = true
+		}
+	}
+	for _, source := range append(sources, extraSources...) {
+		normalized := normalizeForMatch(source)
+		v.sources = append(v.sources, normalized)
+		for _, word := range threadWordPattern.FindAllString(normalized, -1) {
+			v.words[word] = true
+		}
+	}
+
+	return v
+}
+
+func normalizeForMatch(text string) string {
+	return strings.Join(strings.Fields(strings.ToLower(text)), " ")
+}
+
+func (v *verifier) knowsName(name string) bool {
+	return v.names[strings.ToLower(strings.TrimPrefix(strings.TrimSpace(name), "@"))]
+}
+
+// knowsCapitalized returns whether a run of capitalized words is a name of the thread or only uses
+// words of the thread.
+func (v *verifier) knowsCapitalized(name string) bool {
+	if v.knowsName(name) {
+		return true
+	}
+
+	for _, word := range strings.Fields(strings.ToLower(name)) {
+		if !v.names[word] && !v.words[word] && !calendarWords[word] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (v *verifier) isQuoted(quote string) bool {
+	quote = normalizeForMatch(quote)
+	for _, source := range v.sources {
+		if strings.Contains(source, quote) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkText records the mentions and names of people outside the thread and the quotes that don't
+// appear in it.
+func (v *verifier) checkText(text string, result *Verification) {
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		username := strings.ToLower(match[1])
+		if !specialMentions[username] && !v.knowsName(username) {
+			result.addUnknownUser("@" + username)
+		}
+	}
+
+	for _, name := range capitalizedNames(text) {
+		if !v.knowsCapitalized(name) {
+			result.addUnknownUser(name)
+		}
+	}
+
+	for _, match := range quotePattern.FindAllStringSubmatch(text, -1) {
+		quote := match[1] + match[2]
+		if !v.isQuoted(quote) {
+			result.addUnsupportedQuote(quote)
+		}
+	}
+}
+
+func (v *verifier) VerifyText(text string) *Verification {
+	result := &Verification{Verified: true, UnknownUsers: []string{}, UnsupportedQuotes: []string{}}
+	v.checkText(text, result)
+
+	return result
+}
+
+// capitalizedNames returns the runs of capitalized words that may name people. The first word of a
+// sentence is capitalized anyway, so it's left out, as are parts of other words and mentions.
+func capitalizedNames(text string) []string {
+	names := []string{}
+	for _, match := range capitalizedNamePattern.FindAllStringIndex(text, -1) {
+		start, end := match[0], match[1]
+		previous, _ := utf8.DecodeLastRuneInString(text[:start])
+		next, _ := utf8.DecodeRuneInString(text[end:])
+		if isWordRune(previous) || previous == '@' || isWordRune(next) {
+			continue
+		}
+
+		name := text[start:end]
+		if isSentenceStart(text[:start]) {
+			fields := strings.Fields(name)
+			if len(fields) == 1 {
+				continue
+			}
+			name = strings.Join(fields[1:], " ")
+		}
+		names = append(names, name)
+	}
+
+	return names
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// isSentenceStart returns whether the text following before starts a sentence, a line or a
+// markdown element.
+func isSentenceStart(before string) bool {
+	before = strings.TrimRight(before, " \t")
+	if before == "" {
+		return true
+	}
+
+	last, _ := utf8.DecodeLastRuneInString(before)
+	return strings.ContainsRune(".!?:;\n-*#>|(\"“", last)
+}
+
+func (v *verifier) VerifyStructuredSummary(summary *StructuredSummary) *Verification {
+	result := &Verification{Verified: true, UnknownUsers: []string{}, UnsupportedQuotes: []string{}}
+
+	v.checkText(summary.TLDR, result)
+	for _, text := range append(append([]string{}, summary.Decisions...), summary.OpenQuestions...) {
+		v.checkText(text, result)
+	}
+	for _, item := range summary.ActionItems {
+		v.checkText(item.Description, result)
+		if item.Owner != "" && !v.knowsName(item.Owner) {
+			result.addUnknownUser(item.Owner)
+		}
+	}
+	for _, participant := range summary.Participants {
+		if !v.knowsName(participant) {
+			result.addUnknownUser(participant)
+		}
+	}
+
+	return result
+}
+
+// removeUnverified drops the sentences that contain any of the unsupported claims.
+func removeUnverified(text string, result *Verification) string {
+	if result.Verified {
+		return text
+	}
+
+	claims := append(append([]string{}, result.UnknownUsers...), result.UnsupportedQuotes...)
+	return sentencePattern.ReplaceAllStringFunc(text, func(sentence string) string {
+		lower := strings.ToLower(sentence)
+		for _, claim := range claims {
+			if strings.Contains(lower, strings.ToLower(claim)) {
+				return ""
+			}
+		}
+		return sentence
+	})
+}
+
+// removeUnverifiedFromSummary drops unknown people and the statements with unsupported claims.
+func removeUnverifiedFromSummary(summary *StructuredSummary, result *Verification, v *verifier) {
+	if result.Verified {
+		return
+	}
+
+	filter := func(texts []string) []string {
+		kept := []string{}
+		for _, text := range texts {
+			if text = strings.TrimSpace(removeUnverified(text, result)); text != "" {
+				kept = append(kept, text)
+			}
+		}
+		return kept
+	}
+
+	summary.TLDR = strings.TrimSpace(removeUnverified(summary.TLDR, result))
+	summary.Decisions = filter(summary.Decisions)
+	summary.OpenQuestions = filter(summary.OpenQuestions)
+
+	participants := []string{}
+	for _, participant := range summary.Participants {
+		if v.knowsName(participant) {
+			participants = append(participants, participant)
+		}
+	}
+	summary.Participants = participants
+
+	items := []ActionItem{}
+	for _, item := range summary.ActionItems {
+		if item.Description = strings.TrimSpace(removeUnverified(item.Description, result)); item.Description == "" {
+			continue
+		}
+		if item.Owner != "" && !v.knowsName(item.Owner) {
+			item.Owner = ""
+		}
+		items = append(items, item)
+	}
+	summary.ActionItems = items
+}
+
+// verifyText checks a response against the thread, removing the sentences with unsupported
+// claims or flagging them depending on the configuration. Extra sources, like the restored
+// formatted thread, let quotes of redacted content match.
+func (p *Plugin) verifyText(text string, data *ThreadData, extraSources ...string) (string, *Verification) {
+	result := newVerifier(data, extraSources...).VerifyText(text)
+	if result.Verified {
+		return text, result
+	}
+
+	if p.getConfiguration().RemoveUnverifiedClaims {
+		return strings.TrimSpace(removeUnverified(text, result)), result
+	}
+
+	return text + "\n\n" + result.Note(), result
+}
+
+// verifyStructuredSummary is verifyText for structured summaries. Unsupported claims are removed
+// from the summary when configured, otherwise the note is returned for the caller to show.
+func (p *Plugin) verifyStructuredSummary(summary *StructuredSummary, data *ThreadData, extraSources ...string) (*Verification, string) {
+	v := newVerifier(data, extraSources...)
+	result := v.VerifyStructuredSummary(summary)
+	if result.Verified {
+		return result, ""
+	}
+
+	if p.getConfiguration().RemoveUnverifiedClaims {
+		removeUnverifiedFromSummary(summary, result, v)
+		return result, ""
+	}
+
+	return result, result.Note()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func verificationThread() *ThreadData {
+	return &ThreadData{
+		Posts: []*model.Post{
+			{Id: "p1", UserId: "u1", Message: "We should ship the new   Importer on Friday."},
+			{Id: "p2", UserId: "u2", Message: "Fine by me, @alice will write the release notes."},
+			{Id: "p3", UserId: "u1", Message: "@carol can you check the Postgres migration?"},
+		},
+		UsersByID: map[string]*model.User{
+			"u1": {Id: "u1", Username: "alice", FirstName: "Alice", LastName: "Liddell"},
+			"u2": {Id: "u2", Username: "bob.smith", Nickname: "Bobby"},
+		},
+	}
+}
+
+func TestVerifyText(t *testing.T) {
+	v := newVerifier(verificationThread())
+
+	for name, tc := range map[string]struct {
+		text              string
+		unknownUsers      []string
+		unsupportedQuotes []string
+	}{
+		"known mentions and quotes": {
+			text:              `@alice suggested to "ship the new importer on Friday" and @bob.smith agreed.`,
+			unknownUsers:      []string{},
+			unsupportedQuotes: []string{},
+		},
+		"special mentions and emails are ignored": {
+			text:              "@here contact ops@example.com about it.",
+			unknownUsers:      []string{},
+			unsupportedQuotes: []string{},
+		},
+		"unknown mentions are reported once": {
+			text:              "@erin will review it, @Erin said so.",
+			unknownUsers:      []string{"@erin"},
+			unsupportedQuotes: []string{},
+		},
+		"users mentioned in the thread are known": {
+			text:              "@carol checks the migration.",
+			unknownUsers:      []string{},
+			unsupportedQuotes: []string{},
+		},
+		"names of the thread users": {
+			text:              "The release notes are for Alice, then Bobby and Alice Liddell ship it. Mr Smith agreed, and so did Carol.",
+			unknownUsers:      []string{},
+			unsupportedQuotes: []string{},
+		},
+		"capitalized words of the thread": {
+			text:              "Everyone agreed to check the Postgres migration before Friday, in June.",
+			unknownUsers:      []string{},
+			unsupportedQuotes: []string{},
+		},
+		"unknown names are reported": {
+			text:              "It was approved by Dave and Alice Jones. Then Erin Brown asked for a demo. Frank left.",
+			unknownUsers:      []string{"Dave", "Alice Jones", "Erin Brown"},
+			unsupportedQuotes: []string{},
+		},
+		"parts of words and mentions aren't names": {
+			text:              "Deploy it on macOS with the iPhone app, ping @Carol and @dave_Smith.",
+			unknownUsers:      []string{"@dave_smith"},
+			unsupportedQuotes: []string{},
+		},
+		"invented quotes are reported": {
+			text:              `Bob said “the release is cancelled”.`,
+			unknownUsers:      []string{},
+			unsupportedQuotes: []string{"the release is cancelled"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			result := v.VerifyText(tc.text)
+			assert.Equal(t, tc.unknownUsers, result.UnknownUsers)
+			assert.Equal(t, tc.unsupportedQuotes, result.UnsupportedQuotes)
+			assert.Equal(t, len(tc.unknownUsers)+len(tc.unsupportedQuotes) == 0, result.Verified)
+		})
+	}
+}
+
+func TestVerifyStructuredSummary(t *testing.T) {
+	v := newVerifier(verificationThread())
+	summary := &StructuredSummary{
+		TLDR:      "The importer ships on Friday.",
+		Decisions: []string{"Ship the importer on Friday.", `@dave said "we can skip the tests".`},
+		ActionItems: []ActionItem{
+			{Description: "Write the release notes", Owner: "@alice"},
+			{Description: "Update the docs", Owner: "Dave"},
+		},
+		Participants: []string{"Alice Liddell", "Bobby", "Dave"},
+	}
+
+	result := v.VerifyStructuredSummary(summary)
+	assert.False(t, result.Verified)
+	assert.Equal(t, []string{"@dave", "Dave"}, result.UnknownUsers)
+	assert.Equal(t, []string{"we can skip the tests"}, result.UnsupportedQuotes)
+
+	removeUnverifiedFromSummary(summary, result, v)
+	assert.Equal(t, []string{"Ship the importer on Friday."}, summary.Decisions)
+	assert.Equal(t, []string{"Alice Liddell", "Bobby"}, summary.Participants)
+	assert.Equal(t, []ActionItem{
+		{Description: "Write the release notes", Owner: "@alice"},
+		{Description: "Update the docs"},
+	}, summary.ActionItems)
+}
+
+func TestRemoveUnverified(t *testing.T) {
+	result := &Verification{UnknownUsers: []string{"@carol"}, UnsupportedQuotes: []string{"never said this"}}
+
+	text := "Alice will ship it. @Carol reviews it! Bob wrote \"never said this\".\nDone?"
+	assert.Equal(t, "Alice will ship it.\nDone?", removeUnverified(text, result))
+	assert.Equal(t, text, removeUnverified(text, &Verification{Verified: true}))
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	pluginapi "github.com/mattermost/mattermost-plugin-api"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+// searchableChannels returns the channels the user is a member of that workspace-wide questions
+// may read: those allowed by the usage restrictions and not excluded by an admin.
+func (p *Plugin) searchableChannels(userID string) (map[string]*model.Channel, error) {
+	teams, err := p.pluginAPI.Team.List(pluginapi.FilterTeamsByUser(userID))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list teams")
+	}
+
+	excluded := p.getConfiguration().WorkspaceSearchExcludedChannelIDs
+	channels := map[string]*model.Channel{}
+	for _, team := range teams {
+		teamChannels, err := p.pluginAPI.Channel.ListForTeamForUser(team.Id, userID, false)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list channels of team %s", team.Id)
+		}
+
+		for _, channel := range teamChannels {
+			if _, ok := channels[channel.Id]; ok || strings.Contains(excluded, channel.Id) {
+				continue
+			}
+			// Direct and group messages don't belong to a team, check them against the team searched.
+			teamID := channel.TeamId
+			if teamID == "" {
+				teamID = team.Id
+			}
+			if p.checkUsageRestrictions(userID, teamID, channel) != nil {
+				continue
+			}
+			channels[channel.Id] = channel
+		}
+	}
+
+	return channels, nil
+}
+
+// dropDisallowedChannels removes the posts of channels whose policy doesn't allow summarizing
+// them. Policies are only checked for the channels that were retrieved, as checking the consent
+// of every conversation of the user up front would be too costly.
+func (p *Plugin) dropDisallowedChannels(data *ThreadData, channels map[string]*model.Channel) *ThreadData {
+	allowed := map[string]bool{}
+	posts := make([]*model.Post, 0, len(data.Posts))
+	for _, post := range data.Posts {
+		isAllowed, checked := allowed[post.ChannelId]
+		if !checked {
+			_, policyErr := p.checkChannelPolicy(channels[post.ChannelId])
+			isAllowed = policyErr == nil
+			allowed[post.ChannelId] = isAllowed
+		}
+		if isAllowed {
+			posts = append(posts, post)
+		}
+	}
+
+	return &ThreadData{Posts: posts, UsersByID: data.UsersByID}
+}
+
+// groupPostsByChannel splits the posts by channel, ordering the channels by name.
+func groupPostsByChannel(data *ThreadData, channels map[string]*model.Channel) []*ThreadData {
+	byChannel := map[string]*ThreadData{}
+	channelIDs := []string{}
+	for _, post := range data.Posts {
+		group, ok := byChannel[post.ChannelId]
+		if !ok {
+			group = &ThreadData{UsersByID: data.UsersByID}
+			byChannel[post.ChannelId] = group
+			channelIDs = append(channelIDs, post.ChannelId)
+		}
+		group.Posts = append(group.Posts, post)
+	}
+
+	sort.Slice(channelIDs, func(i, j int) bool {
+		return strings.ToLower(channelLabel(channels[channelIDs[i]])) < strings.ToLower(channelLabel(channels[channelIDs[j]]))
+	})
+
+	groups := make([]*ThreadData, 0, len(channelIDs))
+	for _, channelID := range channelIDs {
+		groups = append(groups, byChannel[channelID])
+	}
+
+	return groups
+}
+
+func channelLabel(channel *model.Channel) string {
+	if channel.DisplayName != "" {
+		return channel.DisplayName
+	}
+
+	return channel.Name
+}
+
+// formatSources lists the permalinks of the posts the answer was based on, grouped by channel.
+func (p *Plugin) formatSources(groups []*ThreadData, channels map[string]*model.Channel) string {
+	var sb strings.Builder
+	sb.WriteString("#### Sources\n")
+	for _, group := range groups {
+		fmt.Fprintf(&sb, "\n**%s**\n", channelLabel(channels[group.Posts[0].ChannelId]))
+		for _, post := range group.Posts {
+			fmt.Fprintf(&sb, "- [@%s, %s](%s)\n",
+				group.UsersByID[post.UserId].Username,
+				model.GetTimeForMillis(post.CreateAt).UTC().Format("2006-01-02 15:04 MST"),
+				p.permalink(post.Id),
+			)
+		}
+	}
+
+	return strings.TrimSpace(sb.String())
+}
+
+// executeAskAllCommand answers a question from every channel the user can read, using the
+// vector index to find the relevant posts.
+func (p *Plugin) executeAskAllCommand(args *model.CommandArgs, params []string) (*model.CommandResponse, error) {
+	if !p.semanticSearchEnabled() {
+		return ephemeralResponse(args, "Workspace questions need semantic search, which is disabled."), nil
+	}
+
+	language, params, err := extractOption(params, "--lang")
+	if err != nil {
+		return ephemeralResponse(args, err.Error()), nil
+	}
+	filters, rest, err := parseSummaryFilters(params, time.Now())
+	if err == nil {
+		err = p.resolveSummaryFilters(filters)
+	}
+	if err != nil {
+		return ephemeralResponse(args, err.Error()), nil
+	}
+	if len(rest) == 0 {
+		return ephemeralResponse(args, "Usage: `/summarize ask-all [--since 7d] [--from @user] <question>`"), nil
+	}
+	question := strings.Join(rest, " ")
+
+	if err = p.checkLimits(args.UserId, args.TeamId); err != nil {
+		var limitErr *LimitExceededError
+		if errors.As(err, &limitErr) {
+			return ephemeralResponse(args, limitErr.Error()), nil
+		}
+		return nil, err
+	}
+
+	channels, err := p.searchableChannels(args.UserId)
+	if err != nil {
+		return nil, err
+	}
+	channelIDs := make([]string, 0, len(channels))
+	for channelID := range channels {
+		channelIDs = append(channelIDs, channelID)
+	}
+
+	ctx := withRequestInfo(context.Background(), RequestInfo{
+		UserID:    args.UserId,
+		TeamID:    args.TeamId,
+		ChannelID: args.ChannelId,
+	})
+
+	answer, err := p.answerWorkspaceQuestion(ctx, channelIDs, channels, question, filters, p.resolveLanguage(args.UserId, language))
+	if err != nil {
+		var llmErr *LLMError
+		if errors.As(err, &llmErr) {
+			_, message := p.handleLLMError(err, "user_id", args.UserId, "channel_id", args.ChannelId)
+			return ephemeralResponse(args, message), nil
+		}
+		return nil, err
+	}
+
+	return ephemeralResponse(args, answer), nil
+}
+
+func (p *Plugin) answerWorkspaceQuestion(ctx context.Context, channelIDs []string, channels map[string]*model.Channel, question string, filters *SummaryFilters, language string) (string, error) {
+	data, err := p.retrieveRelevantPosts(ctx, channelIDs, question, filters)
+	if err != nil {
+		return "", err
+	}
+	data = p.dropDisallowedChannels(data, channels)
+	if len(data.Posts) == 0 {
+		return "No posts related to the question were found in your channels.", nil
+	}
+
+	// Posts are numbered in the same order as the sources are listed, grouped by channel.
+	groups := groupPostsByChannel(data, channels)
+	grouped := &ThreadData{UsersByID: data.UsersByID, ChannelsByID: channels}
+	for _, group := range groups {
+		grouped.Posts = append(grouped.Posts, group.Posts...)
+	}
+
+	content, redactor := p.prepareThread(grouped)
+	p.auditSummarization(ctx, AuditOperationAskAll, "", grouped, content)
+	answer, err := p.getSummarizer().AnswerQuestionOnThread(ctx, content, redactor.RedactText(question), language)
+	if err != nil {
+		return "", err
+	}
+	answer, _ = p.verifyText(redactor.Restore(answer), grouped, redactor.Restore(content))
+	answer = p.linkCitations(answer, grouped.Posts)
+
+	return answer + "\n\n" + p.formatSources(groups, channels), nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupPostsByChannel(t *testing.T) {
+	channels := map[string]*model.Channel{
+		"town":   {Id: "town", DisplayName: "Town Square"},
+		"dev":    {Id: "dev", DisplayName: "Developers"},
+		"nodesc": {Id: "nodesc", Name: "a-channel"},
+	}
+	data := &ThreadData{
+		Posts: []*model.Post{
+			{Id: "1", ChannelId: "town"},
+			{Id: "2", ChannelId: "dev"},
+			{Id: "3", ChannelId: "town"},
+			{Id: "4", ChannelId: "nodesc"},
+		},
+	}
+
+	groups := groupPostsByChannel(data, channels)
+	require.Len(t, groups, 3)
+
+	assert.Equal(t, "nodesc", groups[0].Posts[0].ChannelId)
+	assert.Equal(t, "dev", groups[1].Posts[0].ChannelId)
+	require.Len(t, groups[2].Posts, 2)
+	assert.Equal(t, "1", groups[2].Posts[0].Id)
+	assert.Equal(t, "3", groups[2].Posts[1].Id)
+}
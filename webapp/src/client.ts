@@ -0,0 +1,148 @@
+import {Client4} from 'mattermost-redux/client';
+
+import {manifest} from '@/manifest';
+
+export type SummaryDestination = 'rhs' | 'ephemeral';
+
+export interface PostSummary {
+    result: string;
+    root_id: string;
+    channel_id: string;
+    post_count: number;
+}
+
+const apiURL = () => `${window.basename || ''}/plugins/${manifest.id}/api/v1`;
+
+export async function summarizePost(postId: string, destination: SummaryDestination): Promise<PostSummary> {
+    const response = await fetch(`${apiURL()}/post/${postId}/summarize`, Client4.getOptions({
+        method: 'POST',
+        body: JSON.stringify({destination}),
+    }));
+
+    const data = await response.json();
+    if (!response.ok) {
+        throw new Error(data.error || `Request failed with status ${response.status}`);
+    }
+
+    return data;
+}
+
+export interface PostTranslation {
+    post_id: string;
+    user_id: string;
+    username: string;
+    message: string;
+}
+
+export interface ThreadTranslation {
+    result: string;
+    translations: PostTranslation[];
+    language: string;
+    root_id: string;
+    channel_id: string;
+    post_count: number;
+}
+
+export async function translatePost(postId: string, destination: SummaryDestination, language?: string): Promise<ThreadTranslation> {
+    const response = await fetch(`${apiURL()}/post/${postId}/translate`, Client4.getOptions({
+        method: 'POST',
+        body: JSON.stringify({destination, language}),
+    }));
+
+    const data = await response.json();
+    if (!response.ok) {
+        throw new Error(data.error || `Request failed with status ${response.status}`);
+    }
+
+    return data;
+}
+
+export interface TranslatedSummary {
+    result: string;
+    language: string;
+    root_id: string;
+    channel_id: string;
+}
+
+export async function translateSummary(postId: string, summary: string, language?: string): Promise<TranslatedSummary> {
+    const response = await fetch(`${apiURL()}/post/${postId}/summary/translate`, Client4.getOptions({
+        method: 'POST',
+        body: JSON.stringify({summary, language}),
+    }));
+
+    const data = await response.json();
+    if (!response.ok) {
+        throw new Error(data.error || `Request failed with status ${response.status}`);
+    }
+
+    return data;
+}
+
+export interface BackendHealthStatus {
+    backend: string;
+    model: string;
+    healthy: boolean;
+    auth: 'ok' | 'invalid' | 'unknown';
+    model_status: 'available' | 'unavailable' | 'unknown';
+    latency_ms: number;
+    error?: string;
+    checked_at: number;
+}
+
+export interface Diagnosis {
+    healthy: boolean;
+    problems: string[];
+    backend: BackendHealthStatus | null;
+}
+
+// getHealth runs the diagnostics, or returns the last ones when cached is set. Unhealthy backends
+// are reported with a 503 that still carries the diagnosis.
+export async function getHealth(cached: boolean): Promise<Diagnosis> {
+    const response = await fetch(`${apiURL()}/health${cached ? '?cached=true' : ''}`, Client4.getOptions({
+        method: 'GET',
+    }));
+
+    const data = await response.json();
+    if (!response.ok && response.status !== 503) {
+        throw new Error(data.error || `Request failed with status ${response.status}`);
+    }
+
+    return data;
+}
+
+export interface CredentialInfo {
+    name: string;
+    backend: string;
+    team_id: string;
+    key_hint: string;
+    updated_at: number;
+    updated_by: string;
+}
+
+export async function getCredentials(): Promise<CredentialInfo[]> {
+    const response = await fetch(`${apiURL()}/admin/credentials`, Client4.getOptions({
+        method: 'GET',
+    }));
+
+    const data = await response.json();
+    if (!response.ok) {
+        throw new Error(data.error || `Request failed with status ${response.status}`);
+    }
+
+    return data;
+}
+
+// setAPIKey stores the key of the default OpenAI credential. The response only has a hint of the key.
+export async function setAPIKey(apiKey: string): Promise<CredentialInfo> {
+    const response = await fetch(`${apiURL()}/admin/credentials`, Client4.getOptions({
+        method: 'POST',
+        body: JSON.stringify({name: 'default', backend: 'openai', api_key: apiKey}),
+    }));
+
+    const data = await response.json();
+    if (!response.ok) {
+        throw new Error(data.error || `Request failed with status ${response.status}`);
+    }
+
+    return data;
+}
@@ -0,0 +1,58 @@
+import React, {useEffect, useState} from 'react';
+
+import {CredentialInfo, getCredentials, setAPIKey} from '@/client';
+
+// APIKeySetting stores the OpenAI API key in the encrypted credentials from the System Console.
+// The stored key is never shown, only its last characters.
+const APIKeySetting = () => {
+    const [credential, setCredential] = useState<CredentialInfo | null>(null);
+    const [apiKey, setAPIKeyInput] = useState('');
+    const [saving, setSaving] = useState(false);
+    const [error, setError] = useState('');
+
+    useEffect(() => {
+        getCredentials().then(
+            (credentials) => setCredential(credentials.find((c) => c.name === 'default') || null),
+            (e) => setError((e as Error).message),
+        );
+    }, []);
+
+    const save = async () => {
+        setSaving(true);
+        setError('');
+        try {
+            setCredential(await setAPIKey(apiKey.trim()));
+            setAPIKeyInput('');
+        } catch (e) {
+            setError((e as Error).message);
+        }
+        setSaving(false);
+    };
+
+    return (
+        <div>
+            <div>
+                {credential ? `A key ending in ${credential.key_hint} is stored, updated ${new Date(credential.updated_at).toLocaleString()}.` : 'No key is stored.'}
+            </div>
+            <input
+                type='password'
+                className='form-control'
+                autoComplete='off'
+                placeholder={credential ? 'Enter a new key to replace it' : 'Enter the API key'}
+                value={apiKey}
+                onChange={(e) => setAPIKeyInput(e.target.value)}
+            />
+            {error && <div className='error-text'>{`Could not store the key: ${error}`}</div>}
+            <button
+                type='button'
+                className='btn btn-tertiary'
+                disabled={saving || apiKey.trim() === ''}
+                onClick={save}
+            >
+                {saving ? 'Saving...' : 'Save key'}
+            </button>
+        </div>
+    );
+};
+
+export default APIKeySetting;
@@ -0,0 +1,72 @@
+import React, {useEffect, useState} from 'react';
+
+import {Diagnosis, getHealth} from '@/client';
+
+// BackendHealth shows the diagnostics of the plugin in the System Console.
+const BackendHealth = () => {
+    const [diagnosis, setDiagnosis] = useState<Diagnosis | null>(null);
+    const [checking, setChecking] = useState(false);
+    const [error, setError] = useState('');
+
+    const check = async (cached: boolean) => {
+        setChecking(true);
+        setError('');
+        try {
+            setDiagnosis(await getHealth(cached));
+        } catch (e) {
+            setError((e as Error).message);
+        }
+        setChecking(false);
+    };
+
+    useEffect(() => {
+        check(true);
+    }, []);
+
+    const backend = diagnosis?.backend;
+
+    return (
+        <div>
+            {error && <div className='error-text'>{`Could not check the backend: ${error}`}</div>}
+            {diagnosis && (
+                <div>
+                    <strong>{diagnosis.healthy ? 'Healthy' : 'Unhealthy'}</strong>
+                    {backend ? (
+                        <ul>
+                            <li>{`Backend: ${backend.backend}, model ${backend.model}`}</li>
+                            <li>{`Authentication: ${backend.auth}`}</li>
+                            <li>{`Model: ${backend.model_status}`}</li>
+                            <li>{`Latency: ${backend.latency_ms} ms`}</li>
+                            {backend.error && <li>{`Error: ${backend.error}`}</li>}
+                            <li>{`Checked at: ${new Date(backend.checked_at).toLocaleString()}`}</li>
+                        </ul>
+                    ) : (
+                        <div>{'The backend was not checked.'}</div>
+                    )}
+                    {diagnosis.problems.length > 0 && (
+                        <ul>
+                            {diagnosis.problems.map((problem) => (
+                                <li
+                                    key={problem}
+                                    className='error-text'
+                                >
+                                    {problem}
+                                </li>
+                            ))}
+                        </ul>
+                    )}
+                </div>
+            )}
+            <button
+                type='button'
+                className='btn btn-tertiary'
+                disabled={checking}
+                onClick={() => check(false)}
+            >
+                {checking ? 'Checking...' : 'Test connection'}
+            </button>
+        </div>
+    );
+};
+
+export default BackendHealth;
@@ -0,0 +1,69 @@
+import React, {useEffect, useState} from 'react';
+
+import {translateSummary} from '@/client';
+
+export interface SummaryState {
+    loading: boolean;
+    translating?: boolean;
+    summary?: string;
+    error?: string;
+
+    // rootId is set for summaries of a thread, which can then be translated.
+    rootId?: string;
+}
+
+let state: SummaryState = {loading: false};
+const listeners = new Set<(state: SummaryState) => void>();
+
+export function setSummaryState(newState: SummaryState) {
+    state = newState;
+    listeners.forEach((listener) => listener(state));
+}
+
+async function translateCurrentSummary(rootId: string, summary: string) {
+    setSummaryState({loading: true, translating: true});
+    try {
+        const translation = await translateSummary(rootId, summary);
+        setSummaryState({loading: false, translating: true, summary: translation.result});
+    } catch (error) {
+        setSummaryState({loading: false, translating: true, error: (error as Error).message});
+    }
+}
+
+const SummaryRHS = () => {
+    const [current, setCurrent] = useState(state);
+
+    useEffect(() => {
+        listeners.add(setCurrent);
+        return () => {
+            listeners.delete(setCurrent);
+        };
+    }, []);
+
+    if (current.loading) {
+        return <div style={{padding: '16px'}}>{current.translating ? 'Translating...' : 'Summarizing thread...'}</div>;
+    }
+
+    if (current.error) {
+        return <div style={{padding: '16px'}}>{`Could not ${current.translating ? 'translate' : 'summarize'} the thread: ${current.error}`}</div>;
+    }
+
+    const {rootId, summary} = current;
+
+    return (
+        <div style={{padding: '16px'}}>
+            <div style={{whiteSpace: 'pre-wrap'}}>{summary}</div>
+            {rootId && summary && (
+                <button
+                    className='btn btn-tertiary'
+                    style={{marginTop: '12px'}}
+                    onClick={() => translateCurrentSummary(rootId, summary)}
+                >
+                    {'Translate to my language'}
+                </button>
+            )}
+        </div>
+    );
+};
+
+export default SummaryRHS;
@@ -6,17 +6,48 @@ import {manifest} from '@/manifest';
 
 import {PluginRegistry} from '@/types/mattermost-webapp';
 
+import {summarizePost, translatePost} from '@/client';
+import APIKeySetting from '@/components/api_key_setting';
+import BackendHealth from '@/components/backend_health';
+import SummaryRHS, {setSummaryState} from '@/components/summary_rhs';
+
 export default class Plugin {
-    // eslint-disable-next-line @typescript-eslint/no-unused-vars, @typescript-eslint/no-empty-function
+    // eslint-disable-next-line @typescript-eslint/no-unused-vars
     public async initialize(registry: PluginRegistry, store: Store<GlobalState, Action<Record<string, unknown>>>) {
         // @see https://developers.mattermost.com/extend/plugins/webapp/reference/
-        //
+        const {showRHSPlugin} = registry.registerRightHandSidebarComponent(SummaryRHS, 'Thread Summary');
+
+        registry.registerAdminConsoleCustomSetting('OpenAIAPIKey', APIKeySetting);
+        registry.registerAdminConsoleCustomSetting('BackendHealth', BackendHealth);
+
+        registry.registerPostDropdownMenuAction('Summarize thread', async (postId: string) => {
+            store.dispatch(showRHSPlugin);
+            setSummaryState({loading: true});
+            try {
+                const summary = await summarizePost(postId, 'rhs');
+                setSummaryState({loading: false, summary: summary.result, rootId: summary.root_id});
+            } catch (error) {
+                setSummaryState({loading: false, error: (error as Error).message});
+            }
+        });
+
+        registry.registerPostDropdownMenuAction('Translate thread', async (postId: string) => {
+            store.dispatch(showRHSPlugin);
+            setSummaryState({loading: true, translating: true});
+            try {
+                const translation = await translatePost(postId, 'rhs');
+                setSummaryState({loading: false, translating: true, summary: translation.result});
+            } catch (error) {
+                setSummaryState({loading: false, translating: true, error: (error as Error).message});
+            }
+        });
     }
 }
 
 declare global {
     interface Window {
         registerPlugin(pluginId: string, plugin: Plugin): void
+        basename?: string
     }
 }
 
@@ -1,5 +1,10 @@
+import {Action} from 'redux';
+
 export interface PluginRegistry {
     registerPostTypeComponent(typeName: string, component: React.ElementType)
+    registerPostDropdownMenuAction(text: string, action: (postId: string) => void, filter?: (postId: string) => boolean)
+    registerRightHandSidebarComponent(component: React.ElementType, title: string): {id: string, showRHSPlugin: Action, hideRHSPlugin: Action, toggleRHSPlugin: Action}
+    registerAdminConsoleCustomSetting(key: string, component: React.ElementType, options?: {showTitle: boolean})
 
     // Add more if needed from https://developers.mattermost.com/extend/plugins/webapp/reference
 }